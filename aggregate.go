@@ -0,0 +1,90 @@
+package mongods
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-datastore/query"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// AggregateQuery runs pipeline over the key-values of the datastore and
+// returns the resulting documents as entries, for the queries the datastore
+// query API can't express. The pipeline only sees the documents of the
+// namespace. Each resulting document gives the key of its entry in _id,
+// or in k for hashed keys, and its value in v, or in the field set by
+// WithValueField.
+//
+// Values are returned as they're stored: GridFS files aren't
+// downloaded, and compressed or encrypted values aren't decoded, unless the
+// pipeline handles them. Closing the results closes the aggregation cursor.
+func (m *MongoDS) AggregateQuery(ctx context.Context, pipeline mongo.Pipeline) (query.Results, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	return m.aggregateQuery(ctx, pipeline)
+}
+
+func (m *MongoDS) aggregateQuery(ctx context.Context, pipeline mongo.Pipeline) (_ query.Results, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return nil, err
+	}
+	aggCtx, end := m.startOp(ctx, "aggregateQuery", "")
+	defer end(&err)
+	aggCtx, cls := withTimeout(aggCtx, m.queryTimeout)
+	defer cls()
+
+	stages := append(mongo.Pipeline{{{Key: "$match", Value: m.prefixFilter("/")}}}, pipeline...)
+	cur, err := m.queryReader(aggCtx).Aggregate(aggCtx, stages)
+	if err != nil {
+		return nil, fmt.Errorf("running aggregation: %w", err)
+	}
+
+	// The cursor is in flight until it's closed, which the results do
+	// once they're closed or fully read.
+	m.active.Add(1)
+	var (
+		once sync.Once
+		done bool
+	)
+	closeCursor := func() (err error) {
+		once.Do(func() {
+			defer m.active.Done()
+			err = cur.Close(context.Background())
+		})
+		return err
+	}
+	return query.ResultsFromIterator(query.Query{}, query.Iterator{
+		Next: func() (query.Result, bool) {
+			if done {
+				return query.Result{}, false
+			}
+			nctx, cls := context.WithTimeout(ctx, m.queryTimeout)
+			defer cls()
+			if !cur.Next(nctx) {
+				done = true
+				if err := cur.Err(); err != nil {
+					return query.Result{Error: fmt.Errorf("iterating aggregation: %w", err)}, true
+				}
+				return query.Result{}, false
+			}
+			var kv keyValue
+			if err := cur.Decode(&kv); err != nil {
+				return query.Result{Error: fmt.Errorf("decoding aggregation result: %w", err)}, true
+			}
+			key, err := m.kvKey(kv)
+			if err != nil {
+				return query.Result{Error: err}, true
+			}
+			return query.Result{Entry: query.Entry{
+				Key:   key,
+				Value: kv.Value,
+				Size:  len(kv.Value),
+			}}, true
+		},
+		Close: closeCursor,
+	}), nil
+}
@@ -0,0 +1,346 @@
+package mongods
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CompareAndSwap sets the value of key to new if its current value is old,
+// with a single conditional update, and returns whether it did. A nil old
+// value means the key must not exist, in which case it's inserted only
+// if absent. Swapping drops the expiration the key may have had.
+func (m *MongoDS) CompareAndSwap(ctx context.Context, key datastore.Key, old, new []byte) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return false, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.compareAndSwap(ctx, key, old, new)
+}
+
+func (m *MongoDS) compareAndSwap(ctx context.Context, key datastore.Key, old, new []byte) (swapped bool, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return false, err
+	}
+	ctx, end := m.startOp(ctx, "compareAndSwap", key.String())
+	defer end(&err)
+
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return false, err
+	}
+	ev, err := m.encode(m.idString(key), new)
+	if err != nil {
+		return false, err
+	}
+	update := m.putUpdate(ev, nil)
+	if m.inGridFS(ev) {
+		fid, err := m.uploadFile(ctx, key, ev.data)
+		if err != nil {
+			return false, err
+		}
+		defer func() {
+			if !swapped {
+				m.deleteFile(ctx, fid)
+			}
+		}()
+		update = m.filePutUpdate(fid, ev, nil)
+	}
+
+	if old == nil {
+		opts := options.Update().SetUpsert(true)
+		res, err := m.col.UpdateOne(ctx, filter, m.insertOnly(update, key), opts)
+		if err != nil {
+			return false, fmt.Errorf("inserting key-value: %w", err)
+		}
+		return res.UpsertedCount == 1, nil
+	}
+
+	filter, prev, ok, err := m.valueFilter(ctx, key, old)
+	if !ok || err != nil {
+		return false, err
+	}
+	res, err := m.col.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, fmt.Errorf("updating key-value: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return false, nil
+	}
+	m.replacedFile(ctx, prev)
+	return true, nil
+}
+
+// valueFilter returns the filter matching the document of key only while
+// it stores val, along with the GridFS file holding val, if any. Stored
+// values can only be compared server-side if they're stored as is.
+// Otherwise, the current value is compared client-side, and the filter
+// matches the document only if it still stores it: each write stores a
+// new nonce or GridFS file, which tells versions apart. It returns false
+// if the key was found not to store val client-side.
+func (m *MongoDS) valueFilter(ctx context.Context, key datastore.Key, val []byte) (bson.M, *primitive.ObjectID, bool, error) {
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if m.rawValues() {
+		filter[m.valueField] = val
+		if len(val) == 0 {
+			filter[m.valueField] = bson.M{"$in": bson.A{nil, []byte{}}}
+		}
+		return filter, nil, true, nil
+	}
+
+	// Read from the primary, as a stale value would never match.
+	kv, err := m.findKeyValue(ctx, m.col, key)
+	if errors.Is(err, datastore.ErrNotFound) {
+		return nil, nil, false, nil
+	}
+	if err != nil {
+		return nil, nil, false, err
+	}
+	cur, err := m.loadValue(ctx, kv)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if !bytes.Equal(cur, val) {
+		return nil, nil, false, nil
+	}
+	filter[m.valueField] = kv.Value
+	if kv.File != nil {
+		filter["f"] = *kv.File
+	}
+	if kv.Nonce != nil {
+		filter["n"] = kv.Nonce
+	}
+	return filter, kv.File, true, nil
+}
+
+// DeleteIf deletes key if its current value is expected, with a single
+// conditional delete, and returns whether it did. It allows releasing a
+// lease, or clearing some state, only if it wasn't changed since it was
+// read.
+func (m *MongoDS) DeleteIf(ctx context.Context, key datastore.Key, expected []byte) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return false, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.deleteIf(ctx, key, expected)
+}
+
+func (m *MongoDS) deleteIf(ctx context.Context, key datastore.Key, expected []byte) (deleted bool, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return false, err
+	}
+	ctx, end := m.startOp(ctx, "deleteIf", key.String())
+	defer end(&err)
+
+	filter, file, ok, err := m.valueFilter(ctx, key, expected)
+	if !ok || err != nil {
+		return false, err
+	}
+	res, err := m.col.DeleteOne(ctx, filter)
+	if err != nil {
+		return false, fmt.Errorf("deleting key-value: %w", err)
+	}
+	if res.DeletedCount == 0 {
+		return false, nil
+	}
+	m.replacedFile(ctx, file)
+	return true, nil
+}
+
+// GetAndDelete atomically deletes key and returns the value it had, or
+// ErrNotFound if it doesn't exist. Among concurrent callers, only one
+// gets the value.
+func (m *MongoDS) GetAndDelete(ctx context.Context, key datastore.Key) ([]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.getAndDelete(ctx, key)
+}
+
+func (m *MongoDS) getAndDelete(ctx context.Context, key datastore.Key) (_ []byte, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return nil, err
+	}
+	ctx, end := m.startOp(ctx, "getAndDelete", key.String())
+	defer end(&err)
+
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return nil, err
+	}
+	var kv keyValue
+	if err := m.col.FindOneAndDelete(ctx, filter).Decode(&kv); err != nil {
+		return nil, readErr("deleting key-value", err)
+	}
+	// The file is read before being deleted, since the document
+	// that referenced it is already gone.
+	val, err := m.loadValue(ctx, kv)
+	m.replacedFile(ctx, kv.File)
+	return val, err
+}
+
+// GetAndPut atomically sets the value of key to new and returns the value
+// it replaced. existed is false if the key was inserted. Like Put, it drops
+// the expiration the key may have had.
+func (m *MongoDS) GetAndPut(ctx context.Context, key datastore.Key, new []byte) (old []byte, existed bool, err error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, false, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.getAndPut(ctx, key, new)
+}
+
+func (m *MongoDS) getAndPut(ctx context.Context, key datastore.Key, new []byte) (old []byte, existed bool, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return nil, false, err
+	}
+	ctx, end := m.startOp(ctx, "getAndPut", key.String())
+	defer end(&err)
+
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return nil, false, err
+	}
+	ev, err := m.encode(m.idString(key), new)
+	if err != nil {
+		return nil, false, err
+	}
+	update := m.putUpdate(ev, nil)
+	var file *primitive.ObjectID
+	if m.inGridFS(ev) {
+		fid, err := m.uploadFile(ctx, key, ev.data)
+		if err != nil {
+			return nil, false, err
+		}
+		file = &fid
+		update = m.filePutUpdate(fid, ev, nil)
+	}
+
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetReturnDocument(options.Before)
+	var prev keyValue
+	err = m.col.FindOneAndUpdate(ctx, filter, m.upsertKey(update, key), opts).Decode(&prev)
+	if err == mongo.ErrNoDocuments {
+		return nil, false, nil
+	}
+	if err != nil {
+		if file != nil {
+			m.deleteFile(ctx, *file)
+		}
+		return nil, false, fmt.Errorf("inserting/updating key-value: %w", err)
+	}
+	old, err = m.loadValue(ctx, prev)
+	m.replacedFile(ctx, prev.File)
+	if err != nil {
+		return nil, true, err
+	}
+	return old, true, nil
+}
+
+// PutIfChanged stores val as the value of key unless it's already its
+// value, and returns whether it wrote. Skipping unchanged values avoids
+// oplog entries and index updates for hot keys that are rewritten with
+// the same value. Unlike Put, a skipped write keeps the expiration the key
+// may have had. When values are stored as is, it's done with a single
+// update that excludes the documents already storing val. Otherwise, or
+// within transactions, the stored value must be read and compared
+// client-side first, which costs an extra round-trip.
+func (m *MongoDS) PutIfChanged(ctx context.Context, key datastore.Key, val []byte) (bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return false, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.putIfChanged(ctx, key, val)
+}
+
+func (m *MongoDS) putIfChanged(ctx context.Context, key datastore.Key, val []byte) (changed bool, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return false, err
+	}
+	ctx, end := m.startOp(ctx, "putIfChanged", key.String())
+	defer end(&err)
+
+	// A failed write aborts the transaction it runs in, so the
+	// duplicate key error trick below can't be used in transactions.
+	if !m.rawValues() || inTransaction(ctx) {
+		cur, err := m.findKeyValue(ctx, m.col, key)
+		if err != nil && !errors.Is(err, datastore.ErrNotFound) {
+			return false, err
+		}
+		if err == nil {
+			v, err := m.loadValue(ctx, cur)
+			if err != nil {
+				return false, err
+			}
+			if bytes.Equal(v, val) {
+				return false, nil
+			}
+		}
+		if err := m.writeValue(ctx, key, val, nil); err != nil {
+			return false, fmt.Errorf("inserting/updating key-value: %w", err)
+		}
+		return true, nil
+	}
+
+	// If the key already stores val, the filter doesn't match and the
+	// upsert fails to insert a document with the same _id. The upsert
+	// may also fail if a concurrent one inserted the key since the filter
+	// didn't match, in which case it's retried once to match the
+	// inserted document if it stores another value.
+	var differs interface{} = bson.M{"$ne": val}
+	if len(val) == 0 {
+		differs = bson.M{"$nin": bson.A{nil, []byte{}}}
+	}
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return false, err
+	}
+	filter[m.valueField] = differs
+	ev := encodedValue{data: val, size: len(val)}
+	update := m.upsertKey(m.putUpdate(ev, nil), key)
+	for attempt := 1; ; attempt++ {
+		_, err = m.col.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+		if !mongo.IsDuplicateKeyError(err) {
+			break
+		}
+		if attempt == 2 {
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, fmt.Errorf("inserting/updating key-value: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,35 @@
+package mongods
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BackoffFunc returns how long to wait before the given retry attempt,
+// starting at 1 for the first retry.
+type BackoffFunc func(attempt int) time.Duration
+
+// ConstantBackoff returns a BackoffFunc waiting d before every retry.
+func ConstantBackoff(d time.Duration) BackoffFunc {
+	return func(int) time.Duration {
+		return d
+	}
+}
+
+// ExponentialBackoff returns a BackoffFunc waiting a random delay between
+// zero and base doubled at every attempt, capped at max. The jitter keeps
+// clients that failed together from retrying in lockstep.
+func ExponentialBackoff(base, max time.Duration) BackoffFunc {
+	return func(attempt int) time.Duration {
+		d := max
+		if attempt < 32 {
+			if b := base << uint(attempt-1); b > 0 && b < max {
+				d = b
+			}
+		}
+		if d <= 0 {
+			return 0
+		}
+		return time.Duration(rand.Int63n(int64(d) + 1))
+	}
+}
@@ -4,11 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/ipfs/go-datastore"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -21,9 +22,25 @@ type mongoBatch struct {
 	lock sync.Mutex
 
 	commited bool
-	deletes  map[datastore.Key]struct{}
-	upserts  map[datastore.Key][]byte
-	ds       *MongoDS
+	// ops keeps the queued operations in the order they were
+	// issued. A document is written at most once: a later Put or
+	// Delete of a key stored in the same document replaces the
+	// earlier operation, so the result doesn't depend on the bulk
+	// write being ordered. keys indexes them by docKey.
+	ops  []mongo.WriteModel
+	keys map[string]int
+	ds   *MongoDS
+	// sizes holds the approximate size of each queued operation, so
+	// flushes can be split to stay under the BSON size limit.
+	sizes []int
+	// txn is the transaction the operations are written within, if
+	// the batch was created by one.
+	txn *mongoTxn
+	// unordered is set if operations are flushed with unordered bulk
+	// writes.
+	unordered bool
+	// ctx bounds the writes of the batch, if it isn't nil.
+	ctx context.Context
 }
 
 func (mb *mongoBatch) Put(key datastore.Key, val []byte) error {
@@ -33,9 +50,51 @@ func (mb *mongoBatch) Put(key datastore.Key, val []byte) error {
 		return ErrBatchAlreadyCommited
 	}
 
-	mb.upserts[key] = val
-	delete(mb.deletes, key)
-	return nil
+	// The file is left for CollectGarbage if the batch doesn't end up
+	// writing it.
+	ctx, cls := context.WithTimeout(context.Background(), mb.ds.opTimeout)
+	defer cls()
+	upsOp, err := mb.ds.putModel(ctx, key, val, false, nil)
+	if err != nil {
+		return err
+	}
+	mb.queue(key, upsOp, len(key.String())+len(val))
+	return mb.maybeFlush()
+}
+
+// putModel returns the upsert storing val as the value of key, for a bulk
+// write. Large values are uploaded to GridFS right away, so the upsert only
+// writes the pointer document. If insertOnly is true, the upsert doesn't
+// change the value of key if it's already stored. The key expires at
+// expireAt, unless it's nil.
+func (m *MongoDS) putModel(ctx context.Context, key datastore.Key, val []byte, insertOnly bool, expireAt *time.Time) (*mongo.UpdateOneModel, error) {
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return nil, err
+	}
+	ev, err := m.encode(m.idString(key), val)
+	if err != nil {
+		return nil, err
+	}
+	update := m.putUpdate(ev, expireAt)
+	if m.inGridFS(ev) {
+		id, err := m.uploadFile(ctx, key, ev.data)
+		if err != nil {
+			return nil, err
+		}
+		update = m.filePutUpdate(id, ev, expireAt)
+	}
+	if insertOnly {
+		update = m.insertOnly(update, key)
+	} else {
+		update = m.upsertKey(update, key)
+	}
+
+	upsOp := mongo.NewUpdateOneModel()
+	upsOp.SetUpsert(true)
+	upsOp.SetFilter(filter)
+	upsOp.SetUpdate(update)
+	return upsOp, nil
 }
 
 func (mb *mongoBatch) Delete(key datastore.Key) error {
@@ -45,9 +104,14 @@ func (mb *mongoBatch) Delete(key datastore.Key) error {
 		return ErrBatchAlreadyCommited
 	}
 
-	mb.deletes[key] = struct{}{}
-	delete(mb.upserts, key)
-	return nil
+	filter, err := mb.ds.docFilter(key)
+	if err != nil {
+		return err
+	}
+	delOp := mongo.NewDeleteOneModel()
+	delOp.SetFilter(filter)
+	mb.queue(key, delOp, len(key.String()))
+	return mb.maybeFlush()
 }
 
 func (mb *mongoBatch) Commit() error {
@@ -57,32 +121,316 @@ func (mb *mongoBatch) Commit() error {
 		return ErrBatchAlreadyCommited
 	}
 
-	operations := make([]mongo.WriteModel, 0, len(mb.deletes)+len(mb.upserts))
-	if cap(operations) == 0 {
-		mb.commited = true
+	if err := mb.flush(); err != nil {
+		return fmt.Errorf("committing batch: %w", err)
+	}
+	mb.commited = true
+	return nil
+}
+
+// queue adds op for key, of approximately size bytes, replacing any
+// operation already queued for a key stored in the same document. Must be
+// called with the lock held.
+func (mb *mongoBatch) queue(key datastore.Key, op mongo.WriteModel, size int) {
+	k := mb.ds.docKey(key)
+	if i, ok := mb.keys[k]; ok {
+		mb.ops[i] = op
+		mb.sizes[i] = size
+		return
+	}
+	mb.keys[k] = len(mb.ops)
+	mb.ops = append(mb.ops, op)
+	mb.sizes = append(mb.sizes, size)
+}
+
+// maybeFlush flushes the queued operations if the configured
+// threshold was reached. Must be called with the lock held.
+func (mb *mongoBatch) maybeFlush() error {
+	if mb.ds.batchFlushThreshold <= 0 || len(mb.ops) < mb.ds.batchFlushThreshold {
 		return nil
 	}
-	for k := range mb.deletes {
-		delOp := mongo.NewDeleteOneModel()
-		delOp.SetFilter(bson.M{"_id": k.String()})
-		operations = append(operations, delOp)
+	if err := mb.flush(); err != nil {
+		return fmt.Errorf("flushing batch: %w", err)
 	}
-	for k, v := range mb.upserts {
-		upsOp := mongo.NewUpdateOneModel()
-		upsOp.SetUpsert(true)
-		upsOp.SetFilter(bson.M{"_id": k.String()})
-		upsOp.SetUpdate(bson.M{"$set": bson.M{"v": v}})
-		operations = append(operations, upsOp)
+	return nil
+}
+
+// flush writes all queued operations and resets the queue. Operations
+// are written with as few BulkWrite calls as possible, each staying under
+// the BSON size limit. When the batch is ordered, the calls are made one
+// after the other, and the first failure stops the flush: the operations
+// already written are removed from the queue, the others are kept. When
+// it's unordered, only the operations of the calls that failed without
+// reaching the server are kept. Must be called with the lock held.
+func (mb *mongoBatch) flush() error {
+	if len(mb.ops) == 0 {
+		return nil
 	}
 
-	bulkOption := options.BulkWriteOptions{}
-	bulkOption.SetOrdered(false) // Will do things in parallel
-	ctx, cls := context.WithTimeout(context.Background(), mb.ds.opTimeout*time.Duration(len(operations)))
-	defer cls()
-	if _, err := mb.ds.col.BulkWrite(ctx, operations, &bulkOption); err != nil {
-		return fmt.Errorf("committing batch: %s", err)
+	var failed []chunkError
+	// Sessions aren't goroutine-safe, so batches of a transaction are
+	// always flushed serially.
+	if mb.unordered && mb.ds.batchConcurrency > 1 && mb.txn == nil {
+		failed = mb.flushParallel()
+	} else {
+		bulkOption := options.BulkWrite().SetOrdered(!mb.unordered)
+		start := 0
+		for _, end := range splitOps(mb.sizes, bulkBatchBytes, 0) {
+			err := mb.write(start, end, bulkOption)
+			if err != nil && !mb.unordered {
+				// An ordered bulk write stops at the first failed
+				// operation, after applying the ones before it.
+				applied := firstWriteError(err)
+				if applied < 0 {
+					applied = 0
+				}
+				mb.dequeue(start + applied)
+				return err
+			}
+			if err != nil {
+				failed = append(failed, chunkError{start: start, end: end, err: err})
+			}
+			start = end
+		}
 	}
 
-	mb.commited = true
+	// Unordered writes are best-effort, so the operations the server
+	// got are dequeued even if some of them failed, but the ones of the
+	// calls that failed as a whole are kept for the next flush.
+	keep := make([]bool, len(mb.ops))
+	errs := make([]error, len(failed))
+	for i, f := range failed {
+		errs[i] = f.error()
+		if !reachedServer(f.err) {
+			for j := f.start; j < f.end; j++ {
+				keep[j] = true
+			}
+		}
+	}
+	mb.retain(keep)
+	if len(errs) > 0 {
+		// Offsetting the write errors drops the kind of the errors
+		// they come from, so conflicts are recognized again.
+		return conflictErr(joinWriteErrors(errs...))
+	}
 	return nil
 }
+
+// chunkError is the error of the BulkWrite call writing the queued
+// operations from start to end.
+type chunkError struct {
+	start, end int
+	err        error
+}
+
+// error returns the error of the call, with the indexes of the operations
+// that failed counted among all the queued operations, or naming the
+// operations written if the call failed as a whole.
+func (c chunkError) error() error {
+	if reachedServer(c.err) {
+		return offsetWriteErrors(c.err, c.start)
+	}
+	return fmt.Errorf("writing operations %d to %d: %w", c.start, c.end-1, c.err)
+}
+
+// reachedServer returns true if err is the error of a BulkWrite call the
+// server ran, which reports the operations that failed, if any.
+func reachedServer(err error) bool {
+	var bwe mongo.BulkWriteException
+	return errors.As(err, &bwe)
+}
+
+// flushParallel writes the queued operations of an unordered batch with
+// up to batchConcurrency concurrent BulkWrite calls, and returns the
+// errors of the calls that failed. Operations are split in at least as
+// many chunks as there are workers. Must be called with the lock held.
+func (mb *mongoBatch) flushParallel() []chunkError {
+	n := mb.ds.batchConcurrency
+	perChunk := (len(mb.ops) + n - 1) / n
+	bulkOption := options.BulkWrite().SetOrdered(false)
+
+	var (
+		wg     sync.WaitGroup
+		lock   sync.Mutex
+		failed []chunkError
+	)
+	sem := make(chan struct{}, n)
+	start := 0
+	for _, end := range splitOps(mb.sizes, bulkBatchBytes, perChunk) {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(start, end int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if err := mb.write(start, end, bulkOption); err != nil {
+				lock.Lock()
+				failed = append(failed, chunkError{start: start, end: end, err: err})
+				lock.Unlock()
+			}
+		}(start, end)
+		start = end
+	}
+	wg.Wait()
+
+	// Chunks may fail in any order, so failures are reported by
+	// increasing operation index.
+	sort.Slice(failed, func(i, j int) bool {
+		return failed[i].start < failed[j].start
+	})
+	return failed
+}
+
+// write runs the queued operations from start to end in a BulkWrite call,
+// within the transaction of the batch if it has one. Each call is admitted
+// as a single write.
+func (mb *mongoBatch) write(start, end int, opts *options.BulkWriteOptions) (err error) {
+	timeout := mb.ds.opTimeout * time.Duration(end-start)
+	if mb.txn != nil {
+		return mb.txn.bulkWrite(mb.ops[start:end], opts, timeout)
+	}
+	parent := mb.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, cls := context.WithTimeout(parent, timeout)
+	defer cls()
+	if err = mb.ds.admit(ctx, writeOp); err != nil {
+		return err
+	}
+	ctx, done := mb.ds.startOp(ctx, "batchWrite", "")
+	defer done(&err)
+	ops := mb.ops[start:end]
+	if !mb.ds.retriesWrites(ctx) {
+		_, err = mb.ds.col.BulkWrite(ctx, ops, opts)
+		return err
+	}
+	ops, pinned, err := mb.ds.pinVersions(ctx, ops)
+	if err != nil {
+		return err
+	}
+	return mb.ds.retryWrite(ctx, func() error {
+		return mb.ds.bulkWritePinned(ctx, ops, pinned, opts)
+	})
+}
+
+// dequeue removes the first n queued operations. Must be called with the
+// lock held.
+func (mb *mongoBatch) dequeue(n int) {
+	keep := make([]bool, len(mb.ops))
+	for i := n; i < len(keep); i++ {
+		keep[i] = true
+	}
+	mb.retain(keep)
+}
+
+// retain removes the queued operations but the ones keep is true for,
+// which keep their order. Must be called with the lock held.
+func (mb *mongoBatch) retain(keep []bool) {
+	index := make([]int, len(mb.ops))
+	ops, sizes := mb.ops[:0:0], mb.sizes[:0:0]
+	for i, op := range mb.ops {
+		index[i] = -1
+		if keep[i] {
+			index[i] = len(ops)
+			ops = append(ops, op)
+			sizes = append(sizes, mb.sizes[i])
+		}
+	}
+	keys := make(map[string]int, len(ops))
+	for k, i := range mb.keys {
+		if index[i] >= 0 {
+			keys[k] = index[i]
+		}
+	}
+	mb.ops, mb.sizes, mb.keys = ops, sizes, keys
+}
+
+// splitOps splits operations of the given sizes into consecutive groups
+// of at most max bytes, and of at most maxOps operations if maxOps > 0,
+// and returns the end index of each group. An operation larger than max
+// gets a group of its own.
+func splitOps(sizes []int, max, maxOps int) []int {
+	var ends []int
+	size, start := 0, 0
+	for i, s := range sizes {
+		if i > 0 && (size+s > max || (maxOps > 0 && i-start >= maxOps)) {
+			ends = append(ends, i)
+			size, start = 0, i
+		}
+		size += s
+	}
+	return append(ends, len(sizes))
+}
+
+// firstWriteError returns the index of the first operation that failed
+// in err, or -1 if err doesn't report individual operations.
+func firstWriteError(err error) int {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || len(bwe.WriteErrors) == 0 {
+		return -1
+	}
+	return bwe.WriteErrors[0].Index
+}
+
+// joinWriteErrors collects every per-operation failure of the bulk
+// writes that failed with errs, along with the errors of the ones that
+// failed as a whole, into a single error, which wraps the first of them.
+func joinWriteErrors(errs ...error) error {
+	if len(errs) == 1 && !reachedServer(errs[0]) {
+		return errs[0]
+	}
+	var msgs []string
+	failedOps := 0
+	for _, err := range errs {
+		var bwe mongo.BulkWriteException
+		if !errors.As(err, &bwe) {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		for _, we := range bwe.WriteErrors {
+			msgs = append(msgs, fmt.Sprintf("operation %d: %s", we.Index, we.Message))
+			failedOps++
+		}
+		if len(bwe.WriteErrors) == 0 {
+			msgs = append(msgs, err.Error())
+		}
+	}
+	msg := strings.Join(msgs, "; ")
+	if failedOps > 0 {
+		msg = fmt.Sprintf("%d operations failed: %s", failedOps, msg)
+	}
+	return &writeErrors{msg: msg, err: errs[0]}
+}
+
+// offsetWriteErrors shifts the indexes of the operations that failed in
+// err by offset, the index of the first operation of its bulk write among
+// all the operations being written.
+func offsetWriteErrors(err error, offset int) error {
+	var bwe mongo.BulkWriteException
+	if offset == 0 || !errors.As(err, &bwe) {
+		return err
+	}
+	wes := make([]mongo.BulkWriteError, len(bwe.WriteErrors))
+	for i, we := range bwe.WriteErrors {
+		we.Index += offset
+		wes[i] = we
+	}
+	bwe.WriteErrors = wes
+	return bwe
+}
+
+// writeErrors is the error of bulk writes some operations of which failed.
+type writeErrors struct {
+	msg string
+	err error
+}
+
+func (e *writeErrors) Error() string {
+	return e.msg
+}
+
+func (e *writeErrors) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,84 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var ErrUnavailable = errors.New("MongoDB is unavailable")
+
+// circuitBreaker fails operations fast while MongoDB looks unavailable. It
+// opens after threshold consecutive operations failed with a timeout or a
+// network error, and fails operations with ErrUnavailable for cooldown.
+// It then lets a single operation through to probe whether MongoDB is
+// back: the breaker closes if it succeeds, and opens again otherwise. A nil
+// breaker lets every operation through.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	logger    Logger
+
+	lock      sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration, logger Logger) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, logger: logger}
+}
+
+// allow returns ErrUnavailable if the breaker is open, or if it's probing
+// and another operation is already the probe.
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.failures < b.threshold {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return ErrUnavailable
+	}
+	b.probing = true
+	return nil
+}
+
+// record updates the breaker with the outcome of an operation. Only
+// timeouts and network errors count as failures: other errors, such as
+// ErrNotFound, show that MongoDB is reachable.
+func (b *circuitBreaker) record(err error) {
+	if b == nil || errors.Is(err, ErrUnavailable) {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	wasOpen := b.failures >= b.threshold
+	if !isUnavailable(err) {
+		if wasOpen {
+			b.logger.Warnf("circuit breaker closed, MongoDB is available again")
+		}
+		b.failures, b.probing = 0, false
+		return
+	}
+	b.failures++
+	b.probing = false
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		if !wasOpen {
+			b.logger.Errorf("circuit breaker opened after %d failed operations: %s", b.failures, err)
+		}
+	}
+}
+
+// isUnavailable returns true if err shows that MongoDB couldn't be reached
+// in time.
+func isUnavailable(err error) bool {
+	return err != nil && (errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err) || mongo.IsNetworkError(err))
+}
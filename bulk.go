@@ -0,0 +1,177 @@
+package mongods
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// bulkBatchBytes bounds the size of the values written by a single bulk
+// write of a bulk operation, on top of the batch flush threshold.
+const bulkBatchBytes = 16 << 20
+
+// BulkOption configures an operation over many keys, such as Export.
+type BulkOption func(*bulkConfig)
+
+type bulkConfig struct {
+	prefix       datastore.Key
+	skipExisting bool
+	progress     func(done, total int)
+}
+
+// WithPrefix restricts the operation to the keys strictly below prefix.
+func WithPrefix(prefix datastore.Key) BulkOption {
+	return func(c *bulkConfig) {
+		c.prefix = prefix
+	}
+}
+
+// WithSkipExisting makes the operation leave the keys already stored
+// untouched, instead of overwriting them, so an interrupted restore can
+// be resumed by running it again.
+func WithSkipExisting(skip bool) BulkOption {
+	return func(c *bulkConfig) {
+		c.skipExisting = skip
+	}
+}
+
+// WithProgress makes the operation call fn as it progresses, with the
+// number of keys processed so far and the total number of keys to process,
+// or -1 if the total isn't known in advance. It's called once per batch of
+// keys, not for every key.
+func WithProgress(fn func(done, total int)) BulkOption {
+	return func(c *bulkConfig) {
+		c.progress = fn
+	}
+}
+
+func newBulkConfig(opts []BulkOption) bulkConfig {
+	c := bulkConfig{prefix: datastore.NewKey("/")}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// CopyFrom writes the key-values of src into the datastore, and returns how
+// many keys it wrote. It eases migrating from another datastore
+// implementation. If WithSkipExisting is set, the keys already stored are
+// left untouched and aren't counted, so an interrupted copy can be resumed
+// by running it again. Keys are written in batches, and WithProgress
+// reports the progress after each of them. Expiration times aren't copied.
+func (m *MongoDS) CopyFrom(ctx context.Context, src datastore.Datastore, opts ...BulkOption) (int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	return m.copyFrom(ctx, src, newBulkConfig(opts))
+}
+
+func (m *MongoDS) copyFrom(ctx context.Context, src datastore.Datastore, c bulkConfig) (_ int, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return 0, err
+	}
+	ctx, end := m.startOp(ctx, "copyFrom", c.prefix.String())
+	defer end(&err)
+
+	res, err := src.Query(query.Query{Prefix: c.prefix.String()})
+	if err != nil {
+		return 0, fmt.Errorf("querying source: %w", err)
+	}
+	defer res.Close()
+
+	bw := m.newBulkWriter(ctx, c)
+	for r := range res.Next() {
+		if r.Error != nil {
+			return bw.written, fmt.Errorf("reading source: %w", r.Error)
+		}
+		if err := bw.put(datastore.RawKey(r.Key), r.Value); err != nil {
+			return bw.written, err
+		}
+		if err := ctx.Err(); err != nil {
+			return bw.written, err
+		}
+	}
+	return bw.written, bw.flush()
+}
+
+// bulkWriter writes key-values with bulk writes, in batches bounded by the
+// batch flush threshold and by the size of their values.
+type bulkWriter struct {
+	ctx context.Context
+	m   *MongoDS
+	c   bulkConfig
+
+	limit  int
+	models []mongo.WriteModel
+	size   int
+
+	// done is the number of keys processed, and written the number of
+	// keys written, which excludes the keys skipped.
+	done    int
+	written int
+}
+
+func (m *MongoDS) newBulkWriter(ctx context.Context, c bulkConfig) *bulkWriter {
+	limit := m.batchFlushThreshold
+	if limit <= 0 {
+		limit = gcBatchSize
+	}
+	return &bulkWriter{ctx: ctx, m: m, c: c, limit: limit}
+}
+
+// put queues the write of val as the value of key, and flushes the queued
+// writes if the batch is full.
+func (bw *bulkWriter) put(key datastore.Key, val []byte) error {
+	ctx, cls := context.WithTimeout(bw.ctx, bw.m.opTimeout)
+	model, err := bw.m.putModel(ctx, key, val, bw.c.skipExisting, nil)
+	cls()
+	if err != nil {
+		return err
+	}
+	bw.models = append(bw.models, model)
+	bw.size += len(val)
+	if len(bw.models) >= bw.limit || bw.size >= bulkBatchBytes {
+		return bw.flush()
+	}
+	return nil
+}
+
+// flush writes the queued writes.
+func (bw *bulkWriter) flush() error {
+	if len(bw.models) == 0 {
+		return nil
+	}
+	n, err := bw.m.bulkPut(bw.ctx, bw.models, bw.c.skipExisting)
+	bw.written += n
+	bw.done += len(bw.models)
+	bw.models, bw.size = bw.models[:0], 0
+	if err != nil {
+		return err
+	}
+	if bw.c.progress != nil {
+		bw.c.progress(bw.done, -1)
+	}
+	return nil
+}
+
+// bulkPut runs the upserts built by putModel and returns how many keys
+// they wrote. With insertOnly upserts, only the inserted keys were written.
+func (m *MongoDS) bulkPut(ctx context.Context, models []mongo.WriteModel, insertOnly bool) (int, error) {
+	ctx, cls := context.WithTimeout(ctx, m.opTimeout*time.Duration(len(models)))
+	defer cls()
+	res, err := m.col.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return 0, fmt.Errorf("writing key-values: %w", joinWriteErrors(err))
+	}
+	if insertOnly {
+		return int(res.UpsertedCount), nil
+	}
+	return int(res.MatchedCount + res.UpsertedCount), nil
+}
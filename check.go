@@ -0,0 +1,57 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+var (
+	ErrNotConnected      = errors.New("not connected to MongoDB")
+	ErrCollectionMissing = errors.New("collection is missing")
+)
+
+// checkProbeID is the _id of the document written by Check. It's outside
+// of the datastore key space, so it never shows up in queries.
+const checkProbeID = "_mongods_check"
+
+var _ datastore.CheckedDatastore = (*MongoDS)(nil)
+
+// Check verifies the primary is reachable and the backing collection
+// exists and is writable, by doing a write round-trip on a probe document.
+// It returns an error wrapping ErrNotConnected if the primary can't be
+// reached, or ErrCollectionMissing if the collection doesn't exist.
+func (m *MongoDS) Check() error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	defer cls()
+	if err := m.m.Ping(ctx, readpref.Primary()); err != nil {
+		return &kindError{kind: ErrNotConnected, err: err}
+	}
+	names, err := m.db.ListCollectionNames(ctx, bson.M{"name": m.col.Name()})
+	if err != nil {
+		return fmt.Errorf("listing collections: %w", err)
+	}
+	if len(names) == 0 {
+		return ErrCollectionMissing
+	}
+
+	probe := m.internalFilter(checkProbeID)
+	if _, err := m.col.UpdateOne(ctx, probe, bson.M{"$set": bson.M{m.valueField: []byte{}}}, options.Update().SetUpsert(true)); err != nil {
+		return fmt.Errorf("writing probe: %w", err)
+	}
+	if _, err := m.col.DeleteOne(ctx, probe); err != nil {
+		return fmt.Errorf("deleting probe: %w", err)
+	}
+	return nil
+}
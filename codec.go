@@ -0,0 +1,132 @@
+package mongods
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+)
+
+// Codec compresses the values stored by the datastore. The name of the
+// codec is recorded in each document it compressed, so it must be stable.
+type Codec interface {
+	Name() string
+	Compress(val []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+// builtinCodecs can decompress values even if the datastore is no
+// longer configured with them.
+var builtinCodecs = map[string]Codec{
+	"gzip": GzipCodec(gzip.DefaultCompression),
+}
+
+type gzipCodec struct {
+	level int
+}
+
+// GzipCodec returns a Codec compressing values with gzip at the given
+// compression level, as accepted by gzip.NewWriterLevel.
+func GzipCodec(level int) Codec {
+	return gzipCodec{level: level}
+}
+
+func (c gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (c gzipCodec) Compress(val []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(val); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// encodedValue is a value as it's stored in a document.
+type encodedValue struct {
+	// data holds the stored bytes.
+	data []byte
+	// codec is the name of the codec that compressed data, if any.
+	codec string
+	// nonce and encryption are set if data is encrypted.
+	nonce      []byte
+	encryption int
+	// size is the length of the value.
+	size int
+}
+
+// rawValues returns true if values are stored as is in the documents,
+// which is the case unless GridFS, compression or encryption is enabled.
+func (m *MongoDS) rawValues() bool {
+	return m.gridfsThreshold <= 0 && m.codec == nil && m.aead == nil
+}
+
+// encode compresses val with the configured codec, then encrypts it if
+// encryption is enabled. Values that don't get any smaller are stored
+// uncompressed.
+func (m *MongoDS) encode(id string, val []byte) (encodedValue, error) {
+	ev := encodedValue{data: val, size: len(val)}
+	if m.codec != nil {
+		data, err := m.codec.Compress(val)
+		if err != nil {
+			return ev, fmt.Errorf("compressing value: %w", err)
+		}
+		if len(data) < len(val) {
+			ev.data = data
+			ev.codec = m.codec.Name()
+		}
+	}
+	if m.aead != nil {
+		if err := m.encrypt(id, &ev); err != nil {
+			return ev, err
+		}
+	}
+	return ev, nil
+}
+
+// decode returns the value of kv, given the bytes it stores.
+func (m *MongoDS) decode(kv keyValue, data []byte) ([]byte, error) {
+	if kv.Encryption != 0 {
+		var err error
+		if data, err = m.decrypt(kv, data); err != nil {
+			return nil, err
+		}
+	}
+	return m.decompress(kv.Codec, data)
+}
+
+// decompress returns the value stored as data by the codec named name.
+func (m *MongoDS) decompress(name string, data []byte) ([]byte, error) {
+	if name == "" {
+		return data, nil
+	}
+	c := builtinCodecs[name]
+	if m.codec != nil && m.codec.Name() == name {
+		c = m.codec
+	}
+	if c == nil {
+		return nil, fmt.Errorf("value compressed with unknown codec %q", name)
+	}
+	val, err := c.Decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing value: %w", err)
+	}
+	return val, nil
+}
@@ -0,0 +1,137 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collatedPrefixEnd is appended to a prefix to bound the strings starting
+// with it under a collation, since U+FFFF has the highest primary weight.
+const collatedPrefixEnd = "\uffff"
+
+// createCollection creates the collection named name in db with collation
+// as its default, unless it already exists, in which case it checks that
+// the collection has the same collation. The collation of a collection
+// can't change, and queries read and order it with the default one.
+func createCollection(ctx context.Context, db *mongo.Database, name string, collation *options.Collation) error {
+	opts := options.CreateCollection()
+	if collation != nil {
+		opts.SetCollation(collation)
+	}
+	_ = db.CreateCollection(ctx, name, opts)
+
+	specs, err := db.ListCollectionSpecifications(ctx, bson.M{"name": name})
+	if err != nil {
+		return fmt.Errorf("listing collections: %w", err)
+	}
+	if len(specs) == 0 {
+		return nil
+	}
+	var spec struct {
+		Collation *options.Collation `bson:"collation"`
+	}
+	if err := bson.Unmarshal(specs[0].Options, &spec); err != nil {
+		return fmt.Errorf("decoding collection options: %w", err)
+	}
+	if !sameCollation(spec.Collation, collation) {
+		return fmt.Errorf("collection %s exists with collation %s, which differs from the configured one", name, collationString(spec.Collation))
+	}
+	return nil
+}
+
+// sameCollation returns true if a and b compare strings the same way, as
+// far as their locale and strength tell. MongoDB fills in the defaults of
+// the other fields, so they aren't compared.
+func sameCollation(a, b *options.Collation) bool {
+	if a == nil || b == nil {
+		return isSimple(a) && isSimple(b)
+	}
+	return a.Locale == b.Locale && strength(a) == strength(b)
+}
+
+// isSimple returns true if c compares strings byte-wise.
+func isSimple(c *options.Collation) bool {
+	return c == nil || c.Locale == "simple"
+}
+
+// strength returns the comparison level of c, which defaults to 3.
+func strength(c *options.Collation) int {
+	if c.Strength == 0 {
+		return 3
+	}
+	return c.Strength
+}
+
+func collationString(c *options.Collation) string {
+	if isSimple(c) {
+		return "simple"
+	}
+	return fmt.Sprintf("%s (strength %d)", c.Locale, strength(c))
+}
+
+// caseInsensitiveCollation is the collation of datastores built with
+// WithCaseInsensitiveKeys and no other collation.
+var caseInsensitiveCollation = options.Collation{Locale: "en", Strength: 2}
+
+// resolveCollation sets the collation case-insensitive keys rely on, and
+// checks that the collation can be used with the other options of c.
+func resolveCollation(c *config) error {
+	if c.caseInsensitiveKeys {
+		if c.collation == nil {
+			coll := caseInsensitiveCollation
+			c.collation = &coll
+		} else if strength(c.collation) != 2 {
+			return errors.New("case-insensitive keys need a collation of strength 2")
+		}
+	}
+	// Keys equal under the collation must map to the same hash and be
+	// bound to the same encrypted values, which foldKey only ensures
+	// for differences of case.
+	if !isSimple(c.collation) && strength(c.collation) == 1 && (c.keyHashThreshold > 0 || c.aead != nil) {
+		return errors.New("collations of strength 1 can't be used with key hashing or encryption")
+	}
+	return nil
+}
+
+// foldKey returns the form of the stored key k that keys hashes and the
+// encryption of values. Under a collation of strength 2, keys which only
+// differ by case are the same, so it's lower-cased.
+func (m *MongoDS) foldKey(k string) string {
+	if !isSimple(m.collation) && strength(m.collation) == 2 {
+		return strings.ToLower(k)
+	}
+	return k
+}
+
+// startsWith returns the condition matching the strings starting with p.
+// Byte-wise, it's the range they span. Under a collation, that range is
+// made of the strings whose first characters have the same base letters
+// as p, so it's narrowed with a regular expression to the strings whose
+// first characters are equal to p under the collation: ignoring case at
+// strength 2, and exactly at strength 3 and above.
+func (m *MongoDS) startsWith(p string) bson.M {
+	if isSimple(m.collation) {
+		cond := bson.M{"$gte": p}
+		if end, ok := prefixEnd(p); ok {
+			cond["$lt"] = end
+		}
+		return cond
+	}
+	cond := bson.M{"$gte": p, "$lt": p + collatedPrefixEnd}
+	switch strength(m.collation) {
+	case 1:
+	case 2:
+		cond["$regex"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(p), Options: "i"}
+	default:
+		cond["$regex"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(p)}
+	}
+	return cond
+}
@@ -0,0 +1,61 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var ErrDropAllDisabled = errors.New("DropAll isn't allowed, enable it with WithAllowDropAll")
+
+// DropAll removes every key by dropping the collection, along with the
+// GridFS bucket if GridFS is enabled, and recreates the collection and its
+// indexes. It's meant to reset state in tests or when reprovisioning, and
+// is much faster than deleting the keys. It must be enabled with
+// WithAllowDropAll. A namespaced datastore doesn't own its collection, so
+// DropAll fails; use DeletePrefix on the root key instead.
+func (m *MongoDS) DropAll(ctx context.Context) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+	if !m.allowDropAll {
+		return ErrDropAllDisabled
+	}
+	if m.namespace != "" {
+		return fmt.Errorf("can't drop the collection shared by namespace %s", strings.Trim(m.namespace, namespaceDelim))
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	if err := m.col.Drop(ctx); err != nil {
+		return fmt.Errorf("dropping collection: %w", err)
+	}
+	if m.gridfsThreshold > 0 {
+		b, err := m.bucket(ctx)
+		if err != nil {
+			return err
+		}
+		if err := b.Drop(); err != nil {
+			return fmt.Errorf("dropping gridfs bucket: %w", err)
+		}
+	}
+	if err := createCollection(ctx, m.db, m.col.Name(), m.collation); err != nil {
+		return err
+	}
+	return createIndexes(ctx, m.col, &config{
+		ttlIndex:         m.ttlIndex,
+		valueIndex:       m.valueIndex,
+		valueField:       m.valueField,
+		prefixField:      m.prefixField,
+		timestamps:       m.timestamps,
+		gridfsThreshold:  m.gridfsThreshold,
+		keyHashThreshold: m.keyHashThreshold,
+		keyCodec:         m.keyCodec,
+		shardKey:         m.shardKey,
+		ensureIndexes:    true,
+		logger:           m.logger,
+	})
+}
@@ -0,0 +1,45 @@
+package mongods
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// encryptionV1 is the format of values sealed by the configured AEAD,
+// using a random nonce and the document _id as additional data.
+const encryptionV1 = 1
+
+var ErrDecryption = errors.New("value can't be decrypted")
+
+// encrypt seals the data of ev, stored under the document id. Under a
+// case-insensitive collation, writes may address the document with an id
+// of another case, so the id is folded first.
+func (m *MongoDS) encrypt(id string, ev *encodedValue) error {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("generating nonce: %w", err)
+	}
+	ev.data = m.aead.Seal(nil, nonce, ev.data, []byte(m.foldKey(id)))
+	ev.nonce = nonce
+	ev.encryption = encryptionV1
+	return nil
+}
+
+// decrypt opens the data stored by kv.
+func (m *MongoDS) decrypt(kv keyValue, data []byte) ([]byte, error) {
+	if m.aead == nil {
+		return nil, fmt.Errorf("%w: encryption isn't enabled", ErrDecryption)
+	}
+	if kv.Encryption != encryptionV1 {
+		return nil, fmt.Errorf("%w: unknown encryption version %d", ErrDecryption, kv.Encryption)
+	}
+	if len(kv.Nonce) != m.aead.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid nonce size", ErrDecryption)
+	}
+	val, err := m.aead.Open(nil, kv.Nonce, data, []byte(m.foldKey(m.kvIDString(kv))))
+	if err != nil {
+		return nil, &kindError{kind: ErrDecryption, err: err}
+	}
+	return val, nil
+}
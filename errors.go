@@ -0,0 +1,99 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ErrWriteConflict is wrapped by the errors of operations that conflicted
+// with a concurrent transaction writing the same keys. The transaction
+// the operation ran in is aborted, and can be retried from the start.
+var ErrWriteConflict = errors.New("write conflict with a concurrent transaction")
+
+// writeConflictCode is the code of the error MongoDB returns when a write
+// conflicts with a concurrent transaction.
+const writeConflictCode = 112
+
+// readErr returns datastore.ErrNotFound if err reports that no document
+// matched a read, so every read path returns the datastore sentinel, and
+// err wrapped with msg otherwise.
+func readErr(msg string, err error) error {
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return datastore.ErrNotFound
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// conflictErr wraps err with ErrWriteConflict if it reports a write
+// conflict, and returns it unchanged otherwise.
+func conflictErr(err error) error {
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCode(writeConflictCode) && !errors.Is(err, ErrWriteConflict) {
+		return &kindError{kind: ErrWriteConflict, err: err}
+	}
+	return err
+}
+
+// transientCodes are the codes of the server errors reporting a condition
+// expected to clear up on its own, such as an election or a shutdown.
+var transientCodes = []int{
+	91,    // ShutdownInProgress
+	112,   // WriteConflict
+	189,   // PrimarySteppedDown
+	10107, // NotWritablePrimary
+	11600, // InterruptedAtShutdown
+	11602, // InterruptedDueToReplStateChange
+	13435, // NotPrimaryNoSecondaryOk
+	13436, // NotPrimaryOrSecondary
+}
+
+// IsTransient returns true if err reports a failure that may not happen
+// again if the operation is retried, such as a network error, a timeout,
+// a primary election or a transaction write conflict. Other errors, such
+// as ErrNotFound or a rejected key, mean that retrying is pointless.
+// Errors returned by the datastore wrap the driver errors they come from,
+// so errors.As can also be used to inspect them, e.g. as mongo.ServerError.
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrUnavailable) || errors.Is(err, ErrNotConnected) || isUnavailable(err) {
+		return true
+	}
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	if se.HasErrorLabel("TransientTransactionError") || se.HasErrorLabel("RetryableWriteError") {
+		return true
+	}
+	for _, code := range transientCodes {
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
+// kindError tags an error with one of the sentinel errors of the package,
+// while keeping it inspectable with errors.Is and errors.As.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *kindError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *kindError) Unwrap() error {
+	return e.err
+}
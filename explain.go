@@ -0,0 +1,69 @@
+package mongods
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore/query"
+	dsextensions "github.com/textileio/go-datastore-extensions"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// ExplainQuery returns the plan the server chooses for the find running q,
+// as reported by the queryPlanner verbosity of the explain command. It's
+// meant to investigate slow queries, such as checking whether a prefix
+// scan uses an index (IXSCAN) or the whole collection (COLLSCAN). Orders
+// that can't be done server-side, and the offset and limit applied after
+// them, aren't part of the find and so aren't reflected in the plan.
+func (m *MongoDS) ExplainQuery(ctx context.Context, q query.Query, opts ...QueryOption) (bson.M, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.queryTimeout)
+	defer cls()
+
+	return m.explainQuery(ctx, dsextensions.QueryExt{Query: q}, opts...)
+}
+
+func (m *MongoDS) explainQuery(ctx context.Context, q dsextensions.QueryExt, opts ...QueryOption) (bson.M, error) {
+	var qc queryConfig
+	for _, opt := range opts {
+		opt(&qc)
+	}
+	asc, ok := keyOrder(q.Orders)
+	if !ok {
+		q, asc = baseQuery(q), true
+	}
+	fil, fopts, _ := m.findArgs(ctx, q, qc, asc)
+
+	find := bson.D{
+		{Key: "find", Value: m.col.Name()},
+		{Key: "filter", Value: fil},
+		{Key: "sort", Value: fopts.Sort},
+	}
+	if fopts.Skip != nil && *fopts.Skip > 0 {
+		find = append(find, bson.E{Key: "skip", Value: *fopts.Skip})
+	}
+	if fopts.Limit != nil {
+		find = append(find, bson.E{Key: "limit", Value: *fopts.Limit})
+	}
+	if fopts.Projection != nil {
+		find = append(find, bson.E{Key: "projection", Value: fopts.Projection})
+	}
+	if fopts.Hint != nil {
+		find = append(find, bson.E{Key: "hint", Value: fopts.Hint})
+	}
+	cmd := bson.D{
+		{Key: "explain", Value: find},
+		{Key: "verbosity", Value: "queryPlanner"},
+	}
+
+	var plan bson.M
+	if err := m.db.RunCommand(ctx, cmd).Decode(&plan); err != nil {
+		return nil, fmt.Errorf("explaining query: %w", err)
+	}
+	return plan, nil
+}
@@ -0,0 +1,184 @@
+package mongods
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dsextensions "github.com/textileio/go-datastore-extensions"
+)
+
+// exportHeader starts the output of Export, and identifies the version of
+// its format.
+const exportHeader = "mongods-export/1\n"
+
+// maxRecordField bounds the length of the keys and values read by Import,
+// so a corrupted length doesn't make it allocate unbounded memory.
+const maxRecordField = 1 << 30
+
+var ErrExportFormat = errors.New("invalid export format")
+
+// Export writes every key-value of the datastore to w, in a format Import
+// reads back. Results are streamed, so memory use doesn't depend on the
+// size of the datastore. Values are exported decoded, so they can be
+// imported into a datastore using other compression or encryption settings.
+// Expiration times aren't exported.
+//
+// The output starts with a header line, followed by a record for each key,
+// made of the length of the key as an uvarint, the key, the length of the
+// value as an uvarint, and the value.
+func (m *MongoDS) Export(ctx context.Context, w io.Writer, opts ...BulkOption) (err error) {
+	c := newBulkConfig(opts)
+	if err = m.admit(ctx, readOp); err != nil {
+		return err
+	}
+	ctx, end := m.startOp(ctx, "export", c.prefix.String())
+	defer end(&err)
+
+	res, err := m.prefixResults(ctx, c.prefix)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(exportHeader); err != nil {
+		return fmt.Errorf("writing export header: %w", err)
+	}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return fmt.Errorf("reading key-values: %w", r.Error)
+		}
+		if err := writeRecord(bw, r.Key, r.Value); err != nil {
+			return fmt.Errorf("writing record: %w", err)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// Import writes the key-values read from r, in the format written by
+// Export, and returns how many keys it wrote. If WithSkipExisting is set,
+// the keys already stored are left untouched and aren't counted. Records
+// are written in batches bounded by the batch flush threshold and by their
+// size, and WithProgress reports the progress after each batch. If Import
+// fails, the batches already written are kept.
+func (m *MongoDS) Import(ctx context.Context, r io.Reader, opts ...BulkOption) (int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	return m.importRecords(ctx, r, newBulkConfig(opts))
+}
+
+func (m *MongoDS) importRecords(ctx context.Context, r io.Reader, c bulkConfig) (_ int, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return 0, err
+	}
+	ctx, end := m.startOp(ctx, "import", "")
+	defer end(&err)
+
+	br := bufio.NewReader(r)
+	if err := readHeader(br); err != nil {
+		return 0, err
+	}
+	bw := m.newBulkWriter(ctx, c)
+	for {
+		k, v, err := readRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return bw.written, err
+		}
+		if err := bw.put(datastore.RawKey(k), v); err != nil {
+			return bw.written, err
+		}
+	}
+	return bw.written, bw.flush()
+}
+
+// prefixResults returns the key-values strictly below prefix. Close waits
+// for the query worker on its own, so the lock is only held while starting
+// the query, to not hold Close back while the results are drained.
+func (m *MongoDS) prefixResults(ctx context.Context, prefix datastore.Key) (query.Results, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	ctx, cls := withTimeout(ctx, m.queryTimeout)
+	defer cls()
+	return m.runQuery(ctx, dsextensions.QueryExt{Query: query.Query{Prefix: prefix.String()}}, queryConfig{})
+}
+
+// writeRecord writes the record of a key-value.
+func writeRecord(w *bufio.Writer, key string, val []byte) error {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(key)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	if _, err := w.WriteString(key); err != nil {
+		return err
+	}
+	n = binary.PutUvarint(buf[:], uint64(len(val)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(val)
+	return err
+}
+
+// readHeader checks that r starts with the export header.
+func readHeader(r *bufio.Reader) error {
+	header := make([]byte, len(exportHeader))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != exportHeader {
+		return fmt.Errorf("%w: missing header", ErrExportFormat)
+	}
+	return nil
+}
+
+// readRecord reads the next record of r. It returns io.EOF once every
+// record was read.
+func readRecord(r *bufio.Reader) (string, []byte, error) {
+	key, err := readField(r)
+	if err == io.EOF {
+		return "", nil, io.EOF
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	val, err := readField(r)
+	if err == io.EOF {
+		err = fmt.Errorf("%w: truncated record", ErrExportFormat)
+	}
+	return string(key), val, err
+}
+
+// readField reads a length-prefixed field of a record.
+func readField(r *bufio.Reader) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, &kindError{kind: ErrExportFormat, err: err}
+	}
+	if l > maxRecordField {
+		return nil, fmt.Errorf("%w: field of %d bytes", ErrExportFormat, l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, fmt.Errorf("%w: truncated record", ErrExportFormat)
+	}
+	return b, nil
+}
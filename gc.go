@@ -0,0 +1,92 @@
+package mongods
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// gcBatchSize is the maximum number of documents removed by a single
+// delete while collecting garbage, to avoid long-running deletes.
+const gcBatchSize = 1000
+
+var _ datastore.GCDatastore = (*MongoDS)(nil)
+
+// CollectGarbage removes the keys whose TTL already expired. It's meant
+// for deployments without a TTL index, or to reclaim space before the
+// TTL monitor runs. If GridFS is enabled, it also removes the files no
+// key references anymore. It's idempotent and safe to call concurrently
+// with writes.
+func (m *MongoDS) CollectGarbage() error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	now := time.Now()
+	var removed int64
+	for {
+		n, err := m.collectGarbageBatch(now)
+		if err != nil {
+			return err
+		}
+		removed += n
+		if n < gcBatchSize {
+			break
+		}
+	}
+	m.logger.Debugf("garbage collection removed %d expired keys", removed)
+
+	if m.gridfsThreshold > 0 {
+		files, err := m.collectOrphanFiles()
+		if err != nil {
+			return err
+		}
+		m.logger.Debugf("garbage collection removed %d orphan gridfs files", files)
+	}
+	return nil
+}
+
+func (m *MongoDS) collectGarbageBatch(now time.Time) (int64, error) {
+	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	defer cls()
+
+	expired := bson.M{"expireAt": bson.M{"$lte": now}}
+	if m.namespace != "" {
+		expired = bson.M{"$and": bson.A{expired, m.prefixFilter("/")}}
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(gcBatchSize)
+	cur, err := m.col.Find(ctx, expired, opts)
+	if err != nil {
+		return 0, fmt.Errorf("finding expired keys: %w", err)
+	}
+	var kvs []keyValue
+	if err := cur.All(ctx, &kvs); err != nil {
+		return 0, fmt.Errorf("decoding expired keys: %w", err)
+	}
+	if len(kvs) == 0 {
+		return 0, nil
+	}
+	ids := make(bson.A, len(kvs))
+	for i, kv := range kvs {
+		ids[i] = kv.ID
+	}
+
+	// The expiration is checked again, in case a key got a new TTL
+	// or was overwritten since it was found.
+	res, err := m.col.DeleteMany(ctx, bson.M{"$and": bson.A{bson.M{"_id": bson.M{"$in": ids}}, expired}})
+	if err != nil {
+		return 0, fmt.Errorf("deleting expired keys: %w", err)
+	}
+	// A batch is full if it found as many keys as the limit, even if
+	// fewer were deleted, so there may be more expired keys left.
+	if len(kvs) == gcBatchSize {
+		return gcBatchSize, nil
+	}
+	return res.DeletedCount, nil
+}
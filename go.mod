@@ -6,7 +6,10 @@ require (
 	github.com/ipfs/go-datastore v0.4.5
 	github.com/ipfs/go-log/v2 v2.3.0
 	github.com/jbenet/goprocess v0.1.4
-	github.com/stretchr/testify v1.6.1
+	github.com/prometheus/client_golang v1.11.0
+	github.com/stretchr/testify v1.7.0
 	github.com/textileio/go-datastore-extensions v1.0.1
 	go.mongodb.org/mongo-driver v1.7.1
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
 )
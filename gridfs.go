@@ -0,0 +1,266 @@
+package mongods
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// gridfsOrphanGrace is how old a GridFS file must be before CollectGarbage
+// considers removing it, so files whose pointer document is still being
+// written, or is part of an open transaction, aren't mistaken for orphans.
+const gridfsOrphanGrace = time.Hour
+
+// bucket returns a handle on the GridFS bucket holding large values,
+// bounded by the deadline of ctx. Buckets aren't goroutine-safe, so a
+// new handle is created for each operation.
+func (m *MongoDS) bucket(ctx context.Context) (*gridfs.Bucket, error) {
+	b, err := gridfs.NewBucket(m.db, options.GridFSBucket().SetName(m.gridfsBucket))
+	if err != nil {
+		return nil, fmt.Errorf("creating gridfs bucket: %w", err)
+	}
+	if dl, ok := ctx.Deadline(); ok {
+		_ = b.SetReadDeadline(dl)
+		_ = b.SetWriteDeadline(dl)
+	}
+	return b, nil
+}
+
+// fileIndex is the index used to find the pointer documents referencing
+// GridFS files. It only covers documents having a file.
+func fileIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.M{"f": 1},
+		Options: options.Index().
+			SetName("f_gridfs").
+			SetPartialFilterExpression(bson.M{"f": bson.M{"$exists": true}}),
+	}
+}
+
+// inGridFS returns true if ev is large enough to be stored in GridFS.
+func (m *MongoDS) inGridFS(ev encodedValue) bool {
+	return m.gridfsThreshold > 0 && len(ev.data) > m.gridfsThreshold
+}
+
+// uploadFile stores val in GridFS and returns the id of the new file.
+func (m *MongoDS) uploadFile(ctx context.Context, key datastore.Key, val []byte) (primitive.ObjectID, error) {
+	b, err := m.bucket(ctx)
+	if err != nil {
+		return primitive.NilObjectID, err
+	}
+	id, err := b.UploadFromStream(key.String(), bytes.NewReader(val))
+	if err != nil {
+		return primitive.NilObjectID, fmt.Errorf("uploading gridfs file: %w", err)
+	}
+	return id, nil
+}
+
+// deleteFile removes a GridFS file. Failures are only logged, since the
+// file is no longer referenced and CollectGarbage removes it later.
+func (m *MongoDS) deleteFile(ctx context.Context, id primitive.ObjectID) {
+	b, err := m.bucket(ctx)
+	if err == nil {
+		err = b.Delete(id)
+	}
+	if err != nil && err != gridfs.ErrFileNotFound {
+		m.logger.Warnf("deleting gridfs file %s: %s", id.Hex(), err)
+	}
+}
+
+// replacedFile deletes prev, the file a write replaced, unless ctx runs
+// within a transaction. The transaction may still abort, so the file is
+// left for CollectGarbage in that case.
+func (m *MongoDS) replacedFile(ctx context.Context, prev *primitive.ObjectID) {
+	if prev == nil || inTransaction(ctx) {
+		return
+	}
+	m.deleteFile(ctx, *prev)
+}
+
+// loadValue returns the value of kv, downloading it from GridFS if
+// the document is a pointer to a file, and decoding it.
+func (m *MongoDS) loadValue(ctx context.Context, kv keyValue) ([]byte, error) {
+	if kv.File == nil {
+		return m.decode(kv, kv.Value)
+	}
+	b, err := m.bucket(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err := b.DownloadToStream(*kv.File, &buf); err != nil {
+		return nil, fmt.Errorf("downloading gridfs file: %w", err)
+	}
+	return m.decode(kv, buf.Bytes())
+}
+
+// filePutUpdate returns the update document that turns a key-value into
+// a pointer to the GridFS file id, holding the data of ev.
+func (m *MongoDS) filePutUpdate(id primitive.ObjectID, ev encodedValue, expireAt *time.Time) bson.M {
+	set := bson.M{"f": id}
+	m.setUpdatedAt(set)
+	unset := bson.M{m.valueField: ""}
+	setEncoding(set, unset, ev)
+	if expireAt == nil {
+		unset["expireAt"] = ""
+	} else {
+		set["expireAt"] = *expireAt
+	}
+	return bson.M{"$set": set, "$unset": unset, "$inc": bson.M{"ver": 1}}
+}
+
+// writeValue upserts val as the value of key. Values above the GridFS
+// threshold, once compressed, are uploaded first, and the file of the
+// value being replaced, if any, is deleted once the pointer document
+// is updated. If writes are retried, the upsert is pinned to the version
+// of the value it replaces.
+func (m *MongoDS) writeValue(ctx context.Context, key datastore.Key, val []byte, expireAt *time.Time) error {
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return err
+	}
+	ev, err := m.encode(m.idString(key), val)
+	if err != nil {
+		return err
+	}
+	if m.gridfsThreshold <= 0 {
+		update := m.upsertKey(m.putUpdate(ev, expireAt), key)
+		if !m.retriesWrites(ctx) {
+			_, err := m.col.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+			return err
+		}
+		u, err := m.pinUpsert(ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		return m.retryWrite(ctx, func() error {
+			_, err := m.col.UpdateOne(ctx, u.Filter, u.Update, options.Update().SetUpsert(true))
+			if mongo.IsDuplicateKeyError(err) {
+				return nil
+			}
+			return err
+		})
+	}
+
+	update := m.putUpdate(ev, expireAt)
+	var file *primitive.ObjectID
+	if m.inGridFS(ev) {
+		fid, err := m.uploadFile(ctx, key, ev.data)
+		if err != nil {
+			return err
+		}
+		file = &fid
+		update = m.filePutUpdate(fid, ev, expireAt)
+	}
+	opts := options.FindOneAndUpdate().
+		SetUpsert(true).
+		SetProjection(bson.M{"f": 1}).
+		SetReturnDocument(options.Before)
+	var prev keyValue
+	if m.retriesWrites(ctx) {
+		u, err := m.pinUpsert(ctx, filter, m.upsertKey(update, key))
+		if err != nil {
+			if file != nil {
+				m.deleteFile(ctx, *file)
+			}
+			return err
+		}
+		// An attempt that failed may have been applied nonetheless, so
+		// the file is left for CollectGarbage if the write fails, as is
+		// the file replaced by an attempt applied before a retry.
+		err = m.retryWrite(ctx, func() error {
+			return m.col.FindOneAndUpdate(ctx, u.Filter, u.Update, opts).Decode(&prev)
+		})
+		if err == mongo.ErrNoDocuments || mongo.IsDuplicateKeyError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m.replacedFile(ctx, prev.File)
+		return nil
+	}
+	err = m.col.FindOneAndUpdate(ctx, filter, m.upsertKey(update, key), opts).Decode(&prev)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		if file != nil {
+			m.deleteFile(ctx, *file)
+		}
+		return err
+	}
+	m.replacedFile(ctx, prev.File)
+	return nil
+}
+
+// collectOrphanFiles removes the GridFS files that no document references
+// anymore, such as the files of expired keys or of keys overwritten or
+// deleted by a batch or a transaction.
+func (m *MongoDS) collectOrphanFiles() (int, error) {
+	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	defer cls()
+
+	b, err := m.bucket(ctx)
+	if err != nil {
+		return 0, err
+	}
+	old := bson.M{"uploadDate": bson.M{"$lt": time.Now().Add(-gridfsOrphanGrace)}}
+	cur, err := b.GetFilesCollection().Find(ctx, old, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, fmt.Errorf("finding gridfs files: %w", err)
+	}
+	var files []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err := cur.All(ctx, &files); err != nil {
+		return 0, fmt.Errorf("decoding gridfs files: %w", err)
+	}
+
+	removed := 0
+	for len(files) > 0 {
+		n := len(files)
+		if n > gcBatchSize {
+			n = gcBatchSize
+		}
+		ids := make(bson.A, n)
+		for i, f := range files[:n] {
+			ids[i] = f.ID
+		}
+		files = files[n:]
+
+		cur, err := m.col.Find(ctx, bson.M{"f": bson.M{"$in": ids}}, options.Find().SetProjection(bson.M{"f": 1}))
+		if err != nil {
+			return removed, fmt.Errorf("finding gridfs pointers: %w", err)
+		}
+		var kvs []keyValue
+		if err := cur.All(ctx, &kvs); err != nil {
+			return removed, fmt.Errorf("decoding gridfs pointers: %w", err)
+		}
+		referenced := make(map[primitive.ObjectID]struct{}, len(kvs))
+		for _, kv := range kvs {
+			if kv.File != nil {
+				referenced[*kv.File] = struct{}{}
+			}
+		}
+		for _, id := range ids {
+			id := id.(primitive.ObjectID)
+			if _, ok := referenced[id]; ok {
+				continue
+			}
+			if err := b.Delete(id); err != nil && err != gridfs.ErrFileNotFound {
+				return removed, fmt.Errorf("deleting gridfs file: %w", err)
+			}
+			removed++
+		}
+	}
+	return removed, nil
+}
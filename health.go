@@ -0,0 +1,97 @@
+package mongods
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// healthFailureThreshold is the number of consecutive failed pings after
+// which the deployment is considered unhealthy.
+const healthFailureThreshold = 3
+
+// healthChecker periodically pings the primary to track connectivity.
+type healthChecker struct {
+	interval time.Duration
+	onChange func(healthy bool, err error)
+
+	// healthy is 1 while the primary is reachable.
+	healthy int32
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Healthy returns whether the primary was reachable at the last health
+// check. It's always true if health checks aren't enabled with
+// WithHealthCheck. The driver reconnects on its own, so it's meant to give
+// applications visibility on connectivity, such as to shed load.
+func (m *MongoDS) Healthy() bool {
+	if m.health == nil {
+		return true
+	}
+	return atomic.LoadInt32(&m.health.healthy) == 1
+}
+
+// startHealthCheck starts pinging the primary in the background, until
+// stopHealthCheck is called.
+func (m *MongoDS) startHealthCheck(interval time.Duration, onChange func(bool, error)) {
+	m.health = &healthChecker{
+		interval: interval,
+		onChange: onChange,
+		healthy:  1,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go m.checkHealth()
+}
+
+// stopHealthCheck stops the health checks, if enabled, and waits for the
+// one running to return.
+func (m *MongoDS) stopHealthCheck() {
+	if m.health == nil {
+		return
+	}
+	close(m.health.stop)
+	<-m.health.done
+}
+
+func (m *MongoDS) checkHealth() {
+	h := m.health
+	defer close(h.done)
+	t := time.NewTicker(h.interval)
+	defer t.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-t.C:
+		}
+
+		ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+		err := m.m.Ping(ctx, readpref.Primary())
+		cls()
+		if err == nil {
+			failures = 0
+			if atomic.CompareAndSwapInt32(&h.healthy, 0, 1) {
+				m.logger.Warnf("MongoDB primary is reachable again")
+				if h.onChange != nil {
+					h.onChange(true, nil)
+				}
+			}
+			continue
+		}
+
+		failures++
+		m.logger.Debugf("pinging MongoDB primary (failure %d): %s", failures, err)
+		if failures >= healthFailureThreshold && atomic.CompareAndSwapInt32(&h.healthy, 1, 0) {
+			m.logger.Errorf("MongoDB primary is unreachable after %d attempts: %s", failures, err)
+			if h.onChange != nil {
+				h.onChange(false, err)
+			}
+		}
+	}
+}
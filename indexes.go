@@ -0,0 +1,201 @@
+package mongods
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// namespaceNotFound is the code of the error MongoDB returns when listing
+// the indexes of a collection that doesn't exist yet.
+const namespaceNotFound = 26
+
+// indexInfo is the subset of an index specification, as listed by
+// MongoDB, that createIndexes checks.
+type indexInfo struct {
+	Name               string        `bson:"name"`
+	Key                bson.Raw      `bson:"key"`
+	ExpireAfterSeconds bson.RawValue `bson:"expireAfterSeconds"`
+	PartialFilter      bson.Raw      `bson:"partialFilterExpression"`
+}
+
+// expectedIndexes returns the indexes the features enabled in c rely on.
+func expectedIndexes(c *config) []mongo.IndexModel {
+	var models []mongo.IndexModel
+	if c.ttlIndex {
+		models = append(models, ttlIndex())
+	}
+	if c.gridfsThreshold > 0 {
+		models = append(models, fileIndex())
+	}
+	if _, ok := c.keyCodec.(stringKeyCodec); !ok || c.keyHashThreshold > 0 {
+		models = append(models, fullKeyIndex())
+	}
+	if c.shardKey != "" {
+		models = append(models, shardKeyIndex(c.shardKey))
+	}
+	if c.valueIndex {
+		models = append(models, valueIndex(c.valueField))
+	}
+	if c.prefixField {
+		models = append(models, prefixIndex())
+	}
+	if c.timestamps {
+		models = append(models, updatedAtIndex())
+	}
+	return models
+}
+
+// createIndexes checks that col has the indexes the features enabled in c
+// rely on, and creates the missing ones if c.ensureIndexes is set, or
+// logs a warning for each otherwise. An index that exists with different
+// options than expected, as created by an older version, is left as is
+// and reported, since it has to be rebuilt for its options to change.
+func createIndexes(ctx context.Context, col *mongo.Collection, c *config) error {
+	expected := expectedIndexes(c)
+	if len(expected) == 0 {
+		return nil
+	}
+	existing, err := listIndexes(ctx, col)
+	if err != nil {
+		if !c.ensureIndexes {
+			c.logger.Warnf("listing indexes, they can't be verified: %s", err)
+			return nil
+		}
+		// Creating an index which already exists is a no-op, so all of
+		// them are created when they can't be listed.
+		existing = nil
+	}
+
+	for _, model := range expected {
+		name := *model.Options.Name
+		info, ok := findIndex(existing, model)
+		if ok {
+			if problem := indexMismatch(info, model); problem != "" {
+				c.logger.Warnf("index %s exists with %s, drop it to have it recreated", info.Name, problem)
+			}
+			continue
+		}
+		if !c.ensureIndexes {
+			c.logger.Warnf("index %s is missing, queries relying on it may scan the collection", name)
+			continue
+		}
+		if _, err := col.Indexes().CreateOne(ctx, model); err != nil {
+			return fmt.Errorf("creating %s index: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// listIndexes returns the indexes of col, which has none if it doesn't
+// exist yet.
+func listIndexes(ctx context.Context, col *mongo.Collection) ([]indexInfo, error) {
+	cur, err := col.Indexes().List(ctx)
+	var se mongo.ServerError
+	if errors.As(err, &se) && se.HasErrorCode(namespaceNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var infos []indexInfo
+	if err := cur.All(ctx, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// findIndex returns the index of existing that has the name of model,
+// or else the same keys.
+func findIndex(existing []indexInfo, model mongo.IndexModel) (indexInfo, bool) {
+	for _, info := range existing {
+		if info.Name == *model.Options.Name {
+			return info, true
+		}
+	}
+	keys, err := bson.Marshal(model.Keys)
+	if err != nil {
+		return indexInfo{}, false
+	}
+	for _, info := range existing {
+		if sameKeys(info.Key, keys) {
+			return info, true
+		}
+	}
+	return indexInfo{}, false
+}
+
+// indexMismatch describes how info differs from model, or returns an
+// empty string if it matches.
+func indexMismatch(info indexInfo, model mongo.IndexModel) string {
+	keys, err := bson.Marshal(model.Keys)
+	if err != nil || !sameKeys(info.Key, keys) {
+		return fmt.Sprintf("keys %s", info.Key)
+	}
+	opts := model.Options
+	if opts.ExpireAfterSeconds != nil {
+		n, ok := number(info.ExpireAfterSeconds)
+		if !ok || n != float64(*opts.ExpireAfterSeconds) {
+			return fmt.Sprintf("expireAfterSeconds %s instead of %d", info.ExpireAfterSeconds, *opts.ExpireAfterSeconds)
+		}
+	} else if info.ExpireAfterSeconds.Type != 0 {
+		return fmt.Sprintf("expireAfterSeconds %s", info.ExpireAfterSeconds)
+	}
+	if opts.PartialFilterExpression != nil {
+		filter, err := bson.Marshal(opts.PartialFilterExpression)
+		if err != nil || !bytes.Equal(filter, info.PartialFilter) {
+			return fmt.Sprintf("partial filter %s", info.PartialFilter)
+		}
+	} else if len(info.PartialFilter) > 0 {
+		return fmt.Sprintf("partial filter %s", info.PartialFilter)
+	}
+	return ""
+}
+
+// sameKeys returns true if the key documents a and b index the same
+// fields in the same order and directions, whatever the numeric type the
+// directions are stored as.
+func sameKeys(a, b bson.Raw) bool {
+	ae, err := a.Elements()
+	if err != nil {
+		return false
+	}
+	be, err := b.Elements()
+	if err != nil || len(ae) != len(be) {
+		return false
+	}
+	for i := range ae {
+		if ae[i].Key() != be[i].Key() {
+			return false
+		}
+		av, bv := ae[i].Value(), be[i].Value()
+		an, aok := number(av)
+		bn, bok := number(bv)
+		if aok && bok {
+			if an != bn {
+				return false
+			}
+		} else if !av.Equal(bv) {
+			return false
+		}
+	}
+	return true
+}
+
+// number returns the value of v if it's numeric.
+func number(v bson.RawValue) (float64, bool) {
+	switch v.Type {
+	case bsontype.Int32:
+		return float64(v.Int32()), true
+	case bsontype.Int64:
+		return float64(v.Int64()), true
+	case bsontype.Double:
+		return v.Double(), true
+	}
+	return 0, false
+}
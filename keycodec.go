@@ -0,0 +1,81 @@
+package mongods
+
+import (
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// KeyCodec maps datastore keys to the _id of the documents storing them.
+// Keys are given with the namespace, if any, prepended, along with a
+// leading '/' so they're valid keys. Decode must invert Encode, and Encode
+// must be stable, since documents are looked up by the _id it returns.
+type KeyCodec interface {
+	Encode(key datastore.Key) (interface{}, error)
+	Decode(id interface{}) (datastore.Key, error)
+}
+
+type stringKeyCodec struct{}
+
+// StringKeyCodec returns the KeyCodec storing keys as string _ids, which
+// is the default. Only string ids can be compared as keys server-side,
+// since MongoDB compares strings byte-wise like Go does, so it's the only
+// codec serving key ranges, comparisons and ordering from the _id index,
+// and the only one supporting WithKeyHashThreshold.
+func StringKeyCodec() KeyCodec {
+	return stringKeyCodec{}
+}
+
+func (stringKeyCodec) Encode(key datastore.Key) (interface{}, error) {
+	return key.String(), nil
+}
+
+func (stringKeyCodec) Decode(id interface{}) (datastore.Key, error) {
+	s, ok := id.(string)
+	if !ok {
+		return datastore.Key{}, fmt.Errorf("_id of type %T isn't a string", id)
+	}
+	return datastore.RawKey(s), nil
+}
+
+type binaryKeyCodec struct{}
+
+// BinaryKeyCodec returns a KeyCodec storing keys as binary _ids, for
+// interoperability with applications that expect them. BSON compares
+// binaries by length before their bytes, so such ids can't be matched as
+// key ranges, and the full key is stored alongside to serve prefixes,
+// comparisons and ordering from its own index.
+func BinaryKeyCodec() KeyCodec {
+	return binaryKeyCodec{}
+}
+
+func (binaryKeyCodec) Encode(key datastore.Key) (interface{}, error) {
+	return primitive.Binary{Subtype: 0, Data: []byte(key.String())}, nil
+}
+
+func (binaryKeyCodec) Decode(id interface{}) (datastore.Key, error) {
+	switch id := id.(type) {
+	case primitive.Binary:
+		return datastore.RawKey(string(id.Data)), nil
+	case []byte:
+		return datastore.RawKey(string(id)), nil
+	}
+	return datastore.Key{}, fmt.Errorf("_id of type %T isn't binary", id)
+}
+
+// stringIDs returns true if keys are stored as string _ids, which can be
+// matched as key ranges. Otherwise, the full key is stored in the k field
+// of every document, and key filters and ordering apply to it instead.
+func (m *MongoDS) stringIDs() bool {
+	_, ok := m.keyCodec.(stringKeyCodec)
+	return ok
+}
+
+// keyField returns the field keys are compared and ordered by.
+func (m *MongoDS) keyField() string {
+	if m.stringIDs() {
+		return "_id"
+	}
+	return "k"
+}
@@ -0,0 +1,175 @@
+package mongods
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// hashedIDPrefix starts the _id of hashed keys. It sorts before '/', so
+// hashed ids fall outside the ranges matching datastore keys.
+const hashedIDPrefix = "#"
+
+// keysProjection only fetches the fields needed to know the key of
+// a document.
+var keysProjection = bson.M{"_id": 1, "k": 1}
+
+// docID returns the _id of the document storing key, as encoded by the
+// key codec. With the string codec, keys longer than the hashing threshold
+// are replaced by their SHA-256 hash.
+//
+// Together with kvKey, it's the only mapping between datastore keys and
+// documents. Keys are only ever used as values, never as field names,
+// where '.' and '$' have a special meaning, so they don't need to be
+// escaped. They can't be mistaken for field paths in expressions either,
+// since datastore keys always start with '/', namespaced ones with the
+// namespace delimiter, and hashed ids with '#'.
+func (m *MongoDS) docID(key datastore.Key) (interface{}, error) {
+	if m.stringIDs() {
+		return m.idString(key), nil
+	}
+	id, err := m.keyCodec.Encode(m.codecKey(key))
+	if err != nil {
+		return nil, fmt.Errorf("encoding key: %w", err)
+	}
+	return id, nil
+}
+
+// idString returns the string identifying the document of key, which is
+// its _id with the string codec, and the stored key otherwise. Encrypted
+// values are bound to it, so it must remain stable.
+func (m *MongoDS) idString(key datastore.Key) string {
+	k := m.storedKey(key)
+	if !m.stringIDs() || m.keyHashThreshold <= 0 || len(k) <= m.keyHashThreshold {
+		return k
+	}
+	h := sha256.Sum256([]byte(m.foldKey(k)))
+	return hashedIDPrefix + hex.EncodeToString(h[:])
+}
+
+// kvIDString returns the idString of the document kv.
+func (m *MongoDS) kvIDString(kv keyValue) string {
+	if id, ok := kv.ID.(string); ok && m.stringIDs() {
+		return id
+	}
+	return kv.FullKey
+}
+
+// namespaceDelim encloses the namespace in stored keys. Namespaces can't
+// contain it, so no enclosed namespace is a prefix of another one, and it
+// sorts before '/', byte-wise as well as under collations, so namespaced
+// keys are outside the ranges of the keys of a datastore without a
+// namespace.
+const namespaceDelim = "!"
+
+// storedKey returns key as it's stored, within the namespace.
+func (m *MongoDS) storedKey(key datastore.Key) string {
+	return m.namespace + key.String()
+}
+
+// docKey returns the same string for all the keys stored in the same
+// document, such as keys differing by case if keys are case-insensitive.
+func (m *MongoDS) docKey(key datastore.Key) string {
+	return m.foldKey(m.storedKey(key))
+}
+
+// codecKey returns the key the key codec encodes for key, which is the
+// stored key, rooted if it's namespaced so it's a valid datastore key.
+func (m *MongoDS) codecKey(key datastore.Key) datastore.Key {
+	if m.namespace == "" {
+		return key
+	}
+	return datastore.RawKey("/" + m.storedKey(key))
+}
+
+// kvKey returns the datastore key stored by kv, without the namespace.
+func (m *MongoDS) kvKey(kv keyValue) (string, error) {
+	k := kv.FullKey
+	if id, ok := kv.ID.(string); k == "" && ok && m.stringIDs() {
+		k = id
+	} else if k == "" {
+		key, err := m.keyCodec.Decode(kv.ID)
+		if err != nil {
+			return "", fmt.Errorf("decoding key: %w", err)
+		}
+		k = key.String()
+		if m.namespace != "" {
+			k = strings.TrimPrefix(k, "/")
+		}
+	}
+	return strings.TrimPrefix(k, m.namespace), nil
+}
+
+// insertFields returns the fields an upsert of key must also store, which
+// are the full key if it's hashed or the _id isn't a string, the prefix
+// field if it's enabled, and the creation time if timestamps are enabled.
+func (m *MongoDS) insertFields(key datastore.Key) bson.M {
+	var fields bson.M
+	if k := m.storedKey(key); m.idString(key) != k || !m.stringIDs() {
+		fields = bson.M{"k": k}
+	}
+	if m.prefixField {
+		if fields == nil {
+			fields = bson.M{}
+		}
+		fields["p"] = m.ancestors(key)
+	}
+	if m.timestamps {
+		if fields == nil {
+			fields = bson.M{}
+		}
+		fields["createdAt"] = time.Now()
+	}
+	return fields
+}
+
+// upsertKey adds to update what an upsert of key must also store.
+func (m *MongoDS) upsertKey(update bson.M, key datastore.Key) bson.M {
+	if fields := m.insertFields(key); fields != nil {
+		update["$setOnInsert"] = fields
+	}
+	return update
+}
+
+// insertOnly turns update, as returned by putUpdate, into the update of
+// an upsert that only writes key if it doesn't exist yet.
+func (m *MongoDS) insertOnly(update bson.M, key datastore.Key) bson.M {
+	set := update["$set"].(bson.M)
+	for f, v := range m.insertFields(key) {
+		set[f] = v
+	}
+	set["ver"] = 1
+	return bson.M{"$setOnInsert": set}
+}
+
+// keyFilter returns a filter matching the keys satisfying cond. If long
+// keys are hashed, cond is checked against their full key, as it is for
+// all keys if the _id isn't a string.
+func (m *MongoDS) keyFilter(cond bson.M) bson.M {
+	if !m.stringIDs() {
+		return bson.M{"k": cond}
+	}
+	if m.keyHashThreshold <= 0 {
+		return bson.M{"_id": cond}
+	}
+	return bson.M{"$or": bson.A{bson.M{"_id": cond}, bson.M{"k": cond}}}
+}
+
+// fullKeyIndex is the index used to query keys by their full key, when
+// they're hashed or the _id isn't a string. It only covers documents
+// storing a full key.
+func fullKeyIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.M{"k": 1},
+		Options: options.Index().
+			SetName("k_hashed").
+			SetPartialFilterExpression(bson.M{"k": bson.M{"$exists": true}}),
+	}
+}
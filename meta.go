@@ -0,0 +1,179 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Meta describes the value of a key. CreatedAt and UpdatedAt are only set
+// if the key was written with WithTimestamps enabled.
+type Meta struct {
+	// CreatedAt is when the key was first written.
+	CreatedAt time.Time
+	// UpdatedAt is when the value of the key was last written.
+	UpdatedAt time.Time
+	// Size is the length of the value.
+	Size int
+	// Version is the version of the value, as checked by PutWithVersion.
+	Version int64
+}
+
+// GetMeta returns the metadata of the value of key, without loading the
+// value, or ErrNotFound.
+func (m *MongoDS) GetMeta(ctx context.Context, key datastore.Key) (Meta, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return Meta{}, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.getMeta(ctx, key)
+}
+
+func (m *MongoDS) getMeta(ctx context.Context, key datastore.Key) (_ Meta, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return Meta{}, err
+	}
+	ctx, end := m.startOp(ctx, "getMeta", key.String())
+	defer end(&err)
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return Meta{}, err
+	}
+	var sizes []keySize
+	sizes, err = m.valueSizes(ctx, filter)
+	if err != nil {
+		return Meta{}, err
+	}
+	if len(sizes) == 0 {
+		return Meta{}, datastore.ErrNotFound
+	}
+	meta := Meta{Size: sizes[0].Size, Version: sizes[0].Version}
+	if sizes[0].CreatedAt != nil {
+		meta.CreatedAt = *sizes[0].CreatedAt
+	}
+	if sizes[0].UpdatedAt != nil {
+		meta.UpdatedAt = *sizes[0].UpdatedAt
+	}
+	return meta, nil
+}
+
+// setUpdatedAt records the time of a write in set, the $set part of its
+// update, if timestamps are enabled.
+func (m *MongoDS) setUpdatedAt(set bson.M) {
+	if m.timestamps {
+		set["updatedAt"] = time.Now()
+	}
+}
+
+// updatedAtIndex is the index QueryModifiedSince finds the keys written
+// after a given time with.
+func updatedAtIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetName("updatedAt_id"),
+	}
+}
+
+// QueryModifiedSince returns the entries strictly below prefix whose value
+// was written at or after since, in the order they were written, so a
+// consumer can resume from the time of the last write it processed, as
+// given by the UpdatedAt of GetMeta. Write times have a millisecond
+// precision, so several writes may share the one resumed from, and the
+// entries written at since are returned again: consumers must skip the
+// ones they already processed. It needs WithTimestamps: keys without a
+// write time, as written while timestamps were disabled, are never
+// returned. Deleted keys aren't reported either. Closing the results
+// closes the cursor.
+func (m *MongoDS) QueryModifiedSince(ctx context.Context, prefix datastore.Key, since time.Time) (query.Results, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if !m.timestamps {
+		return nil, errors.New("querying modified keys requires timestamps to be enabled")
+	}
+	return m.queryModifiedSince(ctx, prefix, since)
+}
+
+func (m *MongoDS) queryModifiedSince(ctx context.Context, prefix datastore.Key, since time.Time) (_ query.Results, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return nil, err
+	}
+	findCtx, end := m.startOp(ctx, "queryModifiedSince", prefix.String())
+	defer end(&err)
+	findCtx, cls := withTimeout(findCtx, m.queryTimeout)
+	defer cls()
+
+	// Documents without updatedAt don't match $gte, so they're excluded.
+	filter := bson.M{"$and": bson.A{
+		m.prefixFilter(prefix.String()),
+		bson.M{"updatedAt": bson.M{"$gte": since}},
+	}}
+	opts := m.findOptions(findCtx).SetSort(bson.D{{Key: "updatedAt", Value: 1}, {Key: "_id", Value: 1}})
+	cur, err := m.queryReader(findCtx).Find(findCtx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("finding modified key-values: %w", err)
+	}
+
+	// The cursor is in flight until it's closed, which the results do
+	// once they're closed or fully read.
+	m.active.Add(1)
+	var (
+		once sync.Once
+		done bool
+	)
+	closeCursor := func() (err error) {
+		once.Do(func() {
+			defer m.active.Done()
+			err = cur.Close(context.Background())
+		})
+		return err
+	}
+	return query.ResultsFromIterator(query.Query{Prefix: prefix.String()}, query.Iterator{
+		Next: func() (query.Result, bool) {
+			if done {
+				return query.Result{}, false
+			}
+			nctx, cls := context.WithTimeout(ctx, m.queryTimeout)
+			defer cls()
+			if !cur.Next(nctx) {
+				done = true
+				if err := cur.Err(); err != nil {
+					return query.Result{Error: fmt.Errorf("iterating modified key-values: %w", err)}, true
+				}
+				return query.Result{}, false
+			}
+			var kv keyValue
+			if err := cur.Decode(&kv); err != nil {
+				return query.Result{Error: fmt.Errorf("decoding key-value: %w", err)}, true
+			}
+			key, err := m.kvKey(kv)
+			if err != nil {
+				return query.Result{Error: err}, true
+			}
+			val, err := m.iterValue(ctx, kv)
+			if err != nil {
+				return query.Result{Error: err}, true
+			}
+			return query.Result{Entry: query.Entry{
+				Key:   key,
+				Value: val,
+				Size:  kv.size(),
+			}}, true
+		},
+		Close: closeCursor,
+	}), nil
+}
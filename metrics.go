@@ -0,0 +1,87 @@
+package mongods
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics instruments the datastore operations. A nil *metrics is valid
+// and records nothing, so datastores built without WithMetrics don't
+// run any Prometheus code.
+type metrics struct {
+	requests     *prometheus.CounterVec
+	latency      *prometheus.HistogramVec
+	inflightTxns prometheus.Gauge
+	oldestTxn    prometheus.GaugeFunc
+}
+
+// newMetrics registers the collectors of the datastore in reg. oldestTxn
+// returns the age of the oldest open transaction when it's scraped.
+func newMetrics(reg prometheus.Registerer, oldestTxn func() time.Duration) (*metrics, error) {
+	mt := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "mongods",
+			Name:      "requests_total",
+			Help:      "Number of datastore operations.",
+		}, []string{"op", "outcome"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "mongods",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of datastore operations.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"op", "outcome"}),
+		inflightTxns: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "mongods",
+			Name:      "inflight_transactions",
+			Help:      "Number of open transactions.",
+		}),
+		oldestTxn: prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "mongods",
+			Name:      "oldest_transaction_age_seconds",
+			Help:      "Age of the oldest open transaction, zero if none is open.",
+		}, func() float64 {
+			return oldestTxn().Seconds()
+		}),
+	}
+	for _, c := range []prometheus.Collector{mt.requests, mt.latency, mt.inflightTxns, mt.oldestTxn} {
+		if err := reg.Register(c); err != nil {
+			return nil, fmt.Errorf("registering collector: %w", err)
+		}
+	}
+	return mt, nil
+}
+
+// observe records an operation that started at start and finished with
+// the error pointed by err.
+func (mt *metrics) observe(op string, start time.Time, err *error) {
+	if mt == nil {
+		return
+	}
+	outcome := "success"
+	if *err != nil {
+		outcome = "error"
+		if errors.Is(*err, datastore.ErrNotFound) {
+			outcome = "not_found"
+		}
+	}
+	mt.requests.WithLabelValues(op, outcome).Inc()
+	mt.latency.WithLabelValues(op, outcome).Observe(time.Since(start).Seconds())
+}
+
+func (mt *metrics) txnStarted() {
+	if mt == nil {
+		return
+	}
+	mt.inflightTxns.Inc()
+}
+
+func (mt *metrics) txnFinished() {
+	if mt == nil {
+		return
+	}
+	mt.inflightTxns.Dec()
+}
@@ -2,9 +2,9 @@ package mongods
 
 import (
 	"context"
+	"crypto/cipher"
 	"errors"
 	"fmt"
-	"regexp"
 	"sync"
 	"time"
 
@@ -18,64 +18,395 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// syncBarrierID is the _id of the document written by Sync. Like the
+// Check probe, it's outside of the datastore key space.
+const syncBarrierID = "_mongods_sync"
+
 var (
 	ErrClosed = errors.New("datastore was closed")
 
 	log = logging.Logger("mongods")
 )
 
+// Logger is the logger the datastore writes to.
+type Logger interface {
+	Debugf(template string, args ...interface{})
+	Warnf(template string, args ...interface{})
+	Errorf(template string, args ...interface{})
+}
+
+var _ Logger = log
+
 type MongoDS struct {
 	m          *mongo.Client
 	db         *mongo.Database
 	col        *mongo.Collection
+	readCol    *mongo.Collection
+	pointCol   *mongo.Collection
+	queryCol   *mongo.Collection
 	opTimeout  time.Duration
 	txnTimeout time.Duration
 
-	lock   sync.RWMutex
-	closed bool
+	queryTimeout time.Duration
+
+	txnMaxAttempts int
+	txnBackoff     BackoffFunc
+	txnSupported   bool
+	txnFallback    bool
+	txns           *txnTracker
+
+	batchFlushThreshold int
+	unorderedBatch      bool
+	batchConcurrency    int
+
+	metrics    *metrics
+	tracer     trace.Tracer
+	redactKeys bool
+
+	slowOpThreshold time.Duration
+	logger          Logger
+
+	gridfsThreshold int
+	gridfsBucket    string
+	codec           Codec
+	aead            cipher.AEAD
+
+	keyHashThreshold int
+	namespace        string
+	keyCodec         KeyCodec
+	shardKey         string
+
+	ttlIndex     bool
+	valueIndex   bool
+	prefixField  bool
+	allowDropAll bool
+
+	cursorBatchSize int32
+	maxNaiveResults int
+
+	valueField string
+	timestamps bool
+	slidingTTL time.Duration
+	collation  *options.Collation
+
+	writeRetries int
+
+	closeTimeout time.Duration
+	health       *healthChecker
+	breaker      *circuitBreaker
+	opLimit      *rateLimiter
+	readLimit    *rateLimiter
+	writeLimit   *rateLimiter
+	// active counts the queries, transactions, causal sessions and
+	// watchers in flight, which Close waits for.
+	active sync.WaitGroup
+	// fallbackWarn logs once that transactions fall back to
+	// non-atomic ones.
+	fallbackWarn sync.Once
+	// closing is canceled by Close, to stop the change streams of the
+	// watchers.
+	closing     context.Context
+	stopClosing context.CancelFunc
+
+	lock      sync.RWMutex
+	closed    bool
+	closeOnce sync.Once
 }
 
 var _ datastore.Datastore = (*MongoDS)(nil)
 var _ datastore.Batching = (*MongoDS)(nil)
 var _ datastore.TxnDatastore = (*MongoDS)(nil)
+var _ datastore.TTLDatastore = (*MongoDS)(nil)
 var _ dsextensions.DatastoreExtensions = (*MongoDS)(nil)
 
+// keyValue is the document stored for each key. Keys above the hashing
+// threshold are stored hashed in _id, along with the full key. Values
+// above the GridFS threshold are stored as a file, in which case the
+// document only keeps the id of the file and the size of the value.
+// Compressed values record the codec that compressed them, and encrypted
+// values the nonce and the encryption format version, along with the
+// plaintext size. Every write of the value increments the version of the
+// document.
 type keyValue struct {
-	Key   string `bson:"_id"`
-	Value []byte `bson:"v"`
+	ID         interface{}         `bson:"_id"`
+	FullKey    string              `bson:"k,omitempty"`
+	Value      []byte              `bson:"v"`
+	ExpireAt   *time.Time          `bson:"expireAt,omitempty"`
+	File       *primitive.ObjectID `bson:"f,omitempty"`
+	Codec      string              `bson:"c,omitempty"`
+	Nonce      []byte              `bson:"n,omitempty"`
+	Encryption int                 `bson:"e,omitempty"`
+	Size       int                 `bson:"s,omitempty"`
+	Version    int64               `bson:"ver,omitempty"`
 }
 
-func New(ctx context.Context, uri string, dbName string, opts ...Option) (*MongoDS, error) {
-	m, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
-	if err != nil {
-		return nil, fmt.Errorf("connecting to MongoDB: %s", err)
+// size returns the length of the value of kv without downloading
+// or decoding it.
+func (kv keyValue) size() int {
+	if kv.File != nil || kv.Codec != "" || kv.Encryption != 0 {
+		return kv.Size
 	}
+	return len(kv.Value)
+}
+
+// New connects to the MongoDB deployment at uri and returns a datastore
+// backed by a collection configured with opts.
+func New(ctx context.Context, uri string, opts ...Option) (*MongoDS, error) {
 	config := defaultConfig
 	for _, f := range opts {
-		f(&config)
+		if err := f(&config); err != nil {
+			return nil, fmt.Errorf("applying option: %w", err)
+		}
+	}
+	if err := resolveCollation(&config); err != nil {
+		return nil, err
+	}
+	if _, ok := config.keyCodec.(stringKeyCodec); !ok && config.keyHashThreshold > 0 {
+		return nil, errors.New("key hashing requires the string key codec")
+	}
+	if config.shardKey != "" && config.shardKey == config.valueField {
+		return nil, errors.New("shard key and value fields must differ")
+	}
+
+	m, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+
+	db := m.Database(config.dbName)
+
+	if err := createCollection(ctx, db, config.collName, config.collation); err != nil {
+		_ = m.Disconnect(ctx)
+		return nil, err
+	}
+	colOpts := options.Collection()
+	if config.readConcern != nil {
+		colOpts.SetReadConcern(config.readConcern)
+	}
+	if config.writeConcern != nil {
+		colOpts.SetWriteConcern(config.writeConcern)
+	}
+	if config.valueField != defaultValueField {
+		reg, err := kvRegistry(config.valueField)
+		if err != nil {
+			_ = m.Disconnect(ctx)
+			return nil, fmt.Errorf("building bson registry: %w", err)
+		}
+		colOpts.SetRegistry(reg)
+	}
+	col := db.Collection(config.collName, colOpts)
+	readCol := col
+	if config.readPref != nil {
+		readCol, err = col.Clone(options.Collection().SetReadPreference(config.readPref))
+		if err != nil {
+			_ = m.Disconnect(ctx)
+			return nil, fmt.Errorf("cloning collection: %w", err)
+		}
+	}
+	pointCol := readCol
+	if config.linearizable {
+		if config.readPref != nil && config.readPref.Mode() != readpref.PrimaryMode {
+			_ = m.Disconnect(ctx)
+			return nil, errors.New("linearizable reads can't target secondaries")
+		}
+		pointCol, err = col.Clone(options.Collection().
+			SetReadConcern(readconcern.Linearizable()).
+			SetReadPreference(readpref.Primary()))
+		if err != nil {
+			_ = m.Disconnect(ctx)
+			return nil, fmt.Errorf("cloning collection: %w", err)
+		}
+	}
+
+	queryCol := readCol
+	if config.majorityQueries {
+		queryCol, err = readCol.Clone(options.Collection().SetReadConcern(readconcern.Majority()))
+		if err != nil {
+			_ = m.Disconnect(ctx)
+			return nil, fmt.Errorf("cloning collection: %w", err)
+		}
+	}
+
+	if err := createIndexes(ctx, col, &config); err != nil {
+		_ = m.Disconnect(ctx)
+		return nil, err
 	}
 
-	db := m.Database(dbName)
+	txns := newTxnTracker(config.txnLeakWarn, config.txnMaxLifetime, config.logger)
+	var mt *metrics
+	if config.metricsRegisterer != nil {
+		if mt, err = newMetrics(config.metricsRegisterer, txns.oldest); err != nil {
+			_ = m.Disconnect(ctx)
+			return nil, fmt.Errorf("creating metrics: %w", err)
+		}
+	}
 
-	_ = db.CreateCollection(ctx, config.collName)
-	col := db.Collection(config.collName)
+	txnSupported, err := supportsTransactions(ctx, m)
+	if err != nil {
+		_ = m.Disconnect(ctx)
+		return nil, fmt.Errorf("detecting topology: %w", err)
+	}
+	if !txnSupported {
+		config.logger.Warnf("MongoDB deployment doesn't support transactions, it must be a replica set or a sharded cluster")
+	}
 
-	return &MongoDS{
+	ds := &MongoDS{
 		m:          m,
 		db:         db,
 		col:        col,
+		readCol:    readCol,
+		pointCol:   pointCol,
+		queryCol:   queryCol,
 		opTimeout:  config.opTimeout,
 		txnTimeout: config.txnTimeout,
-	}, nil
+
+		queryTimeout: config.queryTimeout,
+
+		txnMaxAttempts: config.txnMaxAttempts,
+		txnBackoff:     config.txnBackoff,
+		txnSupported:   txnSupported,
+		txnFallback:    config.txnFallback,
+		txns:           txns,
+
+		batchFlushThreshold: config.batchFlushThreshold,
+		unorderedBatch:      config.unorderedBatch,
+		batchConcurrency:    config.batchConcurrency,
+
+		metrics:    mt,
+		tracer:     config.tracerProvider.Tracer(tracerName),
+		redactKeys: config.redactKeys,
+
+		slowOpThreshold: config.slowOpThreshold,
+		logger:          config.logger,
+
+		gridfsThreshold: config.gridfsThreshold,
+		gridfsBucket:    config.gridfsBucket,
+		codec:           config.codec,
+		aead:            config.aead,
+
+		keyHashThreshold: config.keyHashThreshold,
+		namespace:        config.namespace,
+		keyCodec:         config.keyCodec,
+		shardKey:         config.shardKey,
+
+		ttlIndex:     config.ttlIndex,
+		valueIndex:   config.valueIndex,
+		prefixField:  config.prefixField,
+		allowDropAll: config.allowDropAll,
+
+		cursorBatchSize: config.cursorBatchSize,
+		maxNaiveResults: config.maxNaiveResults,
+
+		valueField: config.valueField,
+		timestamps: config.timestamps,
+		slidingTTL: config.slidingTTL,
+		collation:  config.collation,
+
+		writeRetries: config.writeRetries,
+
+		closeTimeout: config.closeTimeout,
+	}
+	ds.closing, ds.stopClosing = context.WithCancel(context.Background())
+	if config.rateLimit > 0 {
+		ds.opLimit = newRateLimiter(config.rateLimit)
+	}
+	if config.readRateLimit > 0 {
+		ds.readLimit = newRateLimiter(config.readRateLimit)
+	}
+	if config.writeRateLimit > 0 {
+		ds.writeLimit = newRateLimiter(config.writeRateLimit)
+	}
+	if config.breakerThreshold > 0 {
+		ds.breaker = newCircuitBreaker(config.breakerThreshold, config.breakerCooldown, config.logger)
+	}
+	if config.healthInterval > 0 {
+		ds.startHealthCheck(config.healthInterval, config.healthCallback)
+	}
+	return ds, nil
+}
+
+// supportsTransactions returns true if m is connected to a replica set or
+// a sharded cluster; standalone servers don't support transactions.
+func supportsTransactions(ctx context.Context, m *mongo.Client) (bool, error) {
+	var res bson.M
+	if err := m.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&res); err != nil {
+		return false, err
+	}
+	if _, ok := res["setName"]; ok {
+		return true, nil
+	}
+	msg, _ := res["msg"].(string)
+	return msg == "isdbgrid", nil
+}
+
+// reader returns the collection handle to read with in ctx. Transactions
+// must read from the primary, so the configured read preference only
+// applies outside of them.
+func (m *MongoDS) reader(ctx context.Context) *mongo.Collection {
+	if mongo.SessionFromContext(ctx) != nil {
+		return m.col
+	}
+	return m.readCol
+}
+
+// pointReader is like reader, for the single-document reads of Get and
+// Has, which use the linearizable read concern if it's enabled.
+func (m *MongoDS) pointReader(ctx context.Context) *mongo.Collection {
+	if mongo.SessionFromContext(ctx) != nil {
+		return m.col
+	}
+	return m.pointCol
+}
+
+// queryReader is like reader, for queries and counts, which use the
+// majority read concern if it's enabled.
+func (m *MongoDS) queryReader(ctx context.Context) *mongo.Collection {
+	if mongo.SessionFromContext(ctx) != nil {
+		return m.col
+	}
+	return m.queryCol
+}
+
+// valueIndex is the index matching values, stored in field, within a
+// range of keys. The value comes first so equality on it and a range over
+// _id are both bounded by the index.
+func valueIndex(field string) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{{Key: field, Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetName("v_id"),
+	}
+}
+
+// ttlIndex is the index that expires documents once their expireAt time
+// is reached. Only documents that have the field are covered, so keys
+// stored without a TTL never expire.
+func ttlIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys: bson.M{"expireAt": 1},
+		Options: options.Index().
+			SetName("expireAt_ttl").
+			SetExpireAfterSeconds(0).
+			SetPartialFilterExpression(bson.M{"expireAt": bson.M{"$exists": true}}),
+	}
 }
 
 func (m *MongoDS) Batch() (datastore.Batch, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
 	return &mongoBatch{
-		ds:      m,
-		deletes: map[datastore.Key]struct{}{},
-		upserts: map[datastore.Key][]byte{},
+		ds:        m,
+		keys:      map[string]int{},
+		unordered: m.unorderedBatch,
 	}, nil
 }
 
@@ -91,6 +422,42 @@ func (m *MongoDS) Put(key datastore.Key, val []byte) error {
 	return m.put(ctx, key, val)
 }
 
+func (m *MongoDS) PutWithTTL(key datastore.Key, val []byte, ttl time.Duration) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	defer cls()
+	return m.putWithTTL(ctx, key, val, ttl)
+}
+
+func (m *MongoDS) SetTTL(key datastore.Key, ttl time.Duration) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	defer cls()
+	return m.setTTL(ctx, key, ttl)
+}
+
+func (m *MongoDS) GetExpiration(key datastore.Key) (time.Time, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return time.Time{}, ErrClosed
+	}
+
+	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	defer cls()
+	return m.getExpiration(ctx, key)
+}
+
 func (m *MongoDS) Has(key datastore.Key) (bool, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
@@ -103,7 +470,34 @@ func (m *MongoDS) Has(key datastore.Key) (bool, error) {
 	return m.has(ctx, key)
 }
 
-func (m *MongoDS) Sync(datastore.Key) error {
+// Sync acts as a durability barrier: it does a write acknowledged by a
+// majority of the replica set members and journaled. Since replication
+// applies writes in order, once Sync returns every write that returned
+// before it is majority-committed and survives a failover, regardless of
+// the write concern the datastore was configured with. This holds for
+// the whole collection, so the prefix is only validated.
+func (m *MongoDS) Sync(prefix datastore.Key) error {
+	if p := prefix.String(); p != "" && p[0] != '/' {
+		return fmt.Errorf("invalid sync prefix %q", p)
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	defer cls()
+	wc := writeconcern.New(writeconcern.WMajority(), writeconcern.J(true))
+	col, err := m.col.Clone(options.Collection().SetWriteConcern(wc))
+	if err != nil {
+		return fmt.Errorf("cloning collection: %w", err)
+	}
+	barrier := bson.M{"$set": bson.M{m.valueField: []byte{}, "t": time.Now()}}
+	if _, err := col.UpdateOne(ctx, m.internalFilter(syncBarrierID), barrier, options.Update().SetUpsert(true)); err != nil {
+		return fmt.Errorf("writing sync barrier: %w", err)
+	}
 	return nil
 }
 
@@ -130,6 +524,49 @@ func (m *MongoDS) Get(key datastore.Key) ([]byte, error) {
 	return m.get(ctx, key)
 }
 
+// GetMany retrieves the values of keys with a single round-trip. Keys that
+// aren't found are absent from the returned map.
+func (m *MongoDS) GetMany(ctx context.Context, keys []datastore.Key) (map[datastore.Key][]byte, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.getMany(ctx, keys)
+}
+
+// HasMany checks the existence of keys with a single round-trip, without
+// transferring their values. Every requested key is present in the returned map.
+func (m *MongoDS) HasMany(ctx context.Context, keys []datastore.Key) (map[datastore.Key]bool, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.hasMany(ctx, keys)
+}
+
+// GetSizeMany returns the value sizes of keys with a single aggregation,
+// without transferring their values. Keys that aren't found are absent
+// from the returned map.
+func (m *MongoDS) GetSizeMany(ctx context.Context, keys []datastore.Key) (map[datastore.Key]int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.getSizeMany(ctx, keys)
+}
+
 func (m *MongoDS) Delete(key datastore.Key) error {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
@@ -142,6 +579,62 @@ func (m *MongoDS) Delete(key datastore.Key) error {
 	return m.delete(ctx, key)
 }
 
+// DeleteManyKeys deletes keys and returns the ones that existed and were
+// removed, in the order they were given. On deployments supporting
+// transactions, the keys found and their deletion are part of the same
+// transaction, so the result is exact. Otherwise, a key found may be
+// deleted concurrently by another client before being deleted here, and
+// is then reported as deleted by both.
+func (m *MongoDS) DeleteManyKeys(ctx context.Context, keys []datastore.Key) ([]datastore.Key, error) {
+	if m.txnSupported {
+		var deleted []datastore.Key
+		err := m.WithTransaction(ctx, false, func(txn dsextensions.TxnExt) error {
+			var err error
+			deleted, err = txn.(*mongoTxn).DeleteManyKeys(ctx, keys)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return deleted, nil
+	}
+
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.deleteManyKeys(ctx, keys)
+}
+
+// DeletePrefix deletes every key strictly below prefix with a single
+// DeleteMany, and returns how many were removed. The deletion is bounded
+// by the op timeout; subtrees too large to be removed in time are only
+// partially deleted, and the call can be repeated. Use the transaction
+// DeletePrefix to delete atomically with other writes.
+//
+// If WithProgress is set, the keys are instead deleted in batches, each
+// bounded by the op timeout, and the progress is reported after each batch
+// against the number of keys below prefix when the deletion started.
+func (m *MongoDS) DeletePrefix(ctx context.Context, prefix datastore.Key, opts ...BulkOption) (int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+
+	c := newBulkConfig(opts)
+	if c.progress != nil {
+		return m.deletePrefixBatches(ctx, prefix, c.progress)
+	}
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.deletePrefix(ctx, prefix)
+}
+
 func (m *MongoDS) QueryExtended(q dsextensions.QueryExt) (query.Results, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
@@ -149,7 +642,7 @@ func (m *MongoDS) QueryExtended(q dsextensions.QueryExt) (query.Results, error)
 		return nil, ErrClosed
 	}
 
-	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	ctx, cls := context.WithTimeout(context.Background(), m.queryTimeout)
 	defer cls()
 
 	return m.query(ctx, q)
@@ -162,7 +655,7 @@ func (m *MongoDS) Query(q query.Query) (query.Results, error) {
 		return nil, ErrClosed
 	}
 
-	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	ctx, cls := context.WithTimeout(context.Background(), m.queryTimeout)
 	defer cls()
 
 	qe := dsextensions.QueryExt{Query: q}
@@ -170,184 +663,738 @@ func (m *MongoDS) Query(q query.Query) (query.Results, error) {
 	return m.query(ctx, qe)
 }
 
-func (m *MongoDS) Close() error {
-	m.lock.Lock()
-	defer m.lock.Unlock()
+// Count returns the number of entries matching q. The prefix, offset and
+// limit are counted server-side; queries with filters fall back to counting
+// the streamed results. The count reflects a point-in-time and isn't
+// transactional, use the transaction Count to count within a transaction.
+func (m *MongoDS) Count(ctx context.Context, q query.Query) (int, error) {
+	m.lock.RLock()
 	if m.closed {
-		return fmt.Errorf("mongods already closed")
+		m.lock.RUnlock()
+		return 0, ErrClosed
 	}
-	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
 	defer cls()
-	if err := m.m.Disconnect(ctx); err != nil {
-		return fmt.Errorf("client disconnecting: %s", err)
+
+	if _, ok := m.serverFilters(q); !ok {
+		// Close waits for the query worker on its own, so release the
+		// lock before draining the results to not hold Close back.
+		res, err := m.query(ctx, dsextensions.QueryExt{Query: q})
+		m.lock.RUnlock()
+		if err != nil {
+			return 0, err
+		}
+		return countResults(res)
 	}
-	m.closed = true
-	return nil
+	defer m.lock.RUnlock()
+	return m.countDocuments(ctx, q)
 }
 
-func (m *MongoDS) get(ctx context.Context, key datastore.Key) ([]byte, error) {
-	sr := m.col.FindOne(ctx, bson.M{"_id": key.String()})
-	if sr.Err() == mongo.ErrNoDocuments {
-		return nil, datastore.ErrNotFound
-	}
-	if sr.Err() != nil {
-		return nil, fmt.Errorf("delete document: %s", sr.Err())
-	}
-	var kv keyValue
-	if err := sr.Decode(&kv); err != nil {
-		return nil, fmt.Errorf("decoding key-value: %s", err)
+// Collection returns the collection storing the key-values, as an escape
+// hatch to run aggregations or index operations the datastore doesn't
+// wrap. Documents don't necessarily store keys and values as is: long keys
+// may be hashed, and values may be compressed, encrypted or stored in
+// GridFS. Writing to the collection directly bypasses these layers, and
+// may leave documents the datastore can't read.
+func (m *MongoDS) Collection() *mongo.Collection {
+	return m.col
+}
+
+// Database returns the database holding the collection. See Collection
+// for the risks of bypassing the datastore.
+func (m *MongoDS) Database() *mongo.Database {
+	return m.db
+}
+
+// Client returns the client connected to MongoDB. It's disconnected
+// when the datastore is closed.
+func (m *MongoDS) Client() *mongo.Client {
+	return m.m
+}
+
+// CountPrefix returns the number of keys strictly below prefix. It's
+// counted server-side over a range of the _id index.
+func (m *MongoDS) CountPrefix(ctx context.Context, prefix datastore.Key) (int64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return 0, ErrClosed
 	}
-	return kv.Value, nil
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.countPrefix(ctx, prefix)
 }
 
-func (m *MongoDS) delete(ctx context.Context, key datastore.Key) error {
-	_, err := m.col.DeleteOne(ctx, bson.M{"_id": key.String()})
+func (m *MongoDS) countPrefix(ctx context.Context, prefix datastore.Key) (_ int64, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return 0, err
+	}
+	ctx, end := m.startOp(ctx, "countPrefix", prefix.String())
+	defer end(&err)
+	n, err := m.queryReader(ctx).CountDocuments(ctx, m.prefixFilter(prefix.String()))
 	if err != nil {
-		return fmt.Errorf("delete document: %s", err)
+		return 0, fmt.Errorf("counting documents: %w", err)
 	}
+	return n, nil
+}
 
-	return nil
+// Close stops accepting new operations, which fail with ErrClosed, then
+// waits for the queries and transactions in flight to finish before
+// disconnecting the client. Queries, aggregations included, are in flight
+// until their results are closed or fully read, transactions until they're
+// committed or discarded, and causal sessions until they're closed. Watch
+// streams are stopped. If they don't finish within the close timeout, the
+// transactions still open are aborted, and the client is disconnected
+// anyway, which makes the others fail.
+//
+// Close is idempotent: calls after the first one return nil, once the
+// first one returned.
+func (m *MongoDS) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		err = m.close()
+	})
+	return err
 }
 
-func (m *MongoDS) put(ctx context.Context, key datastore.Key, val []byte) error {
-	_, err := m.col.UpdateOne(ctx, bson.M{"_id": key.String()}, bson.M{"$set": bson.M{"v": val}}, options.Update().SetUpsert(true))
-	if err != nil {
-		return fmt.Errorf("inserting/updating key-value: %s", err)
+func (m *MongoDS) close() error {
+	// Operations check the flag under the read lock, so once it's set
+	// no new operation starts, and none can start a transaction or a
+	// query that Close wouldn't wait for.
+	m.lock.Lock()
+	m.closed = true
+	m.lock.Unlock()
+	m.stopClosing()
+	m.stopHealthCheck()
+
+	if !m.drain(m.closeTimeout) {
+		m.logger.Warnf("closing with queries or transactions still in flight after %s", m.closeTimeout)
+	}
+	// The watchdog and leak warnings don't fire past this point, and the
+	// transactions left open are aborted while the client is connected.
+	for _, abort := range m.txns.stop() {
+		abort()
+	}
+	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	defer cls()
+	if err := m.m.Disconnect(ctx); err != nil {
+		return fmt.Errorf("client disconnecting: %w", err)
 	}
 	return nil
 }
 
-func (m *MongoDS) has(ctx context.Context, key datastore.Key) (bool, error) {
-	sr := m.col.FindOne(ctx, bson.M{"_id": key.String()})
-	if sr.Err() == mongo.ErrNoDocuments {
-		return false, nil
+// drain waits up to timeout for the queries and transactions in flight to
+// finish, and returns whether they did.
+func (m *MongoDS) drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		m.active.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
 	}
-	if sr.Err() != nil {
-		return false, fmt.Errorf("finding key: %s", sr.Err())
+}
+
+func (m *MongoDS) get(ctx context.Context, key datastore.Key) (_ []byte, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return nil, err
 	}
-	return true, nil
+	ctx, end := m.startOp(ctx, "get", key.String())
+	defer end(&err)
+	return m.getValue(ctx, key)
 }
 
-func (m *MongoDS) getSize(ctx context.Context, key datastore.Key) (int, error) {
-	v, err := m.get(ctx, key)
-	if err == datastore.ErrNotFound {
-		return -1, err
+func (m *MongoDS) getValue(ctx context.Context, key datastore.Key) ([]byte, error) {
+	kv, err := m.findKeyValue(ctx, m.pointReader(ctx), key)
+	if err != nil {
+		return nil, err
 	}
+	val, err := m.loadValue(ctx, kv)
 	if err != nil {
-		return 0, fmt.Errorf("getting value: %s", err)
-	}
-	return len(v), nil
-}
-
-func (m *MongoDS) query(ctx context.Context, q dsextensions.QueryExt) (query.Results, error) {
-	opts := options.Find()
-
-	// Handle ordering
-	asc := true
-	if len(q.Orders) > 0 {
-		switch q.Orders[0].(type) {
-		case dsq.OrderByKey, *dsq.OrderByKey:
-			// We order by key by default.
-		case dsq.OrderByKeyDescending, *dsq.OrderByKeyDescending:
-			// Reverse order by key
-			asc = false
-		default:
-			// Ok, we have a weird order we can't handle. Let's
-			// perform the _base_ query (prefix, filter, etc.), then
-			// handle sort/offset/limit later.
-
-			// Skip the stuff we can't apply.
-			baseQuery := q
-			baseQuery.Limit = 0
-			baseQuery.Offset = 0
-			baseQuery.Orders = nil
-
-			// perform the base query.
-			res, err := m.query(ctx, baseQuery)
-			if err != nil {
-				return nil, err
-			}
-
-			// fix the query
-			res = dsq.ResultsReplaceQuery(res, q.Query)
-
-			// Remove the parts we've already applied.
-			naiveQuery := q.Query
-			naiveQuery.Prefix = ""
-			naiveQuery.Filters = nil
-
-			// Apply the rest of the query
-			return dsq.NaiveQueryApply(naiveQuery, res), nil
-		}
+		return nil, err
 	}
-	opts.SetSort(bson.M{"_id": 1})
-	if !asc {
-		opts.SetSort(bson.M{"_id": -1})
+	if m.slidingTTL > 0 && kv.ExpireAt != nil && mongo.SessionFromContext(ctx) == nil {
+		m.touch(ctx, key)
 	}
+	return val, nil
+}
 
-	prefix := datastore.NewKey(q.Prefix).String()
-	// Important to consider the '/' suffix to respect Prefix semantics
-	// of returning strictly child keys.
-	var filters bson.A
-	if prefix != "/" {
-		rgx := fmt.Sprintf("^%s/.*", regexp.QuoteMeta(prefix))
-		filters = append(filters, bson.M{"_id": bson.M{"$regex": primitive.Regex{Pattern: rgx}}})
-	}
-	seekPrefix := datastore.NewKey(q.SeekPrefix).String()
-	if seekPrefix != "/" {
-		op := "$gte"
-		if !asc {
-			op = "$lte"
-		}
-		filters = append(filters, bson.M{"_id": bson.M{op: seekPrefix}})
+// touch pushes the expiration of the document of key back to the sliding TTL
+// from now. It never brings an expiration closer, nor revives a document
+// that already expired. Failures are only logged, as the read succeeded.
+func (m *MongoDS) touch(ctx context.Context, key datastore.Key) {
+	filter, err := m.docFilter(key)
+	if err != nil {
+		m.logger.Warnf("extending expiration of %s: %s", key, err)
+		return
 	}
-	fil := bson.M{}
-	if len(filters) > 0 {
-		fil = bson.M{"$and": filters}
+	now := time.Now()
+	filter["expireAt"] = bson.M{"$gt": now}
+	update := bson.M{"$max": bson.M{"expireAt": now.Add(m.slidingTTL)}}
+	if _, err := m.col.UpdateOne(ctx, filter, update); err != nil {
+		m.logger.Warnf("extending expiration of %s: %s", key, err)
 	}
+}
 
-	// If we have no filters, then we can leverage Skip.
-	// If that isn't the case, we should fetch all of them
-	// and apply skipping later.
-	if len(q.Filters) == 0 {
-		opts.SetSkip(int64(q.Offset))
+// findKeyValue returns the document storing key in col, or ErrNotFound.
+func (m *MongoDS) findKeyValue(ctx context.Context, col *mongo.Collection, key datastore.Key) (keyValue, error) {
+	var kv keyValue
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return kv, err
 	}
-
-	if q.KeysOnly {
-		opts.SetProjection(bson.D{
-			{Key: "v", Value: 0},
-		})
+	if err := col.FindOne(ctx, filter).Decode(&kv); err != nil {
+		return kv, readErr("finding key-value", err)
 	}
+	return kv, nil
+}
 
-	it, err := m.col.Find(ctx, fil, opts)
+func (m *MongoDS) getMany(ctx context.Context, keys []datastore.Key) (_ map[datastore.Key][]byte, err error) {
+	res := make(map[datastore.Key][]byte, len(keys))
+	if len(keys) == 0 {
+		return res, nil
+	}
+	if err = m.admit(ctx, readOp); err != nil {
+		return nil, err
+	}
+	ctx, end := m.startOp(ctx, "getMany", "")
+	defer end(&err)
+	filter, err := m.docsFilter(keys)
 	if err != nil {
-		return nil, fmt.Errorf("finding key-values: %s", err)
+		return nil, err
 	}
+	cur, err := m.reader(ctx).Find(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("finding key-values: %w", err)
+	}
+	defer func() {
+		if err := cur.Close(ctx); err != nil {
+			m.logger.Errorf("closing cursor: %s", err)
+		}
+	}()
+	for cur.Next(ctx) {
+		var kv keyValue
+		if err := cur.Decode(&kv); err != nil {
+			return nil, fmt.Errorf("decoding key-value: %w", err)
+		}
+		k, err := m.kvKey(kv)
+		if err != nil {
+			return nil, err
+		}
+		v, err := m.loadValue(ctx, kv)
+		if err != nil {
+			return nil, err
+		}
+		res[datastore.NewKey(k)] = v
+	}
+	if err := cur.Err(); err != nil {
+		return nil, fmt.Errorf("iterating key-values: %w", err)
+	}
+	return res, nil
+}
 
-	qrb := dsq.NewResultBuilder(q.Query)
-	qrb.Process.Go(func(worker goprocess.Process) {
-		m.lock.RLock()
-		closedEarly := false
-		defer func() {
-			m.lock.RUnlock()
-			if closedEarly {
-				select {
-				case qrb.Output <- dsq.Result{
-					Error: ErrClosed,
-				}:
-				case <-qrb.Process.Closing():
-				}
-			}
-
-		}()
-		if m.closed {
-			closedEarly = true
-			return
+func (m *MongoDS) hasMany(ctx context.Context, keys []datastore.Key) (_ map[datastore.Key]bool, err error) {
+	res := make(map[datastore.Key]bool, len(keys))
+	if len(keys) == 0 {
+		return res, nil
+	}
+	if err = m.admit(ctx, readOp); err != nil {
+		return nil, err
+	}
+	ctx, end := m.startOp(ctx, "hasMany", "")
+	defer end(&err)
+	for _, k := range keys {
+		res[k] = false
+	}
+	filter, err := m.docsFilter(keys)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetProjection(keysProjection)
+	cur, err := m.reader(ctx).Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("finding keys: %w", err)
+	}
+	defer func() {
+		if err := cur.Close(ctx); err != nil {
+			m.logger.Errorf("closing cursor: %s", err)
+		}
+	}()
+	for cur.Next(ctx) {
+		var kv keyValue
+		if err := cur.Decode(&kv); err != nil {
+			return nil, fmt.Errorf("decoding key: %w", err)
+		}
+		k, err := m.kvKey(kv)
+		if err != nil {
+			return nil, err
+		}
+		res[datastore.NewKey(k)] = true
+	}
+	if err := cur.Err(); err != nil {
+		return nil, fmt.Errorf("iterating keys: %w", err)
+	}
+	return res, nil
+}
+
+// keyIDs returns the _id values of keys.
+func (m *MongoDS) keyIDs(keys []datastore.Key) (bson.A, error) {
+	ids := make(bson.A, len(keys))
+	for i, k := range keys {
+		id, err := m.docID(k)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+func (m *MongoDS) delete(ctx context.Context, key datastore.Key) (err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return err
+	}
+	ctx, end := m.startOp(ctx, "delete", key.String())
+	defer end(&err)
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return err
+	}
+	if m.gridfsThreshold <= 0 {
+		err = m.retryWrite(ctx, func() error {
+			_, err := m.col.DeleteOne(ctx, filter)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("delete document: %w", err)
+		}
+		return nil
+	}
+
+	// The deletion isn't retried: if an attempt that failed was applied
+	// nonetheless, the retry wouldn't find the file to delete.
+	var prev keyValue
+	opts := options.FindOneAndDelete().SetProjection(bson.M{"f": 1})
+	err = m.col.FindOneAndDelete(ctx, filter, opts).Decode(&prev)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("delete document: %w", err)
+	}
+	m.replacedFile(ctx, prev.File)
+	return nil
+}
+
+// deleteManyKeys finds which of keys exist, and deletes them by _id so
+// that keys written since aren't removed without being reported.
+func (m *MongoDS) deleteManyKeys(ctx context.Context, keys []datastore.Key) (_ []datastore.Key, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return nil, err
+	}
+	ctx, end := m.startOp(ctx, "deleteManyKeys", "")
+	defer end(&err)
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	filter, err := m.docsFilter(keys)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "k": 1, "f": 1})
+	cur, err := m.col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("finding key-values: %w", err)
+	}
+	var kvs []keyValue
+	if err := cur.All(ctx, &kvs); err != nil {
+		return nil, fmt.Errorf("decoding key-values: %w", err)
+	}
+	if len(kvs) == 0 {
+		return nil, nil
+	}
+	ids := make(bson.A, len(kvs))
+	found := make(map[string]struct{}, len(kvs))
+	for i, kv := range kvs {
+		ids[i] = kv.ID
+		found[m.kvIDString(kv)] = struct{}{}
+	}
+	if _, err := m.col.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return nil, fmt.Errorf("deleting documents: %w", err)
+	}
+	for _, kv := range kvs {
+		m.replacedFile(ctx, kv.File)
+	}
+
+	deleted := make([]datastore.Key, 0, len(kvs))
+	for _, k := range keys {
+		id := m.idString(k)
+		if _, ok := found[id]; ok {
+			deleted = append(deleted, k)
+			delete(found, id)
+		}
+	}
+	return deleted, nil
+}
+
+// deletePrefix removes the keys below prefix. The GridFS files of the
+// removed keys, if any, are left for CollectGarbage.
+func (m *MongoDS) deletePrefix(ctx context.Context, prefix datastore.Key) (_ int, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return 0, err
+	}
+	ctx, end := m.startOp(ctx, "deletePrefix", prefix.String())
+	defer end(&err)
+	res, err := m.col.DeleteMany(ctx, m.prefixFilter(prefix.String()))
+	if err != nil {
+		return 0, fmt.Errorf("deleting documents: %w", err)
+	}
+	return int(res.DeletedCount), nil
+}
+
+// deletePrefixBatches removes the keys below prefix in batches, calling
+// progress after each of them.
+func (m *MongoDS) deletePrefixBatches(ctx context.Context, prefix datastore.Key, progress func(done, total int)) (_ int, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return 0, err
+	}
+	ctx, end := m.startOp(ctx, "deletePrefix", prefix.String())
+	defer end(&err)
+
+	filter := m.prefixFilter(prefix.String())
+	cctx, cls := context.WithTimeout(ctx, m.opTimeout)
+	total, err := m.col.CountDocuments(cctx, filter)
+	cls()
+	if err != nil {
+		return 0, fmt.Errorf("counting documents: %w", err)
+	}
+	deleted := 0
+	for {
+		found, n, err := m.deleteBatch(ctx, filter)
+		deleted += n
+		if err != nil || found == 0 {
+			return deleted, err
+		}
+		progress(deleted, int(total))
+	}
+}
+
+// deleteBatch removes up to gcBatchSize documents matching filter. It
+// returns how many it found, and how many of them it removed.
+func (m *MongoDS) deleteBatch(ctx context.Context, filter bson.M) (int, int, error) {
+	ctx, cls := context.WithTimeout(ctx, m.opTimeout)
+	defer cls()
+
+	opts := options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(gcBatchSize)
+	cur, err := m.col.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("finding documents: %w", err)
+	}
+	var kvs []keyValue
+	if err := cur.All(ctx, &kvs); err != nil {
+		return 0, 0, fmt.Errorf("decoding documents: %w", err)
+	}
+	if len(kvs) == 0 {
+		return 0, 0, nil
+	}
+	ids := make(bson.A, len(kvs))
+	for i, kv := range kvs {
+		ids[i] = kv.ID
+	}
+	res, err := m.col.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return len(kvs), 0, fmt.Errorf("deleting documents: %w", err)
+	}
+	return len(kvs), int(res.DeletedCount), nil
+}
+
+func (m *MongoDS) put(ctx context.Context, key datastore.Key, val []byte) (err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return err
+	}
+	ctx, end := m.startOp(ctx, "put", key.String())
+	defer end(&err)
+	if err = m.writeValue(ctx, key, val, nil); err != nil {
+		return fmt.Errorf("inserting/updating key-value: %w", err)
+	}
+	return nil
+}
+
+func (m *MongoDS) putWithTTL(ctx context.Context, key datastore.Key, val []byte, ttl time.Duration) (err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return err
+	}
+	ctx, end := m.startOp(ctx, "putWithTTL", key.String())
+	defer end(&err)
+	expireAt := time.Now().Add(ttl)
+	if err := m.writeValue(ctx, key, val, &expireAt); err != nil {
+		return fmt.Errorf("inserting/updating key-value with ttl: %w", err)
+	}
+	return nil
+}
+
+func (m *MongoDS) setTTL(ctx context.Context, key datastore.Key, ttl time.Duration) (err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return err
+	}
+	ctx, end := m.startOp(ctx, "setTTL", key.String())
+	defer end(&err)
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return err
+	}
+	res, err := m.col.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"expireAt": time.Now().Add(ttl)}})
+	if err != nil {
+		return fmt.Errorf("updating expiration: %w", err)
+	}
+	if res.MatchedCount == 0 {
+		return datastore.ErrNotFound
+	}
+	return nil
+}
+
+func (m *MongoDS) getExpiration(ctx context.Context, key datastore.Key) (_ time.Time, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return time.Time{}, err
+	}
+	ctx, end := m.startOp(ctx, "getExpiration", key.String())
+	defer end(&err)
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return time.Time{}, err
+	}
+	opts := options.FindOne().SetProjection(bson.M{"expireAt": 1})
+	var kv keyValue
+	if err := m.reader(ctx).FindOne(ctx, filter, opts).Decode(&kv); err != nil {
+		return time.Time{}, readErr("finding key", err)
+	}
+	if kv.ExpireAt == nil {
+		return time.Time{}, nil
+	}
+	return *kv.ExpireAt, nil
+}
+
+// putUpdate returns the update document that stores ev inline, dropping
+// the GridFS file reference the key may have had. A nil expireAt clears
+// any expiration the key had.
+func (m *MongoDS) putUpdate(ev encodedValue, expireAt *time.Time) bson.M {
+	set := bson.M{m.valueField: ev.data}
+	m.setUpdatedAt(set)
+	unset := bson.M{"f": ""}
+	setEncoding(set, unset, ev)
+	if expireAt == nil {
+		unset["expireAt"] = ""
+	} else {
+		set["expireAt"] = *expireAt
+	}
+	return bson.M{"$set": set, "$unset": unset, "$inc": bson.M{"ver": 1}}
+}
+
+// setEncoding adds the fields describing how ev is stored to the set
+// and unset parts of an update. The size is only stored if it can't be
+// inferred from the stored bytes.
+func setEncoding(set, unset bson.M, ev encodedValue) {
+	if ev.codec != "" {
+		set["c"] = ev.codec
+	} else {
+		unset["c"] = ""
+	}
+	if ev.encryption != 0 {
+		set["n"] = ev.nonce
+		set["e"] = ev.encryption
+	} else {
+		unset["n"] = ""
+		unset["e"] = ""
+	}
+	if ev.codec != "" || ev.encryption != 0 || set["f"] != nil {
+		set["s"] = ev.size
+	} else {
+		unset["s"] = ""
+	}
+}
+
+func (m *MongoDS) has(ctx context.Context, key datastore.Key) (_ bool, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return false, err
+	}
+	ctx, end := m.startOp(ctx, "has", key.String())
+	defer end(&err)
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return false, err
+	}
+	err = readErr("finding key", m.pointReader(ctx).FindOne(ctx, filter).Err())
+	if err == datastore.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (m *MongoDS) getSize(ctx context.Context, key datastore.Key) (_ int, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return 0, err
+	}
+	ctx, end := m.startOp(ctx, "getSize", key.String())
+	defer end(&err)
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return 0, err
+	}
+	var sizes []keySize
+	sizes, err = m.valueSizes(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	if len(sizes) == 0 {
+		return -1, datastore.ErrNotFound
+	}
+	return sizes[0].Size, nil
+}
+
+func (m *MongoDS) getSizeMany(ctx context.Context, keys []datastore.Key) (_ map[datastore.Key]int, err error) {
+	res := make(map[datastore.Key]int, len(keys))
+	if len(keys) == 0 {
+		return res, nil
+	}
+	if err = m.admit(ctx, readOp); err != nil {
+		return nil, err
+	}
+	ctx, end := m.startOp(ctx, "getSizeMany", "")
+	defer end(&err)
+	filter, err := m.docsFilter(keys)
+	if err != nil {
+		return nil, err
+	}
+	sizes, err := m.valueSizes(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sizes {
+		k, err := m.kvKey(keyValue{ID: s.ID, FullKey: s.FullKey})
+		if err != nil {
+			return nil, err
+		}
+		res[datastore.NewKey(k)] = s.Size
+	}
+	return res, nil
+}
+
+// keySize is the result of the valueSizes aggregation.
+type keySize struct {
+	ID        interface{} `bson:"_id"`
+	FullKey   string      `bson:"k,omitempty"`
+	Size      int         `bson:"size"`
+	CreatedAt *time.Time  `bson:"createdAt,omitempty"`
+	UpdatedAt *time.Time  `bson:"updatedAt,omitempty"`
+	Version   int64       `bson:"ver,omitempty"`
+}
+
+// valueSizes returns the value sizes of the documents matching filter,
+// computed server-side so the values aren't transferred. Documents whose
+// value isn't stored as is record its size, which is used instead. The
+// timestamps and versions of the documents are returned as well.
+func (m *MongoDS) valueSizes(ctx context.Context, filter bson.M) ([]keySize, error) {
+	size := bson.M{"$ifNull": bson.A{"$s", bson.M{"$ifNull": bson.A{bson.M{"$binarySize": "$" + m.valueField}, 0}}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$project", Value: bson.M{"k": 1, "size": size, "createdAt": 1, "updatedAt": 1, "ver": 1}}},
+	}
+	cur, err := m.reader(ctx).Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("computing value sizes: %w", err)
+	}
+	var sizes []keySize
+	if err := cur.All(ctx, &sizes); err != nil {
+		return nil, fmt.Errorf("decoding value sizes: %w", err)
+	}
+	return sizes, nil
+}
+
+func (m *MongoDS) query(ctx context.Context, q dsextensions.QueryExt, opts ...QueryOption) (_ query.Results, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return nil, err
+	}
+	ctx, end := m.startOp(ctx, "query", q.Prefix)
+	defer end(&err)
+	var qc queryConfig
+	for _, opt := range opts {
+		opt(&qc)
+	}
+	return m.runQuery(ctx, q, qc)
+}
+
+func (m *MongoDS) runQuery(ctx context.Context, q dsextensions.QueryExt, qc queryConfig) (query.Results, error) {
+	asc, ok := keyOrder(q.Orders)
+	if !ok {
+		// Ok, we have a weird order we can't handle. Let's
+		// perform the _base_ query (prefix, filter, etc.), then
+		// handle sort/offset/limit later.
+
+		// perform the base query.
+		res, err := m.runQuery(ctx, baseQuery(q), qc)
+		if err != nil {
+			return nil, err
 		}
 
+		// fix the query
+		res = dsq.ResultsReplaceQuery(res, q.Query)
+		if m.maxNaiveResults > 0 {
+			res = capResults(res, m.maxNaiveResults)
+		}
+
+		// Remove the parts we've already applied.
+		naiveQuery := q.Query
+		naiveQuery.Prefix = ""
+		naiveQuery.Filters = nil
+
+		// Apply the rest of the query
+		return dsq.NaiveQueryApply(naiveQuery, res), nil
+	}
+
+	resultQuery := q.Query
+	fil, opts, clientFilters := m.findArgs(ctx, q, qc, asc)
+	q.Filters = clientFilters
+
+	it, err := m.queryReader(ctx).Find(ctx, fil, opts)
+	if err != nil && qc.hint != "" {
+		return nil, fmt.Errorf("finding key-values with index hint %q: %w", qc.hint, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("finding key-values: %w", err)
+	}
+
+	// The worker is in flight until it's done iterating. Callers hold the
+	// read lock or run within a transaction, which is itself in flight, so
+	// Close can't be waiting on an idle counter.
+	m.active.Add(1)
+	qrb := dsq.NewResultBuilder(resultQuery)
+	qrb.Process.Go(func(worker goprocess.Process) {
+		defer m.active.Done()
+
+		// The cursor is consumed lazily, one document per Next, as the
+		// client reads results. Closing the results cancels any pending
+		// Next and releases the cursor.
+		iterCtx, iterCancel := context.WithCancel(context.Background())
+		go func() {
+			select {
+			case <-worker.Closing():
+				iterCancel()
+			case <-iterCtx.Done():
+			}
+		}()
 		defer func() {
+			iterCancel()
 			if err := it.Close(context.Background()); err != nil {
-				log.Errorf("closing iterator: %s", err)
+				m.logger.Errorf("closing iterator: %s", err)
 			}
 		}()
 
@@ -355,7 +1402,7 @@ func (m *MongoDS) query(ctx context.Context, q dsextensions.QueryExt) (query.Res
 			// skip to the offset
 			skipped := 0
 			for skipped < q.Offset {
-				ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+				ctx, cls := context.WithTimeout(iterCtx, m.queryTimeout)
 				if !it.Next(ctx) {
 					cls()
 					break
@@ -363,58 +1410,47 @@ func (m *MongoDS) query(ctx context.Context, q dsextensions.QueryExt) (query.Res
 				cls()
 
 				var item keyValue
-				err = it.Decode(&item)
-				if err != nil {
-					select {
-					case qrb.Output <- dsq.Result{Error: err}:
-					case <-worker.Closing(): // client told us to close early
-						return
-					}
+				err := it.Decode(&item)
+				var key string
+				if err == nil {
+					key, err = m.kvKey(item)
 				}
-
-				matches := true
-				check := func(value []byte) error {
-					e := dsq.Entry{
-						Key:   item.Key,
-						Value: value,
-						Size:  len(value), // this function is basically free
-					}
-
-					matches = filter(q.Filters, e)
-					return nil
-				}
-
-				var err error
-				if q.KeysOnly {
-					err = check(nil)
-				} else {
-					err = check(item.Value)
+				var value []byte
+				if err == nil {
+					// Filters may check the value even if the
+					// query only returns keys.
+					value, err = m.iterValue(iterCtx, item)
 				}
-
 				if err != nil {
 					select {
 					case qrb.Output <- dsq.Result{Error: err}:
+						continue
 					case <-worker.Closing(): // client told us to close early
 						return
 					}
 				}
-				if !matches {
+
+				e := dsq.Entry{
+					Key:   key,
+					Value: value,
+					Size:  item.size(), // this function is basically free
+				}
+				if !filter(q.Filters, e) {
 					skipped++
 				}
-
 			}
 			if it.Err() != nil {
 				select {
 				case qrb.Output <- dsq.Result{Error: it.Err()}:
 				case <-worker.Closing(): // client told us to close early
-					return
 				}
+				return
 			}
 		}
 
 		sent := 0
 		for q.Limit <= 0 || sent < q.Limit {
-			ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+			ctx, cls := context.WithTimeout(iterCtx, m.queryTimeout)
 			if !it.Next(ctx) {
 				cls()
 				break
@@ -423,26 +1459,52 @@ func (m *MongoDS) query(ctx context.Context, q dsextensions.QueryExt) (query.Res
 			cls()
 
 			var item keyValue
-			err = it.Decode(&item)
+			err := it.Decode(&item)
+			var key string
+			if err == nil {
+				key, err = m.kvKey(item)
+			}
 			if err != nil {
 				select {
 				case qrb.Output <- dsq.Result{Error: err}:
+					continue
 				case <-worker.Closing(): // client told us to close early
 					return
 				}
 			}
 
 			e := dsq.Entry{
-				Key:   item.Key,
-				Value: item.Value,
-				Size:  len(item.Value),
+				Key:  key,
+				Size: item.size(),
+			}
+			if q.ReturnExpirations && item.ExpireAt != nil {
+				e.Expiration = *item.ExpireAt
+			}
+			// Values stored in GridFS are only downloaded if they're
+			// returned or needed to filter the entry.
+			if !q.KeysOnly || len(q.Filters) > 0 {
+				var err error
+				if e.Value, err = m.iterValue(iterCtx, item); err != nil {
+					select {
+					case qrb.Output <- dsq.Result{Error: err}:
+						continue
+					case <-worker.Closing(): // client told us to close early
+						return
+					}
+				}
 			}
-			result := dsq.Result{Entry: e}
 
 			// Finally, filter it (unless we're dealing with an error).
-			if result.Error == nil && filter(q.Filters, e) {
+			if filter(q.Filters, e) {
 				continue
 			}
+			if q.KeysOnly {
+				e.Value = nil
+				if !q.ReturnsSizes {
+					e.Size = -1
+				}
+			}
+			result := dsq.Result{Entry: e}
 
 			select {
 			case qrb.Output <- result:
@@ -465,6 +1527,327 @@ func (m *MongoDS) query(ctx context.Context, q dsextensions.QueryExt) (query.Res
 	return qrb.Results(), nil
 }
 
+// iterValue loads the value of a document read by a query worker.
+func (m *MongoDS) iterValue(iterCtx context.Context, item keyValue) ([]byte, error) {
+	ctx, cls := context.WithTimeout(iterCtx, m.opTimeout)
+	defer cls()
+	return m.loadValue(ctx, item)
+}
+
+// keyOrder returns whether orders sort entries by ascending key, which is
+// the default, or by descending key. Keys are unique, so the orders that
+// follow a key order never apply and the sort is fully done server-side.
+// It returns false if orders sort entries in another way first, as values
+// can't be sorted server-side: BSON compares binaries by length before
+// their bytes, and stored values may be compressed, encrypted or in
+// GridFS. The whole sort is then done client-side.
+func keyOrder(orders []dsq.Order) (asc bool, ok bool) {
+	if len(orders) == 0 {
+		return true, true
+	}
+	switch orders[0].(type) {
+	case dsq.OrderByKey, *dsq.OrderByKey:
+		return true, true
+	case dsq.OrderByKeyDescending, *dsq.OrderByKeyDescending:
+		return false, true
+	}
+	return false, false
+}
+
+// baseQuery returns q without the orders that can't be done server-side,
+// nor the offset and limit that must be applied after ordering.
+func baseQuery(q dsextensions.QueryExt) dsextensions.QueryExt {
+	q.Limit = 0
+	q.Offset = 0
+	q.Orders = nil
+	return q
+}
+
+// findArgs returns the filter and options of the find running q, with
+// entries ordered by key. It also returns the filters of q that couldn't
+// be translated and must be checked client-side.
+func (m *MongoDS) findArgs(ctx context.Context, q dsextensions.QueryExt, qc queryConfig, asc bool) (bson.M, *options.FindOptions, []dsq.Filter) {
+	opts := m.findOptions(ctx)
+	if qc.hint != "" {
+		opts.SetHint(qc.hint)
+	}
+
+	// Key ordering is done server-side so it can be combined with
+	// the skip and limit pushdown.
+	dir := 1
+	if !asc {
+		dir = -1
+	}
+	opts.SetSort(bson.D{{Key: m.keyField(), Value: dir}})
+
+	// When every filter can be translated, they're applied server-side
+	// and don't need to be checked again while iterating.
+	filters, ok := m.serverFilters(q.Query)
+	clientFilters := q.Filters
+	if ok {
+		clientFilters = nil
+	}
+	seekPrefix := datastore.NewKey(q.SeekPrefix).String()
+	if seekPrefix != "/" {
+		op := "$gte"
+		if !asc {
+			op = "$lte"
+		}
+		filters = append(filters, m.keyFilter(bson.M{op: m.namespace + seekPrefix}))
+	}
+	fil := bson.M{}
+	if len(filters) > 0 {
+		fil = bson.M{"$and": filters}
+	}
+
+	// If we have no filters, then we can leverage Skip and Limit,
+	// which the server applies after sorting.
+	// If that isn't the case, we should fetch all of them
+	// and apply skipping and limiting later.
+	if len(clientFilters) == 0 {
+		opts.SetSkip(int64(q.Offset))
+		if q.Limit > 0 {
+			opts.SetLimit(int64(q.Limit))
+		}
+	}
+
+	// Sizes can't be computed without the value, nor can the filters
+	// checked client-side, so only skip fetching it if the caller didn't
+	// ask for them and no filter is left.
+	if q.KeysOnly && !q.ReturnsSizes && len(clientFilters) == 0 {
+		if q.ReturnExpirations {
+			opts.SetProjection(bson.M{"_id": 1, "k": 1, "expireAt": 1})
+		} else {
+			opts.SetProjection(keysProjection)
+		}
+	}
+	return fil, opts, clientFilters
+}
+
+// withTimeout bounds ctx by the timeout d, unless the caller already set a
+// deadline on ctx. That deadline then applies instead, so callers can give
+// more time to operations known to be slow, as well as less.
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// findOptions returns the base options of the finds run by queries. The
+// server-side execution time of the find is bounded by the deadline of
+// ctx, or by the query timeout if ctx has none.
+func (m *MongoDS) findOptions(ctx context.Context) *options.FindOptions {
+	maxTime := m.queryTimeout
+	if dl, ok := ctx.Deadline(); ok {
+		maxTime = time.Until(dl)
+	}
+	if maxTime < time.Millisecond {
+		maxTime = time.Millisecond
+	}
+	opts := options.Find().SetMaxTime(maxTime)
+	if m.cursorBatchSize > 0 {
+		opts.SetBatchSize(m.cursorBatchSize)
+	}
+	return opts
+}
+
+func (m *MongoDS) countDocuments(ctx context.Context, q query.Query) (_ int, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return 0, err
+	}
+	ctx, end := m.startOp(ctx, "count", q.Prefix)
+	defer end(&err)
+	filters, _ := m.serverFilters(q)
+	fil := bson.M{}
+	if len(filters) > 0 {
+		fil = bson.M{"$and": filters}
+	}
+	opts := options.Count()
+	if q.Offset > 0 {
+		opts.SetSkip(int64(q.Offset))
+	}
+	if q.Limit > 0 {
+		opts.SetLimit(int64(q.Limit))
+	}
+	n, err := m.queryReader(ctx).CountDocuments(ctx, fil, opts)
+	if err != nil {
+		return 0, fmt.Errorf("counting documents: %w", err)
+	}
+	return int(n), nil
+}
+
+// countResults drains res and returns the number of entries it had.
+func countResults(res query.Results) (int, error) {
+	defer res.Close()
+	n := 0
+	for r := range res.Next() {
+		if r.Error != nil {
+			return 0, r.Error
+		}
+		n++
+	}
+	return n, nil
+}
+
+// serverFilters translates the prefix and filters of q into MongoDB
+// filters, which the find combines with $and. It returns false if any of
+// the filters can only be applied client-side, in which case only the
+// prefix is translated and all the filters are checked client-side.
+func (m *MongoDS) serverFilters(q query.Query) (bson.A, bool) {
+	filters := bson.A{m.prefixFilter(q.Prefix)}
+	translated := make(bson.A, 0, len(q.Filters))
+	for _, f := range q.Filters {
+		tf, ok := m.translateFilter(f)
+		if !ok {
+			return filters, false
+		}
+		translated = append(translated, tf)
+	}
+	return append(filters, translated...), true
+}
+
+// translateFilter returns the MongoDB filter equivalent to f, if any.
+// Values stored in GridFS, compressed or encrypted don't appear as is in the
+// documents, so value filters are only translated if GridFS, compression
+// and encryption are disabled. Likewise, key filters aren't translated if
+// long keys are hashed.
+func (m *MongoDS) translateFilter(f dsq.Filter) (bson.M, bool) {
+	switch f := f.(type) {
+	case dsq.FilterValueCompare:
+		if !m.rawValues() {
+			return nil, false
+		}
+		return m.translateValueCompare(f)
+	case *dsq.FilterValueCompare:
+		if !m.rawValues() {
+			return nil, false
+		}
+		return m.translateValueCompare(*f)
+	case dsq.FilterKeyCompare:
+		if m.keyHashThreshold > 0 {
+			return nil, false
+		}
+		return m.translateKeyCompare(f)
+	case *dsq.FilterKeyCompare:
+		if m.keyHashThreshold > 0 {
+			return nil, false
+		}
+		return m.translateKeyCompare(*f)
+	case dsq.FilterKeyPrefix:
+		if m.keyHashThreshold > 0 {
+			return nil, false
+		}
+		return m.translateKeyPrefix(f), true
+	case *dsq.FilterKeyPrefix:
+		if m.keyHashThreshold > 0 {
+			return nil, false
+		}
+		return m.translateKeyPrefix(*f), true
+	}
+	return nil, false
+}
+
+// translateKeyPrefix turns a key prefix filter into a range over _id, or
+// over the full key if keys aren't stored as string ids. Unlike the prefix
+// of a query, the filter matches keys byte-wise, so /a matches /ab as well
+// as /a/b.
+func (m *MongoDS) translateKeyPrefix(f dsq.FilterKeyPrefix) bson.M {
+	return bson.M{m.keyField(): m.startsWith(m.namespace + f.Prefix)}
+}
+
+// prefixEnd returns the smallest string greater than all the strings
+// starting with p. It returns false if there's none, when p is empty or
+// made of 0xff bytes only.
+func prefixEnd(p string) (string, bool) {
+	b := []byte(p)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// translateKeyCompare turns key comparisons into ranges over _id, or over
+// the full key if keys aren't stored as string ids. Either way, keys are
+// compared as strings, which MongoDB compares byte-wise like Go does, so
+// the result is the same as the client-side comparison. Prepending the
+// namespace to both sides doesn't change the result either. Under a
+// collation, keys are compared with it instead, consistently with the
+// order of the keys queries return.
+func (m *MongoDS) translateKeyCompare(f dsq.FilterKeyCompare) (bson.M, bool) {
+	ops := map[dsq.Op]string{
+		dsq.Equal:              "$eq",
+		dsq.NotEqual:           "$ne",
+		dsq.GreaterThan:        "$gt",
+		dsq.GreaterThanOrEqual: "$gte",
+		dsq.LessThan:           "$lt",
+		dsq.LessThanOrEqual:    "$lte",
+	}
+	op, ok := ops[f.Op]
+	if !ok {
+		return nil, false
+	}
+	return bson.M{m.keyField(): bson.M{op: m.namespace + f.Key}}, true
+}
+
+// translateValueCompare only handles equality. MongoDB orders binary
+// values by length before comparing their bytes, which doesn't match
+// the lexicographic ordering of bytes.Compare used by the other operators.
+func (m *MongoDS) translateValueCompare(f dsq.FilterValueCompare) (bson.M, bool) {
+	var val interface{} = f.Value
+	if len(f.Value) == 0 {
+		// Empty values may be stored either as null or as empty binary.
+		val = bson.A{nil, []byte{}}
+	}
+	switch f.Op {
+	case dsq.Equal:
+		if len(f.Value) == 0 {
+			return bson.M{m.valueField: bson.M{"$in": val}}, true
+		}
+		return bson.M{m.valueField: val}, true
+	case dsq.NotEqual:
+		if len(f.Value) == 0 {
+			return bson.M{m.valueField: bson.M{"$nin": val}}, true
+		}
+		return bson.M{m.valueField: bson.M{"$ne": val}}, true
+	}
+	return nil, false
+}
+
+// prefixFilter returns a filter matching the keys strictly below prefix.
+// The prefix is normalized the same way keys are stored in _id, and
+// translated into a range over _id so MongoDB can serve it from the _id
+// index, or over the full key if keys aren't stored as string ids. The
+// root prefix matches every datastore key, which always start with '/',
+// leaving out internal documents such as the Check probe. If the prefix
+// field is enabled, other prefixes are matched by equality on it.
+func (m *MongoDS) prefixFilter(prefix string) bson.M {
+	if p := datastore.NewKey(prefix).String(); m.prefixField && p != "/" {
+		return bson.M{"p": m.namespace + p}
+	}
+	return m.keyFilter(m.prefixRange(prefix))
+}
+
+// prefixRange returns the range condition matching the stored keys
+// strictly below prefix, within the namespace.
+func (m *MongoDS) prefixRange(prefix string) bson.M {
+	p := datastore.NewKey(prefix).String()
+	if p == "/" {
+		p = ""
+	}
+	// Strict children of p are exactly the strings in [p+"/", p+"0"),
+	// since '0' is the byte that follows '/'. That doesn't hold under a
+	// collation, which orders characters differently.
+	p = m.namespace + p
+	if !isSimple(m.collation) {
+		return m.startsWith(p + "/")
+	}
+	return bson.M{"$gte": p + "/", "$lt": p + "0"}
+}
+
 // filter returns _true_ if we should filter (skip) the entry
 func filter(filters []dsq.Filter, entry dsq.Entry) bool {
 	for _, f := range filters {
@@ -1,20 +1,40 @@
 package mongods
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base32"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
 	dstest "github.com/ipfs/go-datastore/test"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	dsextensions "github.com/textileio/go-datastore-extensions"
 	"github.com/textileio/go-ds-mongo/test"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestMain(m *testing.M) {
@@ -29,6 +49,208 @@ func TestMongoDatastore(t *testing.T) {
 	dstest.SubtestAll(t, ds)
 }
 
+func TestNewOptions(t *testing.T) {
+	ctx := context.Background()
+	invalid := []Option{
+		WithDatabase(""),
+		WithCollection(""),
+		WithOpTimeout(0),
+		WithTxnTimeout(-time.Second),
+		WithReadConcern(nil),
+		WithWriteConcern(nil),
+	}
+	for _, opt := range invalid {
+		_, err := New(ctx, test.GetMongoUri(), opt)
+		require.Error(t, err)
+	}
+
+	ds := createMongoDS(t, test.GetMongoUri(),
+		WithCollection("custom"),
+		WithReadConcern(readconcern.Majority()),
+		WithWriteConcern(writeconcern.New(writeconcern.WMajority())),
+	)
+	require.Equal(t, "custom", ds.col.Name())
+	require.NoError(t, ds.Put(datastore.NewKey("/opts"), []byte{1}))
+	require.NoError(t, ds.Close())
+}
+
+func TestConcerns(t *testing.T) {
+	key := datastore.NewKey("/test/concern")
+
+	// The test deployment has a single member, so a write concern
+	// asking for more acknowledgements fails every write.
+	wc := writeconcern.New(writeconcern.W(5), writeconcern.WTimeout(100*time.Millisecond))
+	ds := createMongoDS(t, test.GetMongoUri(), WithWriteConcern(wc))
+	require.Error(t, ds.Put(key, []byte{1}))
+	require.Error(t, ds.Delete(key))
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Put(key, []byte{1}))
+	require.Error(t, b.Commit())
+	require.NoError(t, ds.Close())
+
+	// An unknown read concern level is rejected by the server on reads.
+	ds = createMongoDS(t, test.GetMongoUri(), WithReadConcern(readconcern.New(readconcern.Level("unknown"))))
+	_, err = ds.Get(key)
+	require.Error(t, err)
+	require.NotEqual(t, datastore.ErrNotFound, err)
+	_, err = ds.Has(key)
+	require.Error(t, err)
+	res, err := ds.Query(query.Query{})
+	if err == nil {
+		_, err = res.Rest()
+	}
+	require.Error(t, err)
+	require.NoError(t, ds.Close())
+}
+
+func TestReadPreference(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithReadPreference(readpref.SecondaryPreferred()))
+	require.NotSame(t, ds.col, ds.readCol)
+	require.Same(t, ds.readCol, ds.reader(context.Background()))
+
+	key := datastore.NewKey("/test/readpref")
+	require.NoError(t, ds.Put(key, []byte{1}))
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	// Reads within the transaction are forced to the primary.
+	ctx, cls := txn.(*mongoTxn).sessionCtx(context.Background())
+	defer cls()
+	require.Same(t, ds.col, ds.reader(ctx))
+	v, err := txn.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, v)
+	txn.Discard()
+
+	require.NoError(t, ds.Close())
+}
+
+func TestMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	ds := createMongoDS(t, test.GetMongoUri(), WithMetrics(reg))
+
+	key := datastore.NewKey("/test/metrics")
+	require.NoError(t, ds.Put(key, []byte{1}))
+	_, err := ds.Get(key)
+	require.NoError(t, err)
+	_, err = ds.Get(datastore.NewKey("/test/missing"))
+	require.Equal(t, datastore.ErrNotFound, err)
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.Equal(t, float64(1), testutil.ToFloat64(ds.metrics.inflightTxns))
+	require.NoError(t, txn.Commit())
+	require.Equal(t, float64(0), testutil.ToFloat64(ds.metrics.inflightTxns))
+
+	require.Equal(t, float64(1), testutil.ToFloat64(ds.metrics.requests.WithLabelValues("put", "success")))
+	require.Equal(t, float64(1), testutil.ToFloat64(ds.metrics.requests.WithLabelValues("get", "success")))
+	require.Equal(t, float64(1), testutil.ToFloat64(ds.metrics.requests.WithLabelValues("get", "not_found")))
+	require.Equal(t, float64(1), testutil.ToFloat64(ds.metrics.requests.WithLabelValues("commit", "success")))
+
+	require.NoError(t, ds.Close())
+}
+
+func TestTracing(t *testing.T) {
+	tp := &recordingProvider{}
+	ds := createMongoDS(t, test.GetMongoUri(), WithTracerProvider(tp), WithTraceKeyRedaction(true))
+
+	key := datastore.NewKey("/test/tracing")
+	require.NoError(t, ds.Put(key, []byte{1}))
+	_, err := ds.Get(key)
+	require.NoError(t, err)
+	require.NoError(t, ds.Delete(key))
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Commit())
+
+	require.Equal(t, []string{"mongods.Put", "mongods.Get", "mongods.Delete", "mongods.Commit"}, tp.spans)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestTxnTracing(t *testing.T) {
+	tp := &recordingProvider{}
+	ds := createMongoDS(t, test.GetMongoUri(), WithTracerProvider(tp))
+
+	ctx, span := tp.Tracer("").Start(context.Background(), "caller")
+	key := datastore.NewKey("/test/txntracing")
+	err := ds.WithTransaction(ctx, false, func(txn dsextensions.TxnExt) error {
+		return txn.Put(key, []byte{1})
+	})
+	require.NoError(t, err)
+	span.End()
+
+	// The spans of the operations and the commit are children of the span
+	// in the context the transaction was begun with.
+	require.Equal(t, []string{"caller", "mongods.Put", "mongods.Commit"}, tp.spans)
+	require.Equal(t, []string{"", "caller", "caller"}, tp.parents)
+
+	require.NoError(t, ds.Close())
+}
+
+// recordingProvider records the name of the spans started by its tracer,
+// and the name of their parent span, if any.
+type recordingProvider struct {
+	lock    sync.Mutex
+	spans   []string
+	parents []string
+}
+
+func (p *recordingProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return &recordingTracer{p: p, Tracer: trace.NewNoopTracerProvider().Tracer("")}
+}
+
+type recordingTracer struct {
+	trace.Tracer
+	p *recordingProvider
+}
+
+func (rt *recordingTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	var parent string
+	if ps, ok := trace.SpanFromContext(ctx).(*recordedSpan); ok {
+		parent = ps.name
+	}
+	rt.p.lock.Lock()
+	rt.p.spans = append(rt.p.spans, name)
+	rt.p.parents = append(rt.p.parents, parent)
+	rt.p.lock.Unlock()
+	_, span := rt.Tracer.Start(ctx, name, opts...)
+	rs := &recordedSpan{Span: span, name: name}
+	return trace.ContextWithSpan(ctx, rs), rs
+}
+
+type recordedSpan struct {
+	trace.Span
+	name string
+}
+
+func TestLogger(t *testing.T) {
+	l := &recordingLogger{}
+	ds := createMongoDS(t, test.GetMongoUri(), WithLogger(l), WithSlowOpThreshold(time.Nanosecond))
+
+	require.NoError(t, ds.Put(datastore.NewKey("/test/logger"), []byte{1}))
+	require.NotEmpty(t, l.warns)
+	require.Contains(t, l.warns[0], "slow put operation")
+
+	require.NoError(t, ds.Close())
+}
+
+// recordingLogger records the warnings it's given.
+type recordingLogger struct {
+	lock  sync.Mutex
+	warns []string
+}
+
+func (l *recordingLogger) Debugf(string, ...interface{}) {}
+
+func (l *recordingLogger) Errorf(string, ...interface{}) {}
+
+func (l *recordingLogger) Warnf(template string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.warns = append(l.warns, fmt.Sprintf(template, args...))
+}
+
 func TestQuerySeek(t *testing.T) {
 	ds := createMongoDS(t, test.GetMongoUri())
 	type kv struct {
@@ -104,6 +326,390 @@ func TestQuerySeek(t *testing.T) {
 	}
 }
 
+func TestQueryPrefix(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	for _, k := range []string{"/a", "/a/b", "/a/b/c", "/ab/c", "/a0", "/a.b", "/b/a"} {
+		require.NoError(t, ds.Put(datastore.NewKey(k), []byte(k)))
+	}
+
+	for _, prefix := range []string{"/a", "a", "/a/", "a/"} {
+		res, err := ds.Query(query.Query{Prefix: prefix})
+		require.NoError(t, err)
+		all, err := res.Rest()
+		require.NoError(t, err)
+		require.Len(t, all, 2)
+		require.Equal(t, "/a/b", all[0].Key)
+		require.Equal(t, "/a/b/c", all[1].Key)
+	}
+
+	require.NoError(t, ds.Close())
+}
+
+func TestQueryLimitOffset(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/page/%d", i)), []byte{byte(i)}))
+	}
+
+	res, err := ds.Query(query.Query{Prefix: "/page", Offset: 3, Limit: 4})
+	require.NoError(t, err)
+	all, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, all, 4)
+	for i, e := range all {
+		require.Equal(t, fmt.Sprintf("/page/%d", i+3), e.Key)
+	}
+
+	res, err = ds.Query(query.Query{
+		Prefix: "/page",
+		Orders: []query.Order{query.OrderByKeyDescending{}},
+		Offset: 1,
+		Limit:  2,
+	})
+	require.NoError(t, err)
+	all, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	require.Equal(t, "/page/8", all[0].Key)
+	require.Equal(t, "/page/7", all[1].Key)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestQueryOrders(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	keys := []string{"/c/2", "/a", "/b/1", "/c/10", "/a/z", "/b", "/c/1"}
+	for i, k := range keys {
+		require.NoError(t, ds.Put(datastore.NewKey(k), []byte{byte(len(keys) - i)}))
+	}
+
+	cases := [][]query.Order{
+		{query.OrderByKey{}},
+		{query.OrderByKeyDescending{}},
+		{query.OrderByValue{}},
+		{query.OrderByValueDescending{}, query.OrderByKey{}},
+	}
+	for i, orders := range cases {
+		t.Run(fmt.Sprintf("%d", i+1), func(t *testing.T) {
+			res, err := ds.Query(query.Query{Orders: orders, Limit: 5})
+			require.NoError(t, err)
+			all, err := res.Rest()
+			require.NoError(t, err)
+
+			expected := make([]query.Entry, len(keys))
+			for i, k := range keys {
+				expected[i] = query.Entry{Key: k, Value: []byte{byte(len(keys) - i)}}
+			}
+			query.Sort(orders, expected)
+			expected = expected[:5]
+
+			require.Len(t, all, len(expected))
+			for i := range expected {
+				require.Equal(t, expected[i].Key, all[i].Key)
+			}
+		})
+	}
+
+	require.NoError(t, ds.Close())
+}
+
+func TestQueryKeysOnly(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	require.NoError(t, ds.Put(datastore.NewKey("/keys/1"), []byte("value")))
+
+	res, err := ds.Query(query.Query{KeysOnly: true})
+	require.NoError(t, err)
+	all, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	require.Equal(t, "/keys/1", all[0].Key)
+	require.Nil(t, all[0].Value)
+	require.Equal(t, -1, all[0].Size)
+
+	res, err = ds.Query(query.Query{KeysOnly: true, ReturnsSizes: true})
+	require.NoError(t, err)
+	all, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	require.Nil(t, all[0].Value)
+	require.Equal(t, len("value"), all[0].Size)
+
+	// Value filters checked client-side still see the values.
+	require.NoError(t, ds.Put(datastore.NewKey("/keys/2"), []byte("other")))
+	res, err = ds.Query(query.Query{
+		KeysOnly: true,
+		Filters:  []query.Filter{query.FilterValueCompare{Op: query.GreaterThan, Value: []byte("v")}},
+	})
+	require.NoError(t, err)
+	all, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	require.Equal(t, "/keys/1", all[0].Key)
+	require.Nil(t, all[0].Value)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestQueryStreaming(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+
+	// More documents than the default first cursor batch (101), so the
+	// results need several round-trips to be fully read.
+	const total = 350
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	for i := 0; i < total; i++ {
+		require.NoError(t, b.Put(datastore.NewKey(fmt.Sprintf("/stream/%04d", i)), []byte{byte(i)}))
+	}
+	require.NoError(t, b.Commit())
+
+	res, err := ds.Query(query.Query{Prefix: "/stream"})
+	require.NoError(t, err)
+	count := 0
+	for r := range res.Next() {
+		require.NoError(t, r.Error)
+		require.Equal(t, fmt.Sprintf("/stream/%04d", count), r.Key)
+		count++
+	}
+	require.Equal(t, total, count)
+
+	// Closing the results early must release the cursor.
+	res, err = ds.Query(query.Query{Prefix: "/stream"})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		r, ok := res.NextSync()
+		require.True(t, ok)
+		require.NoError(t, r.Error)
+	}
+	require.NoError(t, res.Close())
+
+	require.NoError(t, ds.Close())
+}
+
+func TestCount(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/count/%d", i)), []byte{byte(i)}))
+	}
+	require.NoError(t, ds.Put(datastore.NewKey("/other"), []byte{0}))
+
+	n, err := ds.Count(ctx, query.Query{})
+	require.NoError(t, err)
+	require.Equal(t, 11, n)
+	n, err = ds.Count(ctx, query.Query{Prefix: "/count"})
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	n, err = ds.Count(ctx, query.Query{Prefix: "/count", Offset: 2, Limit: 5})
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	n, err = ds.Count(ctx, query.Query{
+		Prefix:  "/count",
+		Filters: []query.Filter{query.FilterKeyPrefix{Prefix: "/count/1"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(datastore.NewKey("/count/10"), []byte{10}))
+	n, err = txn.(*mongoTxn).Count(ctx, query.Query{Prefix: "/count"})
+	require.NoError(t, err)
+	require.Equal(t, 11, n)
+	n, err = ds.Count(ctx, query.Query{Prefix: "/count"})
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	txn.Discard()
+
+	require.NoError(t, ds.Close())
+}
+
+func TestQueryValueFilters(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	values := [][]byte{{0x01}, {0x02}, {0x01, 0x00}, {0xff}, {0x00, 0xff, 0x01}, {0x02}}
+	for i, v := range values {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/val/%d", i)), v))
+	}
+
+	filters := []query.Filter{
+		query.FilterValueCompare{Op: query.Equal, Value: []byte{0x02}},
+		query.FilterValueCompare{Op: query.NotEqual, Value: []byte{0x02}},
+		query.FilterValueCompare{Op: query.GreaterThan, Value: []byte{0x01}},
+		&query.FilterValueCompare{Op: query.GreaterThan, Value: []byte{0x00, 0xff}},
+	}
+	for i, f := range filters {
+		t.Run(fmt.Sprintf("%d", i+1), func(t *testing.T) {
+			var expected []string
+			for i, v := range values {
+				e := query.Entry{Key: fmt.Sprintf("/val/%d", i), Value: v, Size: len(v)}
+				if f.Filter(e) {
+					expected = append(expected, e.Key)
+				}
+			}
+
+			res, err := ds.Query(query.Query{Filters: []query.Filter{f}})
+			require.NoError(t, err)
+			all, err := res.Rest()
+			require.NoError(t, err)
+			require.Len(t, all, len(expected))
+			for i := range expected {
+				require.Equal(t, expected[i], all[i].Key)
+			}
+		})
+	}
+
+	require.NoError(t, ds.Close())
+}
+
+func TestQueryKeyFilters(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	keys := []string{"/k/a", "/k/b", "/k/b/c", "/k/c", "/k/d"}
+	for _, k := range keys {
+		require.NoError(t, ds.Put(datastore.NewKey(k), []byte(k)))
+	}
+
+	var filters []query.Filter
+	for _, op := range []query.Op{query.Equal, query.NotEqual, query.GreaterThan, query.GreaterThanOrEqual, query.LessThan, query.LessThanOrEqual} {
+		filters = append(filters, query.FilterKeyCompare{Op: op, Key: "/k/b"})
+	}
+	filters = append(filters, &query.FilterKeyCompare{Op: query.GreaterThan, Key: "/k/b/c"})
+	for i, f := range filters {
+		t.Run(fmt.Sprintf("%d", i+1), func(t *testing.T) {
+			var expected []string
+			for _, k := range keys {
+				if f.Filter(query.Entry{Key: k}) {
+					expected = append(expected, k)
+				}
+			}
+
+			res, err := ds.Query(query.Query{Prefix: "/k", Filters: []query.Filter{f}, Limit: 3})
+			require.NoError(t, err)
+			all, err := res.Rest()
+			require.NoError(t, err)
+			if len(expected) > 3 {
+				expected = expected[:3]
+			}
+			require.Len(t, all, len(expected))
+			for i := range expected {
+				require.Equal(t, expected[i], all[i].Key)
+			}
+		})
+	}
+
+	require.NoError(t, ds.Close())
+}
+
+func TestGetMany(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	ctx := context.Background()
+	key1 := datastore.NewKey("/many/1")
+	key2 := datastore.NewKey("/many/2")
+	missing := datastore.NewKey("/many/missing")
+	require.NoError(t, ds.Put(key1, []byte{1}))
+	require.NoError(t, ds.Put(key2, []byte{2}))
+
+	res, err := ds.GetMany(ctx, []datastore.Key{key1, key2, missing})
+	require.NoError(t, err)
+	require.Equal(t, map[datastore.Key][]byte{key1: {1}, key2: {2}}, res)
+
+	res, err = ds.GetMany(ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, res)
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(missing, []byte{3}))
+	res, err = txn.(*mongoTxn).GetMany(ctx, []datastore.Key{key1, missing})
+	require.NoError(t, err)
+	require.Equal(t, map[datastore.Key][]byte{key1: {1}, missing: {3}}, res)
+	txn.Discard()
+
+	require.NoError(t, ds.Close())
+}
+
+func TestHasMany(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	ctx := context.Background()
+	key1 := datastore.NewKey("/many/1")
+	missing := datastore.NewKey("/many/missing")
+	require.NoError(t, ds.Put(key1, []byte{1}))
+
+	res, err := ds.HasMany(ctx, []datastore.Key{key1, missing})
+	require.NoError(t, err)
+	require.Equal(t, map[datastore.Key]bool{key1: true, missing: false}, res)
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(missing, []byte{2}))
+	res, err = txn.(*mongoTxn).HasMany(ctx, []datastore.Key{key1, missing})
+	require.NoError(t, err)
+	require.Equal(t, map[datastore.Key]bool{key1: true, missing: true}, res)
+	txn.Discard()
+
+	require.NoError(t, ds.Close())
+}
+
+func TestDiskUsage(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	for i := 0; i < 100; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/du/%d", i)), make([]byte, 1024)))
+	}
+
+	du, err := ds.DiskUsage()
+	require.NoError(t, err)
+	require.NotZero(t, du)
+
+	require.NoError(t, ds.Close())
+	_, err = ds.DiskUsage()
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestCollectGarbage(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	expired := datastore.NewKey("/gc/expired")
+	alive := datastore.NewKey("/gc/alive")
+	noTTL := datastore.NewKey("/gc/nottl")
+	require.NoError(t, ds.PutWithTTL(expired, []byte{1}, -time.Minute))
+	require.NoError(t, ds.PutWithTTL(alive, []byte{2}, time.Hour))
+	require.NoError(t, ds.Put(noTTL, []byte{3}))
+
+	require.NoError(t, ds.CollectGarbage())
+	require.NoError(t, ds.CollectGarbage())
+
+	res, err := ds.HasMany(context.Background(), []datastore.Key{expired, alive, noTTL})
+	require.NoError(t, err)
+	require.Equal(t, map[datastore.Key]bool{expired: false, alive: true, noTTL: true}, res)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestCheck(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	require.NoError(t, ds.Check())
+
+	require.NoError(t, ds.col.Drop(context.Background()))
+	err := ds.Check()
+	require.True(t, errors.Is(err, ErrCollectionMissing))
+
+	require.NoError(t, ds.Close())
+	require.Equal(t, ErrClosed, ds.Check())
+}
+
+func TestSync(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	require.NoError(t, ds.Put(datastore.NewKey("/sync/1"), []byte{1}))
+	require.NoError(t, ds.Sync(datastore.NewKey("/sync")))
+	require.NoError(t, ds.Sync(datastore.Key{}))
+
+	// The barrier document isn't visible as a datastore key.
+	n, err := ds.Count(context.Background(), query.Query{})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	require.NoError(t, ds.Close())
+	require.Equal(t, ErrClosed, ds.Sync(datastore.NewKey("/sync")))
+}
+
 func TestTxnDiscard(t *testing.T) {
 	ds := createMongoDS(t, test.GetMongoUri())
 
@@ -157,32 +763,185 @@ func TestTxnCommit(t *testing.T) {
 	}
 }
 
-func TestTxnBatch(t *testing.T) {
+func TestTxnReadOnly(t *testing.T) {
 	ds := createMongoDS(t, test.GetMongoUri())
+	key := datastore.NewKey("/test/readonly")
+	require.NoError(t, ds.Put(key, []byte{1}))
 
-	txn, err := ds.NewTransaction(false)
-	if err != nil {
-		t.Fatal(err)
-	}
-	data := make(map[datastore.Key][]byte)
-	for i := 0; i < 10; i++ {
-		key := datastore.NewKey(fmt.Sprintf("/test/batch%d", i))
-		bytes := make([]byte, 16)
-		_, err := rand.Read(bytes)
-		if err != nil {
-			t.Fatal(err)
-		}
-		data[key] = bytes
+	txn, err := ds.NewTransaction(true)
+	require.NoError(t, err)
+	v, err := txn.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, v)
 
-		err = txn.Put(key, bytes)
-		if err != nil {
-			t.Fatal(err)
-		}
-	}
-	err = txn.Commit()
-	if err != nil {
-		t.Fatal(err)
-	}
+	// Writes after the snapshot was taken aren't seen by the transaction.
+	require.NoError(t, ds.Put(key, []byte{2}))
+	v, err = txn.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, v)
+
+	require.Equal(t, ErrTxnReadOnly, txn.Put(key, []byte{3}))
+	require.Equal(t, ErrTxnReadOnly, txn.Delete(key))
+	require.NoError(t, txn.Commit())
+
+	v, err = ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte{2}, v)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestTxnReadYourWrites(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	key := datastore.NewKey("/test/ryw")
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(key, []byte{1}))
+	v, err := txn.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, v)
+	_, err = ds.Get(key)
+	require.Equal(t, datastore.ErrNotFound, err)
+
+	res, err := txn.Query(query.Query{Prefix: "/test"})
+	require.NoError(t, err)
+	all, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	txn.Discard()
+
+	require.NoError(t, ds.Close())
+}
+
+func TestTxnFallback(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	require.True(t, ds.txnSupported)
+
+	// Pretend the deployment is a standalone server.
+	ds.txnSupported = false
+	_, err := ds.NewTransaction(false)
+	require.Equal(t, ErrTxnUnsupported, err)
+
+	l := &recordingLogger{}
+	ds.logger = l
+	ds.txnFallback = true
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	key := datastore.NewKey("/test/fallback")
+	require.NoError(t, txn.Put(key, []byte{1}))
+	// Writes are queued until the commit, but visible to the transaction.
+	has, err := ds.Has(key)
+	require.NoError(t, err)
+	require.False(t, has)
+	v, err := txn.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, v)
+	require.NoError(t, txn.Commit())
+	has, err = ds.Has(key)
+	require.NoError(t, err)
+	require.True(t, has)
+	require.Equal(t, ErrTxnFinalized, txn.Commit())
+
+	// Discard drops the queued writes.
+	txn, err = ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Delete(key))
+	has, err = txn.Has(key)
+	require.NoError(t, err)
+	require.False(t, has)
+	txn.Discard()
+	has, err = ds.Has(key)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// The degraded atomicity is only reported once.
+	require.Len(t, l.warns, 1)
+	require.Contains(t, l.warns[0], "non-atomic transactions")
+
+	// TTLs and many-key reads see the queued writes.
+	txn, err = ds.NewTransaction(false)
+	require.NoError(t, err)
+	ttlTxn := txn.(datastore.TTL)
+	other := datastore.NewKey("/test/fallback/other")
+	require.NoError(t, ttlTxn.PutWithTTL(other, []byte{1, 2}, time.Hour))
+	exp, err := ttlTxn.GetExpiration(other)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), exp, time.Minute)
+	require.NoError(t, txn.Delete(key))
+	require.Equal(t, datastore.ErrNotFound, ttlTxn.SetTTL(key, time.Hour))
+	many := txn.(dsextensions.TxnExt).(interface {
+		HasMany(context.Context, []datastore.Key) (map[datastore.Key]bool, error)
+		GetSizeMany(context.Context, []datastore.Key) (map[datastore.Key]int, error)
+	})
+	hs, err := many.HasMany(context.Background(), []datastore.Key{key, other})
+	require.NoError(t, err)
+	require.Equal(t, map[datastore.Key]bool{key: false, other: true}, hs)
+	sizes, err := many.GetSizeMany(context.Background(), []datastore.Key{key, other})
+	require.NoError(t, err)
+	require.Equal(t, map[datastore.Key]int{other: 2}, sizes)
+	require.NoError(t, txn.Commit())
+	exp, err = ds.GetExpiration(other)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), exp, time.Minute)
+
+	txn, err = ds.NewTransaction(true)
+	require.NoError(t, err)
+	require.Equal(t, ErrTxnReadOnly, txn.Delete(key))
+	txn.Discard()
+
+	require.NoError(t, ds.Close())
+}
+
+func TestTxnFallbackCaseInsensitive(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithCollation(&options.Collation{Locale: "en", Strength: 2}))
+	defer func() { require.NoError(t, ds.Close()) }()
+	ds.txnSupported = false
+	ds.txnFallback = true
+
+	// Keys differing by case are the same key, pending writes included.
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(datastore.NewKey("/Test/Key"), []byte("v")))
+	v, err := txn.Get(datastore.NewKey("/test/key"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), v)
+	require.NoError(t, txn.Delete(datastore.NewKey("/TEST/KEY")))
+	has, err := txn.Has(datastore.NewKey("/Test/Key"))
+	require.NoError(t, err)
+	require.False(t, has)
+	require.NoError(t, txn.Commit())
+	has, err = ds.Has(datastore.NewKey("/test/key"))
+	require.NoError(t, err)
+	require.False(t, has)
+}
+
+func TestTxnBatch(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+
+	txn, err := ds.NewTransaction(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make(map[datastore.Key][]byte)
+	for i := 0; i < 10; i++ {
+		key := datastore.NewKey(fmt.Sprintf("/test/batch%d", i))
+		bytes := make([]byte, 16)
+		_, err := rand.Read(bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data[key] = bytes
+
+		err = txn.Put(key, bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	for key, bytes := range data {
 		retrieved, err := ds.Get(key)
@@ -204,8 +963,3201 @@ func TestTxnBatch(t *testing.T) {
 	}
 }
 
-func createMongoDS(t *testing.T, uri string) *MongoDS {
-	ds, err := New(context.Background(), uri, randStoreName())
+func TestBatchOrder(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+
+	keyPut := datastore.NewKey("/test/batchput")
+	keyDel := datastore.NewKey("/test/batchdel")
+	require.NoError(t, ds.Put(keyDel, []byte("old")))
+
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Delete(keyPut))
+	require.NoError(t, b.Put(keyPut, []byte("new")))
+	require.NoError(t, b.Put(keyDel, []byte("new")))
+	require.NoError(t, b.Delete(keyDel))
+	require.NoError(t, b.Commit())
+
+	v, err := ds.Get(keyPut)
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), v)
+	has, err := ds.Has(keyDel)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	err = b.Commit()
+	require.Equal(t, ErrBatchAlreadyCommited, err)
+
+	// An empty batch commit is a no-op.
+	b, err = ds.Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Commit())
+
+	require.NoError(t, ds.Close())
+}
+
+func TestBatchAutoFlush(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithBatchFlushThreshold(2))
+
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	key1 := datastore.NewKey("/test/flush1")
+	key2 := datastore.NewKey("/test/flush2")
+	key3 := datastore.NewKey("/test/flush3")
+	require.NoError(t, b.Put(key1, []byte{1}))
+	require.NoError(t, b.Put(key2, []byte{2}))
+	require.NoError(t, b.Put(key3, []byte{3}))
+
+	// The first two operations reached the threshold and were flushed.
+	has, err := ds.Has(key2)
+	require.NoError(t, err)
+	require.True(t, has)
+	has, err = ds.Has(key3)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.NoError(t, b.Commit())
+	has, err = ds.Has(key3)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestBatchUnordered(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithUnorderedBatch(true))
+
+	// A unique index on the value lets us force a duplicate-key
+	// failure on a single operation of the batch.
+	_, err := ds.col.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"v": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	require.NoError(t, err)
+	require.NoError(t, ds.Put(datastore.NewKey("/test/existing"), []byte("dup")))
+
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Put(datastore.NewKey("/test/a"), []byte("a")))
+	require.NoError(t, b.Put(datastore.NewKey("/test/b"), []byte("dup")))
+	require.NoError(t, b.Put(datastore.NewKey("/test/c"), []byte("c")))
+	err = b.Commit()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1 operations failed")
+
+	for _, k := range []string{"/test/a", "/test/c"} {
+		has, err := ds.Has(datastore.NewKey(k))
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+	has, err := ds.Has(datastore.NewKey("/test/b"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestBatchChunkFailure(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithUnorderedBatch(true), WithBatchConcurrency(2))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		require.NoError(t, b.Put(datastore.NewKey(fmt.Sprintf("/test/%d", i)), []byte{byte(i)}))
+	}
+
+	// Calls failing as a whole, as they do once the context is done,
+	// never reached the server, so their operations stay queued.
+	mb := b.(*mongoBatch)
+	ctx, cls := context.WithCancel(context.Background())
+	cls()
+	mb.ctx = ctx
+	err = b.Commit()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "writing operations 0 to 1")
+	require.Contains(t, err.Error(), "writing operations 2 to 3")
+	require.Len(t, mb.ops, 4)
+	require.Len(t, mb.keys, 4)
+	mb.ctx = nil
+	require.NoError(t, b.Commit())
+	for i := 0; i < 4; i++ {
+		has, err := ds.Has(datastore.NewKey(fmt.Sprintf("/test/%d", i)))
+		require.NoError(t, err)
+		require.True(t, has)
+	}
+
+	// Failures of whole calls are reported along with the failures of
+	// single operations.
+	bwe := mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Index: 1, Message: "dup"}}}}
+	err = joinWriteErrors(bwe, chunkError{start: 2, end: 4, err: context.DeadlineExceeded}.error())
+	require.Equal(t, "1 operations failed: operation 1: dup; writing operations 2 to 3: context deadline exceeded", err.Error())
+	require.True(t, errors.As(err, &bwe))
+}
+
+func TestBatchOrderedFailure(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	_, err := ds.col.Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys:    bson.M{"v": 1},
+		Options: options.Index().SetUnique(true),
+	})
+	require.NoError(t, err)
+	existing := datastore.NewKey("/test/existing")
+	require.NoError(t, ds.Put(existing, []byte("dup")))
+
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Put(datastore.NewKey("/test/a"), []byte("a")))
+	require.NoError(t, b.Put(datastore.NewKey("/test/b"), []byte("dup")))
+	require.NoError(t, b.Put(datastore.NewKey("/test/c"), []byte("c")))
+	require.Error(t, b.Commit())
+
+	// The write stopped at /test/b, and only the operations that weren't
+	// applied stay queued, so committing again doesn't write /test/a
+	// back once it's deleted.
+	has, err := ds.Has(datastore.NewKey("/test/c"))
+	require.NoError(t, err)
+	require.False(t, has)
+	require.NoError(t, ds.Delete(datastore.NewKey("/test/a")))
+	require.NoError(t, ds.Delete(existing))
+	require.NoError(t, b.Commit())
+	for k, expected := range map[string]bool{"/test/a": false, "/test/b": true, "/test/c": true} {
+		has, err := ds.Has(datastore.NewKey(k))
+		require.NoError(t, err)
+		require.Equal(t, expected, has, k)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+
+	key := datastore.NewKey("/test/ttl")
+	_, err := ds.GetExpiration(key)
+	require.Equal(t, datastore.ErrNotFound, err)
+	require.Equal(t, datastore.ErrNotFound, ds.SetTTL(key, time.Hour))
+
+	before := time.Now()
+	require.NoError(t, ds.PutWithTTL(key, []byte{1}, time.Hour))
+	exp, err := ds.GetExpiration(key)
+	require.NoError(t, err)
+	require.WithinDuration(t, before.Add(time.Hour), exp, time.Second)
+
+	require.NoError(t, ds.SetTTL(key, 2*time.Hour))
+	exp, err = ds.GetExpiration(key)
+	require.NoError(t, err)
+	require.WithinDuration(t, before.Add(2*time.Hour), exp, time.Second)
+	v, err := ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, v)
+
+	// A plain Put clears the expiration.
+	require.NoError(t, ds.Put(key, []byte{2}))
+	exp, err = ds.GetExpiration(key)
+	require.NoError(t, err)
+	require.True(t, exp.IsZero())
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	txnKey := datastore.NewKey("/test/ttltxn")
+	require.NoError(t, txn.(datastore.TTL).PutWithTTL(txnKey, []byte{3}, time.Hour))
+	require.NoError(t, txn.Commit())
+	exp, err = ds.GetExpiration(txnKey)
+	require.NoError(t, err)
+	require.WithinDuration(t, before.Add(time.Hour), exp, time.Second)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestTTLIndex(t *testing.T) {
+	ctx := context.Background()
+	name := randStoreName()
+	ds, err := New(ctx, test.GetMongoUri(), WithDatabase(name), WithTTLIndex(true))
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+
+	// Creating the datastore again over the same collection must not fail.
+	ds, err = New(ctx, test.GetMongoUri(), WithDatabase(name), WithTTLIndex(true))
+	require.NoError(t, err)
+
+	cur, err := ds.col.Indexes().List(ctx)
+	require.NoError(t, err)
+	var indexes []bson.M
+	require.NoError(t, cur.All(ctx, &indexes))
+	found := false
+	for _, idx := range indexes {
+		if idx["name"] == "expireAt_ttl" {
+			found = true
+			require.EqualValues(t, 0, idx["expireAfterSeconds"])
+		}
+	}
+	require.True(t, found)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestGridFS(t *testing.T) {
+	t.Run("Suite", func(t *testing.T) {
+		ds := createMongoDS(t, test.GetMongoUri(), WithGridFSThreshold(64))
+		dstest.SubtestAll(t, ds)
+	})
+
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithGridFSThreshold(1024), WithGridFSBucket("blobs"))
+	files := ds.db.Collection("blobs.files")
+	countFiles := func() int64 {
+		n, err := files.CountDocuments(ctx, bson.M{})
+		require.NoError(t, err)
+		return n
+	}
+
+	key := datastore.NewKey("/test/large")
+	large := make([]byte, 64<<10)
+	_, _ = rand.Read(large)
+	require.NoError(t, ds.Put(key, large))
+	require.EqualValues(t, 1, countFiles())
+
+	v, err := ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, large, v)
+	size, err := ds.GetSize(key)
+	require.NoError(t, err)
+	require.Equal(t, len(large), size)
+
+	res, err := ds.Query(query.Query{Prefix: "/test"})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, large, entries[0].Value)
+	require.Equal(t, len(large), entries[0].Size)
+
+	// Overwriting with a small value stores it inline and removes the file.
+	require.NoError(t, ds.Put(key, []byte("small")))
+	require.EqualValues(t, 0, countFiles())
+	v, err = ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("small"), v)
+
+	require.NoError(t, ds.Put(key, large))
+	require.EqualValues(t, 1, countFiles())
+	require.NoError(t, ds.Delete(key))
+	require.EqualValues(t, 0, countFiles())
+	_, err = ds.Get(key)
+	require.Equal(t, datastore.ErrNotFound, err)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestCompression(t *testing.T) {
+	t.Run("Suite", func(t *testing.T) {
+		ds := createMongoDS(t, test.GetMongoUri(), WithCompression(GzipCodec(gzip.BestSpeed)))
+		dstest.SubtestAll(t, ds)
+	})
+
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithCompression(GzipCodec(gzip.DefaultCompression)))
+
+	key := datastore.NewKey("/test/compressed")
+	val := []byte(strings.Repeat(`{"name":"value","count":1}`, 100))
+	require.NoError(t, ds.Put(key, val))
+
+	var raw keyValue
+	require.NoError(t, ds.col.FindOne(ctx, bson.M{"_id": key.String()}).Decode(&raw))
+	require.Equal(t, "gzip", raw.Codec)
+	require.Less(t, len(raw.Value), len(val))
+
+	v, err := ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, val, v)
+	size, err := ds.GetSize(key)
+	require.NoError(t, err)
+	require.Equal(t, len(val), size)
+
+	// Documents written without compression are still readable.
+	plainKey := datastore.NewKey("/test/plain")
+	_, err = ds.col.InsertOne(ctx, bson.M{"_id": plainKey.String(), "v": []byte("plain")})
+	require.NoError(t, err)
+	v, err = ds.Get(plainKey)
+	require.NoError(t, err)
+	require.Equal(t, []byte("plain"), v)
+
+	// Values that don't shrink are stored as is.
+	small := []byte{1}
+	require.NoError(t, ds.Put(key, small))
+	require.NoError(t, ds.col.FindOne(ctx, bson.M{"_id": key.String()}).Decode(&raw))
+	require.Empty(t, raw.Codec)
+	require.Equal(t, small, raw.Value)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestEncryption(t *testing.T) {
+	newAEAD := func() cipher.AEAD {
+		key := make([]byte, 32)
+		_, _ = rand.Read(key)
+		block, err := aes.NewCipher(key)
+		require.NoError(t, err)
+		aead, err := cipher.NewGCM(block)
+		require.NoError(t, err)
+		return aead
+	}
+	aead := newAEAD()
+
+	t.Run("Suite", func(t *testing.T) {
+		ds := createMongoDS(t, test.GetMongoUri(), WithEncryption(aead), WithCompression(GzipCodec(gzip.BestSpeed)))
+		dstest.SubtestAll(t, ds)
+	})
+
+	ctx := context.Background()
+	name := randStoreName()
+	ds, err := New(ctx, test.GetMongoUri(), WithDatabase(name), WithEncryption(aead))
+	require.NoError(t, err)
+
+	key := datastore.NewKey("/test/secret")
+	val := []byte("sensitive value")
+	require.NoError(t, ds.Put(key, val))
+
+	var raw keyValue
+	require.NoError(t, ds.col.FindOne(ctx, bson.M{"_id": key.String()}).Decode(&raw))
+	require.Equal(t, encryptionV1, raw.Encryption)
+	require.Len(t, raw.Nonce, aead.NonceSize())
+	require.NotContains(t, string(raw.Value), string(val))
+
+	v, err := ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, val, v)
+	size, err := ds.GetSize(key)
+	require.NoError(t, err)
+	require.Equal(t, len(val), size)
+
+	// A ciphertext copied under another key doesn't decrypt.
+	copied := datastore.NewKey("/test/copied")
+	raw.ID = copied.String()
+	_, err = ds.col.InsertOne(ctx, raw)
+	require.NoError(t, err)
+	_, err = ds.Get(copied)
+	require.True(t, errors.Is(err, ErrDecryption))
+
+	// Reading with another key or without encryption fails to decrypt.
+	for _, opts := range [][]Option{{WithEncryption(newAEAD())}, nil} {
+		other, err := New(ctx, test.GetMongoUri(), append([]Option{WithDatabase(name)}, opts...)...)
+		require.NoError(t, err)
+		_, err = other.Get(key)
+		require.True(t, errors.Is(err, ErrDecryption))
+		require.NoError(t, other.Close())
+	}
+
+	require.NoError(t, ds.Close())
+}
+
+func TestKeyHashing(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithKeyHashing(256))
+
+	long := datastore.NewKey("/test/" + strings.Repeat("k", 2000))
+	short := datastore.NewKey("/test/short")
+	require.NoError(t, ds.Put(long, []byte("long")))
+	require.NoError(t, ds.Put(short, []byte("short")))
+
+	var raw keyValue
+	require.NoError(t, ds.col.FindOne(ctx, bson.M{"k": long.String()}).Decode(&raw))
+	require.True(t, strings.HasPrefix(raw.ID.(string), hashedIDPrefix))
+	require.NoError(t, ds.col.FindOne(ctx, bson.M{"_id": short.String()}).Decode(&raw))
+	require.Empty(t, raw.FullKey)
+
+	v, err := ds.Get(long)
+	require.NoError(t, err)
+	require.Equal(t, []byte("long"), v)
+	has, err := ds.Has(long)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	res, err := ds.Query(query.Query{Prefix: "/test", KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	keys := make([]string, len(entries))
+	for i, e := range entries {
+		keys[i] = e.Key
+	}
+	require.ElementsMatch(t, []string{long.String(), short.String()}, keys)
+
+	n, err := ds.Count(ctx, query.Query{Prefix: "/test"})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	require.NoError(t, ds.Delete(long))
+	_, err = ds.Get(long)
+	require.Equal(t, datastore.ErrNotFound, err)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestDeletePrefix(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+
+	for _, k := range []string{"/a", "/a/1", "/a/2", "/a/2/1", "/ab", "/b/1"} {
+		require.NoError(t, ds.Put(datastore.NewKey(k), []byte(k)))
+	}
+	n, err := ds.DeletePrefix(ctx, datastore.NewKey("/a"))
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	for k, exists := range map[string]bool{"/a": true, "/a/1": false, "/a/2/1": false, "/ab": true, "/b/1": true} {
+		has, err := ds.Has(datastore.NewKey(k))
+		require.NoError(t, err)
+		require.Equal(t, exists, has, k)
+	}
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	n, err = txn.(*mongoTxn).DeletePrefix(ctx, datastore.NewKey("/b"))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	has, err := ds.Has(datastore.NewKey("/b/1"))
+	require.NoError(t, err)
+	require.True(t, has)
+	require.NoError(t, txn.Commit())
+	has, err = ds.Has(datastore.NewKey("/b/1"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	configs := map[string][]Option{
+		"Raw":     nil,
+		"Encoded": {WithCompression(GzipCodec(gzip.BestSpeed)), WithGridFSThreshold(8)},
+	}
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := createMongoDS(t, test.GetMongoUri(), opts...)
+			key := datastore.NewKey("/test/cas")
+
+			ok, err := ds.CompareAndSwap(ctx, key, nil, []byte("0"))
+			require.NoError(t, err)
+			require.True(t, ok)
+			ok, err = ds.CompareAndSwap(ctx, key, nil, []byte("1"))
+			require.NoError(t, err)
+			require.False(t, ok)
+			ok, err = ds.CompareAndSwap(ctx, key, []byte("1"), []byte("2"))
+			require.NoError(t, err)
+			require.False(t, ok)
+			ok, err = ds.CompareAndSwap(ctx, datastore.NewKey("/test/missing"), []byte("1"), []byte("2"))
+			require.NoError(t, err)
+			require.False(t, ok)
+
+			// Concurrent increments only succeed once per value.
+			const workers, incs = 8, 10
+			var wg sync.WaitGroup
+			for i := 0; i < workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for n := 0; n < incs; {
+						cur, err := ds.Get(key)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						var v int
+						_, _ = fmt.Sscan(string(cur), &v)
+						next := []byte(fmt.Sprint(v + 1))
+						ok, err := ds.CompareAndSwap(ctx, key, cur, next)
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if ok {
+							n++
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			v, err := ds.Get(key)
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprint(workers*incs), string(v))
+
+			require.NoError(t, ds.Close())
+		})
+	}
+}
+
+func TestGetAndDelete(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	key := datastore.NewKey("/test/pop")
+
+	_, err := ds.GetAndDelete(ctx, key)
+	require.Equal(t, datastore.ErrNotFound, err)
+
+	for i := 0; i < 10; i++ {
+		val := []byte(fmt.Sprint(i))
+		require.NoError(t, ds.Put(key, val))
+
+		// Exactly one of the racing callers pops the value.
+		var (
+			wg     sync.WaitGroup
+			lock   sync.Mutex
+			popped [][]byte
+		)
+		for j := 0; j < 2; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v, err := ds.GetAndDelete(ctx, key)
+				if err == datastore.ErrNotFound {
+					return
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				lock.Lock()
+				popped = append(popped, v)
+				lock.Unlock()
+			}()
+		}
+		wg.Wait()
+		require.Equal(t, [][]byte{val}, popped)
+	}
+
+	require.NoError(t, ds.Put(key, []byte("txn")))
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	v, err := txn.(*mongoTxn).GetAndDelete(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("txn"), v)
+	txn.Discard()
+	has, err := ds.Has(key)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestGetAndPut(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	key := datastore.NewKey("/test/swap")
+
+	old, existed, err := ds.GetAndPut(ctx, key, []byte("1"))
+	require.NoError(t, err)
+	require.False(t, existed)
+	require.Nil(t, old)
+
+	old, existed, err = ds.GetAndPut(ctx, key, []byte("2"))
+	require.NoError(t, err)
+	require.True(t, existed)
+	require.Equal(t, []byte("1"), old)
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	old, existed, err = txn.(*mongoTxn).GetAndPut(ctx, key, []byte("3"))
+	require.NoError(t, err)
+	require.True(t, existed)
+	require.Equal(t, []byte("2"), old)
+	v, err := ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), v)
+	require.NoError(t, txn.Commit())
+	v, err = ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("3"), v)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestWatch(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := ds.Watch(ctx, datastore.NewKey("/test"))
+	require.NoError(t, err)
+
+	key := datastore.NewKey("/test/a")
+	require.NoError(t, ds.Put(datastore.NewKey("/other"), []byte("ignored")))
+	require.NoError(t, ds.Put(key, []byte("1")))
+	require.NoError(t, ds.Put(key, []byte("2")))
+	require.NoError(t, ds.Delete(key))
+
+	next := func() Event {
+		select {
+		case e, ok := <-events:
+			require.True(t, ok)
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+		return Event{}
+	}
+	e := next()
+	require.Equal(t, EventInsert, e.Type)
+	require.Equal(t, key, e.Key)
+	e = next()
+	require.Equal(t, EventUpdate, e.Type)
+	require.Equal(t, key, e.Key)
+	e = next()
+	require.Equal(t, EventDelete, e.Type)
+	require.Equal(t, key, e.Key)
+	require.Nil(t, e.Value)
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		require.False(t, ok)
+	case <-time.After(10 * time.Second):
+		t.Fatal("channel wasn't closed")
+	}
+
+	ds.txnSupported = false
+	_, err = ds.Watch(context.Background(), datastore.NewKey("/test"))
+	require.Equal(t, ErrWatchUnsupported, err)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestWatchClose(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	events, err := ds.Watch(context.Background(), datastore.NewKey("/test"))
+	require.NoError(t, err)
+
+	// Close stops the stream although its context is never canceled.
+	require.NoError(t, ds.Close())
+	select {
+	case _, ok := <-events:
+		require.False(t, ok)
+	case <-time.After(10 * time.Second):
+		t.Fatal("channel wasn't closed")
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	next := func(events <-chan Event) Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(10 * time.Second):
+			t.Fatal("timeout waiting for event")
+		}
+		return Event{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := ds.Watch(ctx, datastore.NewKey("/test"))
+	require.NoError(t, err)
+	require.NoError(t, ds.Put(datastore.NewKey("/test/a"), []byte("a")))
+	e := next(events)
+	require.Equal(t, datastore.NewKey("/test/a"), e.Key)
+	require.NotEmpty(t, e.ResumeToken)
+	cancel()
+
+	// Changes made while not watching are reported after resuming.
+	require.NoError(t, ds.Put(datastore.NewKey("/test/b"), []byte("b")))
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	events, err = ds.Watch(ctx, datastore.NewKey("/test"), WithResumeToken(e.ResumeToken))
+	require.NoError(t, err)
+	e = next(events)
+	require.Equal(t, EventInsert, e.Type)
+	require.Equal(t, datastore.NewKey("/test/b"), e.Key)
+	require.Equal(t, []byte("b"), e.Value)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestAccessors(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithCollection("custom"))
+	require.Equal(t, "custom", ds.Collection().Name())
+	require.Same(t, ds.Database(), ds.Collection().Database())
+	require.Same(t, ds.Client(), ds.Database().Client())
+
+	require.NoError(t, ds.Put(datastore.NewKey("/test/a"), []byte("a")))
+	n, err := ds.Collection().CountDocuments(ctx, bson.M{"_id": "/test/a"})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, n)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestNamespace(t *testing.T) {
+	t.Run("Suite", func(t *testing.T) {
+		ds := createMongoDS(t, test.GetMongoUri(), WithNamespace("tenant"))
+		dstest.SubtestAll(t, ds)
+	})
+
+	ctx := context.Background()
+	name := randStoreName()
+	a, err := New(ctx, test.GetMongoUri(), WithDatabase(name), WithNamespace("a"))
+	require.NoError(t, err)
+	b, err := New(ctx, test.GetMongoUri(), WithDatabase(name), WithNamespace("/b"))
+	require.NoError(t, err)
+
+	key := datastore.NewKey("/test/key")
+	require.NoError(t, a.Put(key, []byte("a")))
+	require.NoError(t, a.Put(datastore.NewKey("/test/only-a"), []byte("a")))
+	require.NoError(t, b.Put(key, []byte("b")))
+
+	v, err := a.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), v)
+	v, err = b.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), v)
+	has, err := b.Has(datastore.NewKey("/test/only-a"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	res, err := b.Query(query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, key.String(), entries[0].Key)
+
+	n, err := b.DeletePrefix(ctx, datastore.NewKey("/test"))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	n, err = a.Count(ctx, query.Query{Prefix: "/test"})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	raw, err := a.Collection().CountDocuments(ctx, bson.M{"_id": "!/a!/test/key"})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, raw)
+
+	_, err = New(ctx, test.GetMongoUri(), WithNamespace("a!b"))
+	require.Error(t, err)
+
+	require.NoError(t, a.Close())
+	require.NoError(t, b.Close())
+}
+
+func TestNamespaceOverlap(t *testing.T) {
+	ctx := context.Background()
+	name := randStoreName()
+	outer, err := New(ctx, test.GetMongoUri(), WithDatabase(name), WithNamespace("/a"))
+	require.NoError(t, err)
+	inner, err := New(ctx, test.GetMongoUri(), WithDatabase(name), WithNamespace("/a/b"))
+	require.NoError(t, err)
+	none, err := New(ctx, test.GetMongoUri(), WithDatabase(name))
+	require.NoError(t, err)
+
+	// /b/x within /a and /x within /a/b would both be /a/b/x if the
+	// namespace was only prepended.
+	require.NoError(t, outer.Put(datastore.NewKey("/b/x"), []byte("outer")))
+	require.NoError(t, inner.Put(datastore.NewKey("/x"), []byte("inner")))
+	v, err := outer.Get(datastore.NewKey("/b/x"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("outer"), v)
+	v, err = inner.Get(datastore.NewKey("/x"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("inner"), v)
+
+	res, err := outer.Query(query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "/b/x", entries[0].Key)
+
+	// A datastore without a namespace doesn't see namespaced keys.
+	has, err := none.Has(datastore.NewKey("/a/b/x"))
+	require.NoError(t, err)
+	require.False(t, has)
+	res, err = none.Query(query.Query{})
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	require.NoError(t, outer.Close())
+	require.NoError(t, inner.Close())
+	require.NoError(t, none.Close())
+}
+
+func TestCausalSession(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithReadPreference(readpref.SecondaryPreferred()))
+	s, err := ds.NewCausalSession(ctx)
+	require.NoError(t, err)
+
+	key := datastore.NewKey("/test/causal")
+	for i := 0; i < 10; i++ {
+		val := []byte(fmt.Sprint(i))
+		require.NoError(t, s.Put(ctx, key, val))
+		v, err := s.Get(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, val, v)
+	}
+	require.NoError(t, s.Delete(ctx, key))
+	has, err := s.Has(ctx, key)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	require.NoError(t, s.Close())
+	require.NoError(t, s.Close())
+	_, err = s.Get(ctx, key)
+	require.Equal(t, ErrClosed, err)
+
+	require.NoError(t, ds.Close())
+}
+
+func TestGetSize(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithCompression(GzipCodec(gzip.DefaultCompression)))
+
+	size, err := ds.GetSize(datastore.NewKey("/test/missing"))
+	require.Equal(t, datastore.ErrNotFound, err)
+	require.Equal(t, -1, size)
+
+	values := map[string][]byte{
+		"/test/nil":        nil,
+		"/test/small":      []byte("abc"),
+		"/test/compressed": []byte(strings.Repeat("a", 4096)),
+	}
+	for k, v := range values {
+		require.NoError(t, ds.Put(datastore.NewKey(k), v))
+		size, err := ds.GetSize(datastore.NewKey(k))
+		require.NoError(t, err)
+		require.Equal(t, len(v), size, k)
+	}
+
+	require.NoError(t, ds.Close())
+}
+
+func TestGetSizeMany(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithKeyHashing(64))
+
+	long := datastore.NewKey("/test/" + strings.Repeat("l", 100))
+	require.NoError(t, ds.Put(datastore.NewKey("/test/a"), []byte("a")))
+	require.NoError(t, ds.Put(long, []byte("long")))
+
+	sizes, err := ds.GetSizeMany(ctx, []datastore.Key{datastore.NewKey("/test/a"), long, datastore.NewKey("/test/missing")})
+	require.NoError(t, err)
+	require.Equal(t, map[datastore.Key]int{datastore.NewKey("/test/a"): 1, long: 4}, sizes)
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(datastore.NewKey("/test/b"), []byte("bb")))
+	sizes, err = txn.(*mongoTxn).GetSizeMany(ctx, []datastore.Key{datastore.NewKey("/test/b")})
+	require.NoError(t, err)
+	require.Equal(t, map[datastore.Key]int{datastore.NewKey("/test/b"): 2}, sizes)
+	txn.Discard()
+
+	require.NoError(t, ds.Close())
+}
+
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/test/%d", i)), make([]byte, 100)))
+	}
+
+	stats, err := ds.Stats(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 10, stats.Count)
+	require.Greater(t, stats.DataSize, uint64(1000))
+	require.Greater(t, stats.IndexSize, uint64(0))
+	require.Equal(t, stats.DataSize/10, stats.AvgObjSize)
+
+	require.NoError(t, ds.Close())
+	_, err = ds.Stats(ctx)
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestDropAll(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	require.Equal(t, ErrDropAllDisabled, ds.DropAll(ctx))
+	require.NoError(t, ds.Close())
+
+	ds = createMongoDS(t, test.GetMongoUri(), WithAllowDropAll(true), WithTTLIndex(true))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/test/%d", i)), []byte{1}))
+	}
+	require.NoError(t, ds.DropAll(ctx))
+	n, err := ds.Count(ctx, query.Query{})
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	cur, err := ds.col.Indexes().List(ctx)
+	require.NoError(t, err)
+	var indexes []bson.M
+	require.NoError(t, cur.All(ctx, &indexes))
+	names := make([]string, len(indexes))
+	for i, idx := range indexes {
+		names[i] = idx["name"].(string)
+	}
+	require.Contains(t, names, "expireAt_ttl")
+
+	require.NoError(t, ds.Put(datastore.NewKey("/test/after"), []byte{1}))
+	require.NoError(t, ds.Close())
+}
+
+func TestCountPrefix(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	for _, k := range []string{"/a", "/a/1", "/a/2", "/a/2/1", "/ab/1", "/b"} {
+		require.NoError(t, ds.Put(datastore.NewKey(k), nil))
+	}
+
+	for prefix, expected := range map[string]int64{"/": 6, "/a": 3, "/a/2": 1, "/ab": 1, "/c": 0} {
+		n, err := ds.CountPrefix(ctx, datastore.NewKey(prefix))
+		require.NoError(t, err)
+		require.Equal(t, expected, n, prefix)
+	}
+
+	require.NoError(t, ds.Close())
+}
+
+func BenchmarkCountPrefix(b *testing.B) {
+	ctx := context.Background()
+	ds, err := New(ctx, test.GetMongoUri(), WithDatabase(randStoreName()))
+	require.NoError(b, err)
+	defer ds.Close()
+
+	batch, err := ds.Batch()
+	require.NoError(b, err)
+	for i := 0; i < 10000; i++ {
+		require.NoError(b, batch.Put(datastore.NewKey(fmt.Sprintf("/bench/%d", i)), make([]byte, 64)))
+	}
+	require.NoError(b, batch.Commit())
+	prefix := datastore.NewKey("/bench")
+
+	b.Run("CountPrefix", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := ds.CountPrefix(ctx, prefix); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Streamed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			res, err := ds.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := countResults(res); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestPutIfChanged(t *testing.T) {
+	configs := map[string][]Option{
+		"Raw":        nil,
+		"Compressed": {WithCompression(GzipCodec(gzip.BestSpeed))},
+	}
+	for name, opts := range configs {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			ds := createMongoDS(t, test.GetMongoUri(), opts...)
+			key := datastore.NewKey("/test/hot")
+
+			for _, step := range []struct {
+				val     []byte
+				changed bool
+			}{
+				{[]byte("a"), true},
+				{[]byte("a"), false},
+				{[]byte("b"), true},
+				{nil, true},
+				{[]byte{}, false},
+			} {
+				changed, err := ds.PutIfChanged(ctx, key, step.val)
+				require.NoError(t, err)
+				require.Equal(t, step.changed, changed)
+				v, err := ds.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, len(step.val), len(v))
+			}
+
+			txn, err := ds.NewTransaction(false)
+			require.NoError(t, err)
+			changed, err := txn.(*mongoTxn).PutIfChanged(ctx, key, nil)
+			require.NoError(t, err)
+			require.False(t, changed)
+			changed, err = txn.(*mongoTxn).PutIfChanged(ctx, key, []byte("c"))
+			require.NoError(t, err)
+			require.True(t, changed)
+			require.NoError(t, txn.Commit())
+
+			require.NoError(t, ds.Close())
+		})
+	}
+}
+
+func TestPutIfChangedConcurrentInsert(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+
+	// Both writes change the value the key has before them, whichever
+	// inserts the key first.
+	for i := 0; i < 20; i++ {
+		key := datastore.NewKey(fmt.Sprintf("/test/race/%d", i))
+		var wg sync.WaitGroup
+		changed := make([]bool, 2)
+		errs := make([]error, 2)
+		for j := range changed {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				changed[j], errs[j] = ds.PutIfChanged(ctx, key, []byte{byte(j)})
+			}(j)
+		}
+		wg.Wait()
+		require.NoError(t, errs[0])
+		require.NoError(t, errs[1])
+		require.Equal(t, []bool{true, true}, changed)
+	}
+
+	require.NoError(t, ds.Close())
+}
+
+func TestCursorBatchSize(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	require.Nil(t, ds.findOptions(context.Background()).BatchSize)
+	require.NoError(t, ds.Close())
+
+	ds = createMongoDS(t, test.GetMongoUri(), WithCursorBatchSize(2))
+	require.EqualValues(t, 2, *ds.findOptions(context.Background()).BatchSize)
+
+	// Results span several batches.
+	for i := 0; i < 5; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/test/%d", i)), []byte{byte(i)}))
+	}
+	res, err := ds.Query(query.Query{Prefix: "/test"})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+
+	require.NoError(t, ds.Close())
+
+	_, err = New(context.Background(), test.GetMongoUri(), WithCursorBatchSize(-1))
+	require.Error(t, err)
+}
+
+func TestQueryTimeout(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithOpTimeout(time.Second), WithQueryTimeout(time.Minute))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	opts := ds.findOptions(context.Background())
+	require.Equal(t, time.Minute, *opts.MaxTime)
+
+	// The deadline of the context wins, whether it's earlier or later.
+	ctx, cls := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cls()
+	opts = ds.findOptions(ctx)
+	require.LessOrEqual(t, int64(*opts.MaxTime), int64(5*time.Second))
+	ctx, cls = context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cls()
+	opts = ds.findOptions(ctx)
+	require.Greater(t, int64(*opts.MaxTime), int64(time.Minute))
+
+	require.NoError(t, ds.Put(datastore.NewKey("/test/1"), []byte("1")))
+	res, err := ds.Query(query.Query{Prefix: "/test"})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	_, err = New(context.Background(), test.GetMongoUri(), WithQueryTimeout(0))
+	require.Error(t, err)
+}
+
+func TestQueryHint(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	require.NoError(t, ds.Put(datastore.NewKey("/test/1"), []byte("1")))
+	require.NoError(t, ds.Put(datastore.NewKey("/test/2"), []byte("2")))
+
+	q := dsextensions.QueryExt{Query: query.Query{Prefix: "/test"}}
+	res, err := ds.QueryWithOptions(q, WithHint("_id_"))
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	_, err = ds.QueryWithOptions(q, WithHint("missing"))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "missing")
+}
+
+func TestExplainQuery(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	require.NoError(t, ds.Put(datastore.NewKey("/test/1"), []byte("1")))
+
+	plan, err := ds.ExplainQuery(ctx, query.Query{Prefix: "/test", Limit: 1})
+	require.NoError(t, err)
+	planner, ok := plan["queryPlanner"].(bson.M)
+	require.True(t, ok)
+	require.Contains(t, fmt.Sprint(planner["winningPlan"]), "IXSCAN")
+
+	// Hints are explained too.
+	_, err = ds.ExplainQuery(ctx, query.Query{Prefix: "/test"}, WithHint("missing"))
+	require.Error(t, err)
+}
+
+func TestValueIndex(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithValueIndex(true))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/a/%d", i)), []byte{byte(i % 2)}))
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/b/%d", i)), []byte{byte(i % 2)}))
+	}
+
+	// Creating the index again is a no-op.
+	_, err := ds.Collection().Indexes().CreateOne(ctx, valueIndex(defaultValueField))
+	require.NoError(t, err)
+
+	q := query.Query{
+		Prefix:  "/a",
+		Filters: []query.Filter{query.FilterValueCompare{Op: query.Equal, Value: []byte{1}}},
+	}
+	res, err := ds.Query(q)
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+
+	res, err = ds.QueryWithOptions(dsextensions.QueryExt{Query: q}, WithHint("v_id"))
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+}
+
+func TestPrefixField(t *testing.T) {
+	ctx := context.Background()
+	name := randStoreName()
+	ds := createMongoDS(t, test.GetMongoUri(), WithDatabase(name))
+	keys := []string{"/a", "/a/b", "/a/b/c", "/a/bc", "/b/a"}
+	for _, k := range keys {
+		require.NoError(t, ds.Put(datastore.NewKey(k), []byte(k)))
+	}
+	require.NoError(t, ds.Close())
+
+	ds = createMongoDS(t, test.GetMongoUri(), WithDatabase(name), WithPrefixField(true))
+	defer func() { require.NoError(t, ds.Close()) }()
+	require.NoError(t, ds.Put(datastore.NewKey("/a/d"), []byte("/a/d")))
+
+	queryKeys := func(prefix string) []string {
+		res, err := ds.Query(query.Query{Prefix: prefix, KeysOnly: true})
+		require.NoError(t, err)
+		entries, err := res.Rest()
+		require.NoError(t, err)
+		keys := make([]string, len(entries))
+		for i, e := range entries {
+			keys[i] = e.Key
+		}
+		return keys
+	}
+	// Documents stored before enabling the field don't match yet.
+	require.Equal(t, []string{"/a/d"}, queryKeys("/a"))
+
+	n, err := ds.MigratePrefixField(ctx)
+	require.NoError(t, err)
+	require.Equal(t, len(keys), n)
+	n, err = ds.MigratePrefixField(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	require.Equal(t, []string{"/a/b", "/a/b/c", "/a/bc", "/a/d"}, queryKeys("/a"))
+	require.Equal(t, []string{"/a/b/c"}, queryKeys("/a/b"))
+	require.Len(t, queryKeys("/"), len(keys)+1)
+
+	count, err := ds.CountPrefix(ctx, datastore.NewKey("/a"))
+	require.NoError(t, err)
+	require.EqualValues(t, 4, count)
+}
+
+func TestAggregateQuery(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/test/%d", i)), []byte{byte(i)}))
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"v": bson.M{"$in": bson.A{[]byte{2}, []byte{4}}}}}},
+		{{Key: "$sort", Value: bson.M{"_id": -1}}},
+	}
+	res, err := ds.AggregateQuery(ctx, pipeline)
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "/test/4", entries[0].Key)
+	require.Equal(t, []byte{4}, entries[0].Value)
+	require.Equal(t, "/test/2", entries[1].Key)
+
+	// Closing early releases the cursor.
+	res, err = ds.AggregateQuery(ctx, mongo.Pipeline{})
+	require.NoError(t, err)
+	r, ok := res.NextSync()
+	require.True(t, ok)
+	require.NoError(t, r.Error)
+	require.NoError(t, res.Close())
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithCompression(GzipCodec(gzip.BestSpeed)))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	want := map[string][]byte{
+		"/a/1": bytes.Repeat([]byte("a"), 1000),
+		"/a/2": {},
+		"/b/1": []byte("b"),
+	}
+	for k, v := range want {
+		require.NoError(t, ds.Put(datastore.NewKey(k), v))
+	}
+
+	readAll := func(buf *bytes.Buffer) map[string][]byte {
+		r := bufio.NewReader(buf)
+		require.NoError(t, readHeader(r))
+		got := make(map[string][]byte)
+		for {
+			k, v, err := readRecord(r)
+			if err == io.EOF {
+				return got
+			}
+			require.NoError(t, err)
+			got[k] = v
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, ds.Export(ctx, &buf))
+	require.Equal(t, want, readAll(&buf))
+
+	buf.Reset()
+	require.NoError(t, ds.Export(ctx, &buf, WithPrefix(datastore.NewKey("/a"))))
+	got := readAll(&buf)
+	require.Len(t, got, 2)
+	require.Equal(t, want["/a/1"], got["/a/1"])
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+	src := createMongoDS(t, test.GetMongoUri(), WithGridFSThreshold(100))
+	defer func() { require.NoError(t, src.Close()) }()
+	dst := createMongoDS(t, test.GetMongoUri(), WithBatchFlushThreshold(3))
+	defer func() { require.NoError(t, dst.Close()) }()
+
+	want := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		k := fmt.Sprintf("/test/%d", i)
+		want[k] = bytes.Repeat([]byte{byte(i)}, (i+1)*20)
+		require.NoError(t, src.Put(datastore.NewKey(k), want[k]))
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, src.Export(ctx, &buf))
+	export := buf.Bytes()
+
+	n, err := dst.Import(ctx, bytes.NewReader(export))
+	require.NoError(t, err)
+	require.Equal(t, len(want), n)
+	res, err := dst.Query(query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	got := make(map[string][]byte)
+	for _, e := range entries {
+		got[e.Key] = e.Value
+	}
+	require.Equal(t, want, got)
+
+	// Existing keys are kept when skipping them.
+	require.NoError(t, dst.Put(datastore.NewKey("/test/1"), []byte("changed")))
+	require.NoError(t, dst.Delete(datastore.NewKey("/test/2")))
+	n, err = dst.Import(ctx, bytes.NewReader(export), WithSkipExisting(true))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	v, err := dst.Get(datastore.NewKey("/test/1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("changed"), v)
+	v, err = dst.Get(datastore.NewKey("/test/2"))
+	require.NoError(t, err)
+	require.Equal(t, want["/test/2"], v)
+
+	// Otherwise they're overwritten.
+	n, err = dst.Import(ctx, bytes.NewReader(export))
+	require.NoError(t, err)
+	require.Equal(t, len(want), n)
+	v, err = dst.Get(datastore.NewKey("/test/1"))
+	require.NoError(t, err)
+	require.Equal(t, want["/test/1"], v)
+
+	_, err = dst.Import(ctx, strings.NewReader("not an export"))
+	require.True(t, errors.Is(err, ErrExportFormat))
+	_, err = dst.Import(ctx, bytes.NewReader(export[:len(export)-1]))
+	require.True(t, errors.Is(err, ErrExportFormat))
+}
+
+func TestCopyFrom(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithBatchFlushThreshold(4))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	src := datastore.NewMapDatastore()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, src.Put(datastore.NewKey(fmt.Sprintf("/test/%d", i)), []byte{byte(i)}))
+	}
+	require.NoError(t, src.Put(datastore.NewKey("/other"), []byte("other")))
+
+	var progress []int
+	n, err := ds.CopyFrom(ctx, src, WithPrefix(datastore.NewKey("/test")), WithProgress(func(done, total int) {
+		require.Equal(t, -1, total)
+		progress = append(progress, done)
+	}))
+	require.NoError(t, err)
+	require.Equal(t, 10, n)
+	require.Equal(t, []int{4, 8, 10}, progress)
+	has, err := ds.Has(datastore.NewKey("/other"))
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// Resuming only copies the missing keys.
+	require.NoError(t, ds.Put(datastore.NewKey("/test/1"), []byte("changed")))
+	n, err = ds.CopyFrom(ctx, src, WithSkipExisting(true))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	v, err := ds.Get(datastore.NewKey("/test/1"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("changed"), v)
+	v, err = ds.Get(datastore.NewKey("/other"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("other"), v)
+}
+
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithBatchFlushThreshold(10))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	_, err := w.WriteString(exportHeader)
+	require.NoError(t, err)
+	for i := 0; i < 25; i++ {
+		require.NoError(t, writeRecord(w, fmt.Sprintf("/test/%d", i), []byte{byte(i)}))
+	}
+	require.NoError(t, w.Flush())
+
+	var progress []int
+	n, err := ds.Import(ctx, &buf, WithProgress(func(done, total int) {
+		require.Equal(t, -1, total)
+		progress = append(progress, done)
+	}))
+	require.NoError(t, err)
+	require.Equal(t, 25, n)
+	require.Equal(t, []int{10, 20, 25}, progress)
+
+	var totals []int
+	progress = nil
+	n, err = ds.DeletePrefix(ctx, datastore.NewKey("/test"), WithProgress(func(done, total int) {
+		totals = append(totals, total)
+		progress = append(progress, done)
+	}))
+	require.NoError(t, err)
+	require.Equal(t, 25, n)
+	require.Equal(t, []int{25}, progress)
+	require.Equal(t, []int{25}, totals)
+}
+
+func TestCloseDrain(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/test/%d", i)), []byte{byte(i)}))
+	}
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	agg, err := ds.AggregateQuery(context.Background(), mongo.Pipeline{})
+	require.NoError(t, err)
+	session, err := ds.NewCausalSession(context.Background())
+	require.NoError(t, err)
+
+	// The query is in flight until its results are read.
+	res, err := ds.Query(query.Query{Prefix: "/test"})
+	require.NoError(t, err)
+	r, ok := res.NextSync()
+	require.True(t, ok)
+	require.NoError(t, r.Error)
+
+	closed := make(chan error)
+	go func() {
+		closed <- ds.Close()
+	}()
+	waiting := func() {
+		select {
+		case <-closed:
+			t.Fatal("close didn't wait for operations in flight")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	waiting()
+	_, err = ds.Get(datastore.NewKey("/test/1"))
+	require.Equal(t, ErrClosed, err)
+
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 9)
+	waiting()
+
+	txn.Discard()
+	waiting()
+	require.NoError(t, agg.Close())
+	waiting()
+	require.NoError(t, session.Close())
+	require.NoError(t, <-closed)
+
+	// Close gives up waiting after the close timeout.
+	ds = createMongoDS(t, test.GetMongoUri(), WithCloseTimeout(100*time.Millisecond))
+	_, err = ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+}
+
+func TestCloseConcurrent(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				txn, err := ds.NewTransaction(false)
+				if err != nil {
+					errs <- err
+					return
+				}
+				_ = txn.Put(datastore.NewKey(fmt.Sprintf("/test/%d/%d", i, j)), []byte("v"))
+				txn.Discard()
+			}
+		}(i)
+	}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			time.Sleep(10 * time.Millisecond)
+			errs <- ds.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			require.Equal(t, ErrClosed, err)
+		}
+	}
+
+	require.NoError(t, ds.Close())
+	_, err := ds.NewTransaction(false)
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestHealthCheck(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	require.Nil(t, ds.health)
+	require.True(t, ds.Healthy())
+	require.NoError(t, ds.Close())
+
+	changes := make(chan bool, 1)
+	ds = createMongoDS(t, test.GetMongoUri(), WithHealthCheck(10*time.Millisecond), WithHealthCallback(func(healthy bool, err error) {
+		changes <- healthy
+	}))
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, ds.Healthy())
+	require.Len(t, changes, 0)
+
+	// The checks stop with Close.
+	require.NoError(t, ds.Close())
+	select {
+	case <-ds.health.done:
+	default:
+		t.Fatal("health check still running")
+	}
+
+	_, err := New(context.Background(), test.GetMongoUri(), WithHealthCheck(0))
+	require.Error(t, err)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker(2, 50*time.Millisecond, log)
+	require.NoError(t, b.allow())
+	b.record(context.DeadlineExceeded)
+	b.record(datastore.ErrNotFound)
+	b.record(context.DeadlineExceeded)
+	require.NoError(t, b.allow())
+
+	b.record(fmt.Errorf("finding: %w", context.DeadlineExceeded))
+	require.Equal(t, ErrUnavailable, b.allow())
+
+	// A single probe is let through after the cooldown.
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, b.allow())
+	require.Equal(t, ErrUnavailable, b.allow())
+	b.record(context.DeadlineExceeded)
+	require.Equal(t, ErrUnavailable, b.allow())
+
+	time.Sleep(60 * time.Millisecond)
+	require.NoError(t, b.allow())
+	b.record(nil)
+	require.NoError(t, b.allow())
+	require.NoError(t, b.allow())
+
+	var nilBreaker *circuitBreaker
+	require.NoError(t, nilBreaker.allow())
+
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithCircuitBreaker(1, time.Minute))
+	defer func() { require.NoError(t, ds.Close()) }()
+	require.NoError(t, ds.Put(datastore.NewKey("/test"), []byte("v")))
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	batch, err := ds.Batch()
+	require.NoError(t, err)
+	require.NoError(t, batch.Put(datastore.NewKey("/test"), []byte("w")))
+	ds.breaker.record(context.DeadlineExceeded)
+	_, err = ds.Get(datastore.NewKey("/test"))
+	require.Equal(t, ErrUnavailable, err)
+
+	// Every operation goes through the breaker.
+	keys := []datastore.Key{datastore.NewKey("/test")}
+	_, err = ds.GetMany(ctx, keys)
+	require.Equal(t, ErrUnavailable, err)
+	_, err = ds.HasMany(ctx, keys)
+	require.Equal(t, ErrUnavailable, err)
+	_, err = ds.GetSizeMany(ctx, keys)
+	require.Equal(t, ErrUnavailable, err)
+	require.Equal(t, ErrUnavailable, ds.PutWithTTL(keys[0], []byte("w"), time.Minute))
+	require.Equal(t, ErrUnavailable, ds.SetTTL(keys[0], time.Minute))
+	_, err = ds.GetExpiration(keys[0])
+	require.Equal(t, ErrUnavailable, err)
+	_, err = ds.Count(ctx, query.Query{})
+	require.Equal(t, ErrUnavailable, err)
+	_, err = ds.CountPrefix(ctx, datastore.NewKey("/"))
+	require.Equal(t, ErrUnavailable, err)
+	require.True(t, errors.Is(batch.Commit(), ErrUnavailable))
+	require.Equal(t, ErrUnavailable, txn.Commit())
+	txn.Discard()
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	l := newRateLimiter(10)
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		require.NoError(t, l.wait(ctx))
+	}
+	// The burst goes through right away, the rest at the limited rate.
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(400*time.Millisecond))
+
+	tctx, cls := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cls()
+	require.Equal(t, context.DeadlineExceeded, l.wait(tctx))
+
+	ds := createMongoDS(t, test.GetMongoUri(), WithWriteRateLimit(5))
+	defer func() { require.NoError(t, ds.Close()) }()
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/test/%d", i)), []byte("v")))
+	}
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(800*time.Millisecond))
+
+	// Reads aren't limited by the write limit.
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := ds.Get(datastore.NewKey(fmt.Sprintf("/test/%d", i)))
+		require.NoError(t, err)
+	}
+	require.Less(t, int64(time.Since(start)), int64(800*time.Millisecond))
+
+	// Batch flushes are limited too, each bulk write counting as one.
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		b, err := ds.Batch()
+		require.NoError(t, err)
+		require.NoError(t, b.Put(datastore.NewKey(fmt.Sprintf("/test/%d", i)), []byte("w")))
+		require.NoError(t, b.Commit())
+	}
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(800*time.Millisecond))
+
+	// And so are many-key reads.
+	rds := createMongoDS(t, test.GetMongoUri(), WithReadRateLimit(5))
+	defer func() { require.NoError(t, rds.Close()) }()
+	keys := []datastore.Key{datastore.NewKey("/test/0"), datastore.NewKey("/test/1")}
+	start = time.Now()
+	for i := 0; i < 10; i++ {
+		_, err := rds.GetMany(ctx, keys)
+		require.NoError(t, err)
+	}
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(800*time.Millisecond))
+}
+
+func TestNotFound(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithGridFSThreshold(10))
+	defer func() { require.NoError(t, ds.Close()) }()
+	missing := datastore.NewKey("/missing")
+
+	_, err := ds.Get(missing)
+	require.True(t, errors.Is(err, datastore.ErrNotFound))
+	_, err = ds.GetSize(missing)
+	require.True(t, errors.Is(err, datastore.ErrNotFound))
+	_, err = ds.GetExpiration(missing)
+	require.True(t, errors.Is(err, datastore.ErrNotFound))
+	require.True(t, errors.Is(ds.SetTTL(missing, time.Minute), datastore.ErrNotFound))
+	_, err = ds.GetAndDelete(ctx, missing)
+	require.True(t, errors.Is(err, datastore.ErrNotFound))
+	has, err := ds.Has(missing)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	txn, err := ds.NewTransaction(true)
+	require.NoError(t, err)
+	defer txn.Discard()
+	_, err = txn.Get(missing)
+	require.True(t, errors.Is(err, datastore.ErrNotFound))
+	_, err = txn.GetSize(missing)
+	require.True(t, errors.Is(err, datastore.ErrNotFound))
+
+	s, err := ds.NewCausalSession(ctx)
+	require.NoError(t, err)
+	defer func() { require.NoError(t, s.Close()) }()
+	_, err = s.Get(ctx, missing)
+	require.True(t, errors.Is(err, datastore.ErrNotFound))
+}
+
+func TestIsTransient(t *testing.T) {
+	require.False(t, IsTransient(nil))
+	require.False(t, IsTransient(datastore.ErrNotFound))
+	require.False(t, IsTransient(context.Canceled))
+	require.False(t, IsTransient(fmt.Errorf("finding key-values: %w", mongo.CommandError{Code: 2})))
+	require.True(t, IsTransient(ErrUnavailable))
+	require.True(t, IsTransient(fmt.Errorf("getting key: %w", context.DeadlineExceeded)))
+	require.True(t, IsTransient(fmt.Errorf("committing batch: %w", mongo.CommandError{Code: 112})))
+	require.True(t, IsTransient(mongo.CommandError{Labels: []string{"TransientTransactionError"}}))
+
+	err := &kindError{kind: ErrNotConnected, err: mongo.CommandError{Code: 189}}
+	require.True(t, IsTransient(err))
+	require.True(t, errors.Is(err, ErrNotConnected))
+	var ce mongo.CommandError
+	require.True(t, errors.As(err, &ce))
+	require.Equal(t, int32(189), ce.Code)
+}
+
+func TestCallerDeadline(t *testing.T) {
+	db := randStoreName()
+	ds := createMongoDS(t, test.GetMongoUri(), WithDatabase(db))
+	defer func() { require.NoError(t, ds.Close()) }()
+	key := datastore.NewKey("/test")
+	require.NoError(t, ds.Put(key, []byte("1")))
+
+	t.Run("shorter", func(t *testing.T) {
+		ctx, cls := context.WithTimeout(context.Background(), time.Nanosecond)
+		defer cls()
+		_, err := ds.GetMany(ctx, []datastore.Key{key})
+		require.Error(t, err)
+		require.True(t, IsTransient(err))
+	})
+
+	t.Run("longer", func(t *testing.T) {
+		short := createMongoDS(t, test.GetMongoUri(), WithDatabase(db), WithOpTimeout(time.Nanosecond))
+		defer func() { require.NoError(t, short.Close()) }()
+
+		_, err := short.GetMany(context.Background(), []datastore.Key{key})
+		require.Error(t, err)
+
+		ctx, cls := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cls()
+		vals, err := short.GetMany(ctx, []datastore.Key{key})
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), vals[key])
+		n, err := short.CountPrefix(ctx, datastore.NewKey("/"))
+		require.NoError(t, err)
+		require.Equal(t, int64(1), n)
+	})
+}
+
+func TestLinearizableReads(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithLinearizableReads())
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	key := datastore.NewKey("/test")
+	require.NoError(t, ds.Put(key, []byte("1")))
+	v, err := ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), v)
+	has, err := ds.Has(key)
+	require.NoError(t, err)
+	require.True(t, has)
+	vals, err := ds.GetMany(context.Background(), []datastore.Key{key})
+	require.NoError(t, err)
+	require.Len(t, vals, 1)
+
+	txn, err := ds.NewTransaction(true)
+	require.NoError(t, err)
+	defer txn.Discard()
+	v, err = txn.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("1"), v)
+
+	_, err = New(context.Background(), test.GetMongoUri(), WithLinearizableReads(), WithReadPreference(readpref.Secondary()))
+	require.Error(t, err)
+	_, err = New(context.Background(), test.GetMongoUri(), WithReadConcern(readconcern.Linearizable()))
+	require.Error(t, err)
+}
+
+func TestMajorityQueries(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithMajorityQueries(), WithReadPreference(readpref.PrimaryPreferred()))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	for _, k := range []string{"/a/1", "/a/2", "/b/1"} {
+		require.NoError(t, ds.Put(datastore.NewKey(k), []byte(k)))
+	}
+	// Majority reads may lag the writes on a replica set, so the results
+	// are awaited.
+	require.Eventually(t, func() bool {
+		res, err := ds.Query(query.Query{Prefix: "/a"})
+		if err != nil {
+			return false
+		}
+		entries, err := res.Rest()
+		return err == nil && len(entries) == 2
+	}, 5*time.Second, 50*time.Millisecond)
+	n, err := ds.CountPrefix(context.Background(), datastore.NewKey("/a"))
+	require.NoError(t, err)
+	require.Equal(t, int64(2), n)
+
+	txn, err := ds.NewTransaction(true)
+	require.NoError(t, err)
+	defer txn.Discard()
+	res, err := txn.Query(query.Query{Prefix: "/b"})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestMaxNaiveResults(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithMaxNaiveResults(2))
+	defer func() { require.NoError(t, ds.Close()) }()
+	for _, k := range []string{"/a/1", "/a/2", "/b/1"} {
+		require.NoError(t, ds.Put(datastore.NewKey(k), []byte(k)))
+	}
+
+	// Queries sorted by MongoDB are streamed, so they aren't bounded.
+	res, err := ds.Query(query.Query{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	byValue := []query.Order{query.OrderByValue{}}
+	res, err = ds.Query(query.Query{Prefix: "/a", Orders: byValue})
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+
+	res, err = ds.Query(query.Query{Orders: byValue})
+	require.NoError(t, err)
+	_, err = res.Rest()
+	require.True(t, errors.Is(err, ErrTooManyResults))
+
+	_, err = New(context.Background(), test.GetMongoUri(), WithMaxNaiveResults(-1))
+	require.Error(t, err)
+}
+
+func TestMultipleOrders(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+	var all []query.Entry
+	for i := 0; i < 20; i++ {
+		key := datastore.NewKey(fmt.Sprintf("/test/%02d", i))
+		val := []byte(fmt.Sprintf("%d", i%3))
+		require.NoError(t, ds.Put(key, val))
+		all = append(all, query.Entry{Key: key.String(), Value: val, Size: len(val)})
+	}
+
+	cases := [][]query.Order{
+		{query.OrderByValue{}, query.OrderByKey{}},
+		{query.OrderByValueDescending{}, query.OrderByKeyDescending{}},
+		{query.OrderByKeyDescending{}, query.OrderByValue{}},
+		{query.OrderByKey{}, query.OrderByValueDescending{}},
+	}
+	for _, orders := range cases {
+		q := query.Query{Prefix: "/test", Orders: orders, Offset: 3, Limit: 10}
+		res, err := ds.Query(q)
+		require.NoError(t, err)
+		got, err := res.Rest()
+		require.NoError(t, err)
+
+		expected, err := query.NaiveQueryApply(q, query.ResultsWithEntries(q, all)).Rest()
+		require.NoError(t, err)
+		require.Len(t, got, len(expected))
+		for i := range expected {
+			require.Equal(t, expected[i].Key, got[i].Key, "orders %v", orders)
+			require.Equal(t, expected[i].Value, got[i].Value, "orders %v", orders)
+		}
+	}
+}
+
+func TestCombinedFilters(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+	var all []query.Entry
+	for _, k := range []string{"/a/1", "/a/2", "/ab/1", "/ab/2", "/b/1", "/b/2"} {
+		val := []byte("odd")
+		if strings.HasSuffix(k, "2") {
+			val = []byte("even")
+		}
+		require.NoError(t, ds.Put(datastore.NewKey(k), val))
+		all = append(all, query.Entry{Key: k, Value: val, Size: len(val)})
+	}
+
+	cases := []struct {
+		filters []query.Filter
+		server  bool
+	}{
+		{[]query.Filter{query.FilterKeyPrefix{Prefix: "/a"}, query.FilterValueCompare{Op: query.Equal, Value: []byte("even")}}, true},
+		{[]query.Filter{&query.FilterKeyPrefix{Prefix: "/ab/"}, query.FilterKeyCompare{Op: query.NotEqual, Key: "/ab/1"}}, true},
+		{[]query.Filter{query.FilterKeyPrefix{Prefix: "/a"}, query.FilterValueCompare{Op: query.GreaterThan, Value: []byte("m")}}, false},
+	}
+	for _, c := range cases {
+		q := query.Query{Filters: c.filters}
+		filters, ok := ds.serverFilters(q)
+		require.Equal(t, c.server, ok)
+		if ok {
+			require.Len(t, filters, 1+len(c.filters))
+		}
+
+		res, err := ds.Query(q)
+		require.NoError(t, err)
+		got, err := res.Rest()
+		require.NoError(t, err)
+		expected, err := query.NaiveQueryApply(q, query.ResultsWithEntries(q, all)).Rest()
+		require.NoError(t, err)
+		require.Len(t, got, len(expected))
+		for i := range expected {
+			require.Equal(t, expected[i].Key, got[i].Key)
+		}
+	}
+
+	end, ok := prefixEnd("/a\xff\xff")
+	require.True(t, ok)
+	require.Equal(t, "/b", end)
+	_, ok = prefixEnd("")
+	require.False(t, ok)
+}
+
+func TestQueryPage(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+	for i := 0; i < 25; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/test/%02d", i)), []byte("v")))
+	}
+
+	var keys []string
+	token := ""
+	for page := 0; ; page++ {
+		entries, next, err := ds.QueryPage(ctx, query.Query{Prefix: "/test"}, token, 10)
+		require.NoError(t, err)
+		for _, e := range entries {
+			keys = append(keys, e.Key)
+		}
+		if page == 0 {
+			// Keys added before the current page don't shift the next ones.
+			require.NoError(t, ds.Put(datastore.NewKey("/test/00a"), []byte("v")))
+		}
+		if next == "" {
+			require.Equal(t, 2, page)
+			break
+		}
+		token = next
+	}
+	require.Len(t, keys, 25)
+	for i, k := range keys {
+		require.Equal(t, fmt.Sprintf("/test/%02d", i), k)
+	}
+
+	entries, next, err := ds.QueryPage(ctx, query.Query{Prefix: "/test", Orders: []query.Order{query.OrderByKeyDescending{}}}, "", 5)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	require.Equal(t, "/test/24", entries[0].Key)
+	entries, _, err = ds.QueryPage(ctx, query.Query{Prefix: "/test", Orders: []query.Order{query.OrderByKeyDescending{}}}, next, 5)
+	require.NoError(t, err)
+	require.Equal(t, "/test/19", entries[0].Key)
+
+	_, _, err = ds.QueryPage(ctx, query.Query{}, "!", 10)
+	require.True(t, errors.Is(err, ErrPageToken))
+	_, _, err = ds.QueryPage(ctx, query.Query{Limit: 5}, "", 10)
+	require.Error(t, err)
+	_, _, err = ds.QueryPage(ctx, query.Query{Orders: []query.Order{query.OrderByValue{}}}, "", 10)
+	require.Error(t, err)
+}
+
+func TestValueField(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithValueField("data"), WithValueIndex(true))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	key := datastore.NewKey("/test/1")
+	require.NoError(t, ds.Put(key, []byte("one")))
+	require.NoError(t, ds.Put(datastore.NewKey("/test/2"), []byte("two")))
+	var doc bson.M
+	require.NoError(t, ds.Collection().FindOne(ctx, bson.M{"_id": "/test/1"}).Decode(&doc))
+	require.Equal(t, primitive.Binary{Data: []byte("one")}, doc["data"])
+	require.NotContains(t, doc, "v")
+
+	v, err := ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("one"), v)
+	size, err := ds.GetSize(key)
+	require.NoError(t, err)
+	require.Equal(t, 3, size)
+	swapped, err := ds.CompareAndSwap(ctx, key, []byte("one"), []byte("uno"))
+	require.NoError(t, err)
+	require.True(t, swapped)
+
+	res, err := ds.Query(query.Query{
+		Prefix:  "/test",
+		Filters: []query.Filter{query.FilterValueCompare{Op: query.Equal, Value: []byte("two")}},
+	})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "/test/2", entries[0].Key)
+	require.Equal(t, []byte("two"), entries[0].Value)
+
+	for _, name := range []string{"", "_id", "expireAt", "a.b", "$v"} {
+		_, err = New(ctx, test.GetMongoUri(), WithValueField(name))
+		require.Error(t, err, name)
+	}
+}
+
+func TestTimestamps(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithTimestamps(true))
+	defer func() { require.NoError(t, ds.Close()) }()
+	key := datastore.NewKey("/test")
+
+	before := time.Now().Add(-time.Second)
+	require.NoError(t, ds.Put(key, []byte("one")))
+	meta, err := ds.GetMeta(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, 3, meta.Size)
+	require.True(t, meta.CreatedAt.After(before))
+	require.True(t, meta.UpdatedAt.After(before))
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, ds.Put(key, []byte("three")))
+	updated, err := ds.GetMeta(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, 5, updated.Size)
+	require.Equal(t, meta.CreatedAt, updated.CreatedAt)
+	require.True(t, updated.UpdatedAt.After(meta.UpdatedAt))
+
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Put(datastore.NewKey("/batched"), []byte("v")))
+	require.NoError(t, b.Commit())
+	meta, err = ds.GetMeta(ctx, datastore.NewKey("/batched"))
+	require.NoError(t, err)
+	require.False(t, meta.CreatedAt.IsZero())
+
+	_, err = ds.GetMeta(ctx, datastore.NewKey("/missing"))
+	require.True(t, errors.Is(err, datastore.ErrNotFound))
+
+	// Without timestamps, only the size is known.
+	plain := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, plain.Close()) }()
+	require.NoError(t, plain.Put(key, []byte("one")))
+	meta, err = plain.GetMeta(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, Meta{Size: 3}, meta)
+}
+
+func TestQueryModifiedSince(t *testing.T) {
+	ctx := context.Background()
+	db := randStoreName()
+	// Keys written without timestamps have no updatedAt field.
+	plain := createMongoDS(t, test.GetMongoUri(), WithDatabase(db))
+	require.NoError(t, plain.Put(datastore.NewKey("/test/old"), []byte("old")))
+	_, err := plain.QueryModifiedSince(ctx, datastore.NewKey("/test"), time.Time{})
+	require.Error(t, err)
+	require.NoError(t, plain.Close())
+
+	ds := createMongoDS(t, test.GetMongoUri(), WithDatabase(db), WithTimestamps(true))
+	defer func() { require.NoError(t, ds.Close()) }()
+	require.NoError(t, ds.Put(datastore.NewKey("/test/1"), []byte("1")))
+	require.NoError(t, ds.Put(datastore.NewKey("/other/1"), []byte("1")))
+	time.Sleep(10 * time.Millisecond)
+	checkpoint := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, ds.Put(datastore.NewKey("/test/3"), []byte("3")))
+	require.NoError(t, ds.Put(datastore.NewKey("/test/2"), []byte("2")))
+
+	res, err := ds.QueryModifiedSince(ctx, datastore.NewKey("/test"), time.Time{})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	res, err = ds.QueryModifiedSince(ctx, datastore.NewKey("/test"), checkpoint)
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "/test/3", entries[0].Key)
+	require.Equal(t, []byte("3"), entries[0].Value)
+	require.Equal(t, "/test/2", entries[1].Key)
+
+	// Resuming from the write time of an entry returns it again, along
+	// with the entries written since.
+	meta, err := ds.GetMeta(ctx, datastore.NewKey("/test/3"))
+	require.NoError(t, err)
+	res, err = ds.QueryModifiedSince(ctx, datastore.NewKey("/test"), meta.UpdatedAt)
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "/test/3", entries[0].Key)
+
+	// The results are in flight until they're closed.
+	res, err = ds.QueryModifiedSince(ctx, datastore.NewKey("/test"), checkpoint)
+	require.NoError(t, err)
+	require.False(t, ds.drain(100*time.Millisecond))
+	require.NoError(t, res.Close())
+	require.True(t, ds.drain(time.Second))
+
+	var plan bson.M
+	cmd := bson.D{
+		{Key: "explain", Value: bson.D{
+			{Key: "find", Value: ds.Collection().Name()},
+			{Key: "filter", Value: bson.M{"updatedAt": bson.M{"$gte": checkpoint}}},
+		}},
+		{Key: "verbosity", Value: "queryPlanner"},
+	}
+	require.NoError(t, ds.Collection().Database().RunCommand(ctx, cmd).Decode(&plan))
+	require.Contains(t, fmt.Sprint(plan["queryPlanner"]), "updatedAt_id")
+}
+
+func TestSlidingTTL(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithSlidingTTL(time.Hour))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	cached := datastore.NewKey("/cached")
+	require.NoError(t, ds.PutWithTTL(cached, []byte("v"), time.Minute))
+	_, err := ds.Get(cached)
+	require.NoError(t, err)
+	exp, err := ds.GetExpiration(cached)
+	require.NoError(t, err)
+	require.True(t, exp.After(time.Now().Add(50*time.Minute)))
+
+	// A longer expiration isn't shortened.
+	require.NoError(t, ds.SetTTL(cached, 2*time.Hour))
+	_, err = ds.Get(cached)
+	require.NoError(t, err)
+	exp, err = ds.GetExpiration(cached)
+	require.NoError(t, err)
+	require.True(t, exp.After(time.Now().Add(90*time.Minute)))
+
+	// Keys without expiration are left as is.
+	permanent := datastore.NewKey("/permanent")
+	require.NoError(t, ds.Put(permanent, []byte("v")))
+	_, err = ds.Get(permanent)
+	require.NoError(t, err)
+	exp, err = ds.GetExpiration(permanent)
+	require.NoError(t, err)
+	require.True(t, exp.IsZero())
+
+	_, err = New(context.Background(), test.GetMongoUri(), WithSlidingTTL(0))
+	require.Error(t, err)
+}
+
+func TestDeleteIf(t *testing.T) {
+	ctx := context.Background()
+	for name, opts := range map[string][]Option{
+		"raw":    nil,
+		"gridfs": {WithGridFSThreshold(1)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ds := createMongoDS(t, test.GetMongoUri(), opts...)
+			defer func() { require.NoError(t, ds.Close()) }()
+			lease := datastore.NewKey("/lease")
+
+			require.NoError(t, ds.Put(lease, []byte("holder-a")))
+			held, err := ds.Get(lease)
+			require.NoError(t, err)
+
+			// The lease changed hands between the read and the delete.
+			require.NoError(t, ds.Put(lease, []byte("holder-b")))
+			deleted, err := ds.DeleteIf(ctx, lease, held)
+			require.NoError(t, err)
+			require.False(t, deleted)
+			v, err := ds.Get(lease)
+			require.NoError(t, err)
+			require.Equal(t, []byte("holder-b"), v)
+
+			deleted, err = ds.DeleteIf(ctx, lease, []byte("holder-b"))
+			require.NoError(t, err)
+			require.True(t, deleted)
+			has, err := ds.Has(lease)
+			require.NoError(t, err)
+			require.False(t, has)
+
+			deleted, err = ds.DeleteIf(ctx, lease, []byte("holder-b"))
+			require.NoError(t, err)
+			require.False(t, deleted)
+		})
+	}
+}
+
+func TestVersions(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+	key := datastore.NewKey("/doc")
+
+	require.NoError(t, ds.PutWithVersion(ctx, key, []byte("v1"), 0))
+	require.True(t, errors.Is(ds.PutWithVersion(ctx, key, []byte("again"), 0), ErrVersionConflict))
+	val, ver, err := ds.GetWithVersion(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v1"), val)
+	require.Equal(t, int64(1), ver)
+
+	// A concurrent editor writes in between.
+	require.NoError(t, ds.Put(key, []byte("theirs")))
+	require.True(t, errors.Is(ds.PutWithVersion(ctx, key, []byte("mine"), ver), ErrVersionConflict))
+	val, ver, err = ds.GetWithVersion(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("theirs"), val)
+	require.Equal(t, int64(2), ver)
+
+	require.NoError(t, ds.PutWithVersion(ctx, key, []byte("mine"), ver))
+	meta, err := ds.GetMeta(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, int64(3), meta.Version)
+
+	// Keys written before versions were recorded are at version 0.
+	legacy := datastore.NewKey("/legacy")
+	_, err = ds.Collection().InsertOne(ctx, bson.M{"_id": legacy.String(), "v": []byte("old")})
+	require.NoError(t, err)
+	_, ver, err = ds.GetWithVersion(ctx, legacy)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), ver)
+	require.NoError(t, ds.PutWithVersion(ctx, legacy, []byte("new"), 0))
+
+	_, _, err = ds.GetWithVersion(ctx, datastore.NewKey("/missing"))
+	require.True(t, errors.Is(err, datastore.ErrNotFound))
+}
+
+func TestBatchSplit(t *testing.T) {
+	require.Equal(t, []int{2, 3}, splitOps([]int{5, 5, 5}, 10, 0))
+	require.Equal(t, []int{1, 2}, splitOps([]int{20, 1}, 10, 0))
+	require.Equal(t, []int{1, 2, 3}, splitOps([]int{1, 20, 1}, 10, 0))
+	require.Equal(t, []int{2, 4, 5}, splitOps([]int{1, 1, 1, 1, 1}, 10, 2))
+
+	ds := createMongoDS(t, test.GetMongoUri(), WithBatchFlushThreshold(0))
+	defer func() { require.NoError(t, ds.Close()) }()
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	val := make([]byte, 1<<20)
+	for i := 0; i < 40; i++ {
+		val[0] = byte(i)
+		require.NoError(t, b.Put(datastore.NewKey(fmt.Sprintf("/big/%02d", i)), val))
+	}
+	require.NoError(t, b.Delete(datastore.NewKey("/big/00")))
+	require.NoError(t, b.Commit())
+
+	n, err := ds.CountPrefix(context.Background(), datastore.NewKey("/big"))
+	require.NoError(t, err)
+	require.Equal(t, int64(39), n)
+	v, err := ds.Get(datastore.NewKey("/big/39"))
+	require.NoError(t, err)
+	require.Equal(t, byte(39), v[0])
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	_, err := New(context.Background(), test.GetMongoUri(), WithBatchConcurrency(0))
+	require.Error(t, err)
+
+	ds := createMongoDS(t, test.GetMongoUri(), WithUnorderedBatch(true), WithBatchConcurrency(4), WithBatchFlushThreshold(0))
+	defer func() { require.NoError(t, ds.Close()) }()
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, b.Put(datastore.NewKey(fmt.Sprintf("/parallel/%04d", i)), []byte{byte(i)}))
+	}
+	require.NoError(t, b.Commit())
+
+	n, err := ds.CountPrefix(context.Background(), datastore.NewKey("/parallel"))
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), n)
+}
+
+func BenchmarkBatchFlush(b *testing.B) {
+	const keys = 20000
+	val := make([]byte, 256)
+	for name, n := range map[string]int{"Serial": 1, "Parallel": 8} {
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			ds, err := New(ctx, test.GetMongoUri(), WithDatabase(randStoreName()),
+				WithUnorderedBatch(true), WithBatchConcurrency(n), WithBatchFlushThreshold(0))
+			require.NoError(b, err)
+			defer ds.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				batch, err := ds.Batch()
+				require.NoError(b, err)
+				for j := 0; j < keys; j++ {
+					if err := batch.Put(datastore.NewKey(fmt.Sprintf("/bench/%d", j)), val); err != nil {
+						b.Fatal(err)
+					}
+				}
+				if err := batch.Commit(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchInTxn(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+	key := datastore.NewKey("/txnbatch/a")
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	b, err := txn.(*mongoTxn).Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Put(key, []byte("a")))
+	require.NoError(t, b.Put(datastore.NewKey("/txnbatch/b"), []byte("b")))
+	require.NoError(t, b.Commit())
+
+	// The writes are only visible within the transaction until it's
+	// committed.
+	has, err := ds.Has(key)
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = txn.Has(key)
+	require.NoError(t, err)
+	require.True(t, has)
+	require.NoError(t, txn.Commit())
+	has, err = ds.Has(key)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	// Discarding the transaction discards the writes of the batch.
+	txn, err = ds.NewTransaction(false)
+	require.NoError(t, err)
+	b, err = txn.(*mongoTxn).Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Delete(key))
+	require.NoError(t, b.Commit())
+	txn.Discard()
+	has, err = ds.Has(key)
+	require.NoError(t, err)
+	require.True(t, has)
+
+	_, err = txn.(*mongoTxn).Batch()
+	require.Equal(t, ErrTxnFinalized, err)
+	ro, err := ds.NewTransaction(true)
+	require.NoError(t, err)
+	defer ro.Discard()
+	_, err = ro.(*mongoTxn).Batch()
+	require.Equal(t, ErrTxnReadOnly, err)
+}
+
+func TestEnsureIndexes(t *testing.T) {
+	ctx := context.Background()
+	name := randStoreName()
+
+	// Without creating indexes, the missing ones are reported.
+	l := &recordingLogger{}
+	ds, err := New(ctx, test.GetMongoUri(), WithDatabase(name), WithTTLIndex(true), WithEnsureIndexes(false), WithLogger(l))
+	require.NoError(t, err)
+	infos, err := listIndexes(ctx, ds.Collection())
+	require.NoError(t, err)
+	for _, info := range infos {
+		require.NotEqual(t, "expireAt_ttl", info.Name)
+	}
+	require.Len(t, l.warns, 1)
+	require.Contains(t, l.warns[0], "index expireAt_ttl is missing")
+
+	// An index created with other options is reported, and left as is.
+	model := ttlIndex()
+	model.Options.SetExpireAfterSeconds(60)
+	_, err = ds.Collection().Indexes().CreateOne(ctx, model)
+	require.NoError(t, err)
+	require.NoError(t, ds.Close())
+	l = &recordingLogger{}
+	ds, err = New(ctx, test.GetMongoUri(), WithDatabase(name), WithTTLIndex(true), WithLogger(l))
+	require.NoError(t, err)
+	require.Len(t, l.warns, 1)
+	require.Contains(t, l.warns[0], "expireAfterSeconds 60 instead of 0")
+	require.NoError(t, ds.Close())
+
+	// Missing indexes are created by default.
+	l = &recordingLogger{}
+	ds = createMongoDS(t, test.GetMongoUri(), WithTTLIndex(true), WithValueIndex(true), WithLogger(l))
+	defer func() { require.NoError(t, ds.Close()) }()
+	require.Empty(t, l.warns)
+	infos, err = listIndexes(ctx, ds.Collection())
+	require.NoError(t, err)
+	for _, model := range expectedIndexes(&config{ttlIndex: true, valueIndex: true, valueField: defaultValueField}) {
+		info, ok := findIndex(infos, model)
+		require.True(t, ok)
+		require.Empty(t, indexMismatch(info, model))
+	}
+}
+
+func TestCollation(t *testing.T) {
+	ctx := context.Background()
+	_, err := New(ctx, test.GetMongoUri(), WithCollation(nil))
+	require.Error(t, err)
+	_, err = New(ctx, test.GetMongoUri(), WithCollation(&options.Collation{Locale: "en", Alternate: "shifted"}))
+	require.Error(t, err)
+
+	name := randStoreName()
+	ds, err := New(ctx, test.GetMongoUri(), WithDatabase(name), WithCollation(&options.Collation{Locale: "en"}))
+	require.NoError(t, err)
+	defer func() { require.NoError(t, ds.Close()) }()
+	for _, k := range []string{"/c/B", "/c/a", "/c/b", "/c/A", "/C/a", "/c\\a"} {
+		require.NoError(t, ds.Put(datastore.NewKey(k), []byte(k)))
+	}
+
+	// Keys are ordered by the collation, which puts lowercase first, and
+	// prefix matches are exact.
+	res, err := ds.Query(query.Query{Prefix: "/c", KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	require.Equal(t, []string{"/c/a", "/c/A", "/c/b", "/c/B"}, keys)
+
+	// The collation of an existing collection can't change.
+	_, err = New(ctx, test.GetMongoUri(), WithDatabase(name))
+	require.Error(t, err)
+	_, err = New(ctx, test.GetMongoUri(), WithDatabase(name), WithCollation(&options.Collation{Locale: "fr", Strength: 2}))
+	require.Error(t, err)
+}
+
+func TestCaseInsensitiveKeys(t *testing.T) {
+	ctx := context.Background()
+	_, err := New(ctx, test.GetMongoUri(), WithCaseInsensitiveKeys(true), WithCollation(&options.Collation{Locale: "en"}))
+	require.Error(t, err)
+
+	block, err := aes.NewCipher(make([]byte, 32))
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	ds := createMongoDS(t, test.GetMongoUri(), WithCaseInsensitiveKeys(true), WithKeyHashing(16), WithEncryption(aead))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	for _, k := range []string{"/Dir/A", "/Dir/LongerThanTheThreshold"} {
+		require.NoError(t, ds.Put(datastore.NewKey(k), []byte("1")))
+		lower := datastore.NewKey(strings.ToLower(k))
+		v, err := ds.Get(lower)
+		require.NoError(t, err)
+		require.Equal(t, []byte("1"), v)
+		has, err := ds.Has(lower)
+		require.NoError(t, err)
+		require.True(t, has)
+
+		require.NoError(t, ds.Put(lower, []byte("2")))
+		v, err = ds.Get(datastore.NewKey(strings.ToUpper(k)))
+		require.NoError(t, err)
+		require.Equal(t, []byte("2"), v)
+	}
+
+	// Keys keep the case of their first write, and prefix matches
+	// ignore case.
+	res, err := ds.Query(query.Query{Prefix: "/dir", KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.Equal(t, "/Dir/A", entries[0].Key)
+
+	require.NoError(t, ds.Delete(datastore.NewKey("/DIR/a")))
+	_, err = ds.Get(datastore.NewKey("/Dir/A"))
+	require.Equal(t, datastore.ErrNotFound, err)
+}
+
+func TestCaseInsensitiveBatch(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri(), WithCaseInsensitiveKeys(true), WithUnorderedBatch(true), WithBatchConcurrency(4))
+	defer func() { require.NoError(t, ds.Close()) }()
+	require.NoError(t, ds.Put(datastore.NewKey("/Dir/B"), []byte("1")))
+
+	// Keys differing by case are stored in the same document, so the
+	// last operation on any of them replaces the earlier ones.
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	require.NoError(t, b.Put(datastore.NewKey("/Dir/A"), []byte("1")))
+	require.NoError(t, b.Delete(datastore.NewKey("/dir/a")))
+	require.NoError(t, b.Delete(datastore.NewKey("/DIR/B")))
+	require.NoError(t, b.Put(datastore.NewKey("/dir/b"), []byte("2")))
+	require.Len(t, b.(*mongoBatch).ops, 2)
+	require.NoError(t, b.Commit())
+
+	_, err = ds.Get(datastore.NewKey("/Dir/A"))
+	require.Equal(t, datastore.ErrNotFound, err)
+	v, err := ds.Get(datastore.NewKey("/Dir/B"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("2"), v)
+}
+
+func TestQueryConformance(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+	for i := 0; i < 10; i++ {
+		require.NoError(t, ds.Put(datastore.NewKey(fmt.Sprintf("/conf/%d", i)), []byte{byte(i)}))
+	}
+	require.NoError(t, ds.PutWithTTL(datastore.NewKey("/conf/ttl"), []byte{100}, time.Hour))
+
+	// Filters checked client-side see the values while skipping the
+	// offset, even if only keys are returned.
+	res, err := ds.Query(query.Query{
+		Prefix:   "/conf",
+		Filters:  []query.Filter{query.FilterValueCompare{Op: query.LessThan, Value: []byte{5}}},
+		Offset:   2,
+		KeysOnly: true,
+	})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	var keys []string
+	for _, e := range entries {
+		require.Nil(t, e.Value)
+		keys = append(keys, e.Key)
+	}
+	require.Equal(t, []string{"/conf/2", "/conf/3", "/conf/4"}, keys)
+
+	for _, keysOnly := range []bool{false, true} {
+		res, err = ds.Query(query.Query{Prefix: "/conf", ReturnExpirations: true, KeysOnly: keysOnly})
+		require.NoError(t, err)
+		entries, err = res.Rest()
+		require.NoError(t, err)
+		require.Len(t, entries, 11)
+		for _, e := range entries {
+			if e.Key == "/conf/ttl" {
+				require.WithinDuration(t, time.Now().Add(time.Hour), e.Expiration, time.Minute)
+			} else {
+				require.True(t, e.Expiration.IsZero())
+			}
+		}
+	}
+}
+
+func TestMove(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+	a, b, c := datastore.NewKey("/move/a"), datastore.NewKey("/move/b"), datastore.NewKey("/move/c")
+
+	require.Equal(t, datastore.ErrNotFound, ds.Move(ctx, a, b))
+	require.NoError(t, ds.PutWithTTL(a, []byte("a"), time.Hour))
+	require.NoError(t, ds.Move(ctx, a, a))
+	require.NoError(t, ds.Move(ctx, a, b))
+	_, err := ds.Get(a)
+	require.Equal(t, datastore.ErrNotFound, err)
+	v, err := ds.Get(b)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), v)
+	exp, err := ds.GetExpiration(b)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), exp, time.Minute)
+
+	// The destination is only replaced when overwriting is allowed.
+	require.NoError(t, ds.Put(c, []byte("c")))
+	require.Equal(t, ErrKeyExists, ds.Move(ctx, b, c))
+	require.NoError(t, ds.Move(ctx, b, c, WithOverwrite()))
+	v, err = ds.Get(c)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), v)
+	has, err := ds.Has(b)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// Within a transaction, the move is only visible once committed.
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.(*mongoTxn).Move(ctx, c, a))
+	txn.Discard()
+	has, err = ds.Has(c)
+	require.NoError(t, err)
+	require.True(t, has)
+}
+
+func TestDeleteManyKeys(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+	a, b, c := datastore.NewKey("/dmk/a"), datastore.NewKey("/dmk/b"), datastore.NewKey("/dmk/c")
+	require.NoError(t, ds.Put(a, []byte("a")))
+	require.NoError(t, ds.Put(c, []byte("c")))
+
+	deleted, err := ds.DeleteManyKeys(ctx, []datastore.Key{c, b, a, c})
+	require.NoError(t, err)
+	require.Equal(t, []datastore.Key{c, a}, deleted)
+	has, err := ds.Has(a)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	deleted, err = ds.DeleteManyKeys(ctx, []datastore.Key{a, b})
+	require.NoError(t, err)
+	require.Empty(t, deleted)
+
+	// Without transactions, keys are found and deleted in two steps.
+	require.NoError(t, ds.Put(b, []byte("b")))
+	ds.txnSupported = false
+	deleted, err = ds.DeleteManyKeys(ctx, []datastore.Key{a, b})
+	require.NoError(t, err)
+	require.Equal(t, []datastore.Key{b}, deleted)
+}
+
+func TestWriteRetries(t *testing.T) {
+	_, err := New(context.Background(), test.GetMongoUri(), WithWriteRetries(-1))
+	require.Error(t, err)
+
+	ds := createMongoDS(t, test.GetMongoUri(), WithWriteRetries(2))
+	defer func() { require.NoError(t, ds.Close()) }()
+	retryable := mongo.CommandError{Message: "network error", Labels: []string{"RetryableWriteError"}}
+	attempts := 0
+	write := func(failures int, err error) func() error {
+		attempts = 0
+		return func() error {
+			attempts++
+			if attempts <= failures {
+				return err
+			}
+			return nil
+		}
+	}
+
+	ctx := context.Background()
+	require.NoError(t, ds.retryWrite(ctx, write(2, retryable)))
+	require.Equal(t, 3, attempts)
+	require.Equal(t, retryable, ds.retryWrite(ctx, write(3, retryable)))
+	require.Equal(t, 3, attempts)
+
+	// Other errors, and writes within transactions, aren't retried.
+	require.Error(t, ds.retryWrite(ctx, write(1, mongo.CommandError{Message: "other"})))
+	require.Equal(t, 1, attempts)
+	txnCtx := context.WithValue(ctx, txnCtxKey{}, true)
+	require.Error(t, ds.retryWrite(txnCtx, write(1, retryable)))
+	require.Equal(t, 1, attempts)
+
+	// Retries stop at the deadline.
+	dlCtx, cls := context.WithTimeout(ctx, time.Nanosecond)
+	defer cls()
+	<-dlCtx.Done()
+	require.Error(t, ds.retryWrite(dlCtx, write(1, retryable)))
+	require.Equal(t, 1, attempts)
+
+	// Upserts pinned to the version they replace can be applied twice,
+	// the second time failing with a duplicate key error that's ignored.
+	key, other := datastore.NewKey("/test/retried"), datastore.NewKey("/test/other")
+	require.NoError(t, ds.Put(key, []byte{1}))
+	for _, ordered := range []bool{true, false} {
+		upsert, err := ds.putModel(ctx, key, []byte{2}, false, nil)
+		require.NoError(t, err)
+		insert, err := ds.putModel(ctx, other, []byte{2}, false, nil)
+		require.NoError(t, err)
+		del := mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": "/test/none"})
+		ops, pinned, err := ds.pinVersions(ctx, []mongo.WriteModel{upsert, del, insert})
+		require.NoError(t, err)
+		require.Equal(t, []bool{true, false, true}, pinned)
+		opts := options.BulkWrite().SetOrdered(ordered)
+		_, v, err := ds.GetWithVersion(ctx, key)
+		require.NoError(t, err)
+		require.NoError(t, ds.bulkWritePinned(ctx, ops, pinned, opts))
+		require.NoError(t, ds.bulkWritePinned(ctx, ops, pinned, opts))
+		_, after, err := ds.GetWithVersion(ctx, key)
+		require.NoError(t, err)
+		require.Equal(t, v+1, after)
+		require.NoError(t, ds.Delete(other))
+	}
+	_, v, err := ds.GetWithVersion(ctx, key)
+	require.NoError(t, err)
+	require.NoError(t, ds.Put(key, []byte{3}))
+	_, after, err := ds.GetWithVersion(ctx, key)
+	require.NoError(t, err)
+	require.Equal(t, v+1, after)
+}
+
+func TestKeyCodec(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithKeyCodec(BinaryKeyCodec()))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	for _, k := range []string{"/a/2", "/a/10", "/a/b/1", "/ab/1", "/b/1"} {
+		require.NoError(t, ds.Put(datastore.NewKey(k), []byte(k)))
+	}
+	var raw keyValue
+	require.NoError(t, ds.col.FindOne(ctx, bson.M{"k": "/a/2"}).Decode(&raw))
+	require.Equal(t, primitive.Binary{Data: []byte("/a/2")}, raw.ID)
+
+	v, err := ds.Get(datastore.NewKey("/a/2"))
+	require.NoError(t, err)
+	require.Equal(t, []byte("/a/2"), v)
+	vals, err := ds.GetMany(ctx, []datastore.Key{datastore.NewKey("/a/2"), datastore.NewKey("/b/1")})
+	require.NoError(t, err)
+	require.Len(t, vals, 2)
+
+	// Binary ids sort by length first, so ordering and ranges must apply
+	// to the full key.
+	res, err := ds.Query(query.Query{Prefix: "/a", KeysOnly: true})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	var keys []string
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	require.Equal(t, []string{"/a/10", "/a/2", "/a/b/1"}, keys)
+
+	res, err = ds.Query(query.Query{
+		KeysOnly: true,
+		Filters:  []query.Filter{query.FilterKeyPrefix{Prefix: "/a"}, query.FilterKeyCompare{Op: query.LessThan, Key: "/ab"}},
+	})
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	require.NoError(t, ds.Delete(datastore.NewKey("/a/2")))
+	_, err = ds.Get(datastore.NewKey("/a/2"))
+	require.Equal(t, datastore.ErrNotFound, err)
+
+	codec := StringKeyCodec()
+	id, err := codec.Encode(datastore.NewKey("/a"))
+	require.NoError(t, err)
+	key, err := codec.Decode(id)
+	require.NoError(t, err)
+	require.Equal(t, datastore.NewKey("/a"), key)
+	_, err = codec.Decode(raw.ID)
+	require.Error(t, err)
+
+	// Documents whose _id the codec can't decode are reported, rather than
+	// returned under a made up key.
+	k, err := ds.kvKey(keyValue{ID: raw.ID})
+	require.NoError(t, err)
+	require.Equal(t, "/a/2", k)
+	_, err = ds.kvKey(keyValue{ID: "/a/2"})
+	require.Error(t, err)
+
+	_, err = New(ctx, test.GetMongoUri(), WithKeyCodec(BinaryKeyCodec()), WithKeyHashing(256))
+	require.Error(t, err)
+}
+
+func TestShardKey(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri(), WithShardKey("sk"))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	key := datastore.NewKey("/a/b")
+	require.NoError(t, ds.Put(key, []byte("v")))
+	var raw bson.M
+	require.NoError(t, ds.col.FindOne(ctx, bson.M{"_id": key.String()}).Decode(&raw))
+	require.Equal(t, ds.shardValue(key), raw["sk"])
+	require.Len(t, ds.shardValue(key), shardValueLen)
+
+	v, err := ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), v)
+	vals, err := ds.GetMany(ctx, []datastore.Key{key, datastore.NewKey("/missing")})
+	require.NoError(t, err)
+	require.Len(t, vals, 1)
+	swapped, err := ds.CompareAndSwap(ctx, key, []byte("v"), []byte("w"))
+	require.NoError(t, err)
+	require.True(t, swapped)
+	require.NoError(t, ds.Delete(key))
+	has, err := ds.Has(key)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	_, err = New(ctx, test.GetMongoUri(), WithShardKey("_id"))
+	require.Error(t, err)
+	_, err = New(ctx, test.GetMongoUri(), WithShardKey("a.b"))
+	require.Error(t, err)
+	_, err = New(ctx, test.GetMongoUri(), WithShardKey("val"), WithValueField("val"))
+	require.Error(t, err)
+}
+
+func TestOldestTxnAge(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	l := &recordingLogger{}
+	ds := createMongoDS(t, test.GetMongoUri(), WithMetrics(reg), WithLogger(l), WithTxnLeakWarn(50*time.Millisecond))
+	defer func() { require.NoError(t, ds.Close()) }()
+	require.Zero(t, ds.OldestTxnAge())
+
+	first, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	second, err := ds.NewTransaction(true)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, int64(ds.OldestTxnAge()), int64(20*time.Millisecond))
+	require.Greater(t, testutil.ToFloat64(ds.metrics.oldestTxn), 0.0)
+
+	// The oldest transaction is left open past the threshold.
+	require.NoError(t, second.Commit())
+	require.Eventually(t, func() bool {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		return len(l.warns) == 1
+	}, time.Second, 10*time.Millisecond)
+	require.Contains(t, l.warns[0], "may have been leaked")
+
+	first.Discard()
+	require.Zero(t, ds.OldestTxnAge())
+	require.Zero(t, testutil.ToFloat64(ds.metrics.oldestTxn))
+
+	// A failed commit finalizes the transaction, so it's not tracked
+	// anymore either.
+	failed, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, failed.Put(datastore.NewKey("/test/oldest"), []byte{1}))
+	require.NotZero(t, ds.OldestTxnAge())
+	mt := failed.(*mongoTxn)
+	mt.session = &faultySession{Session: mt.session, failures: 1}
+	require.Error(t, failed.Commit())
+	require.Zero(t, ds.OldestTxnAge())
+	require.Zero(t, testutil.ToFloat64(ds.metrics.oldestTxn))
+}
+
+func TestTxnMaxLifetime(t *testing.T) {
+	l := &recordingLogger{}
+	ds := createMongoDS(t, test.GetMongoUri(), WithLogger(l), WithTxnMaxLifetime(100*time.Millisecond))
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	key := datastore.NewKey("/test/abandoned")
+	leaked, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, leaked.Put(key, []byte{1}))
+	require.Eventually(t, func() bool {
+		return ds.OldestTxnAge() == 0
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, ErrTxnFinalized, leaked.Put(key, []byte{2}))
+	require.Equal(t, ErrTxnFinalized, leaked.Delete(key))
+	require.Equal(t, ErrTxnFinalized, leaked.Commit())
+	leaked.Discard()
+	has, err := ds.Has(key)
+	require.NoError(t, err)
+	require.False(t, has)
+	l.lock.Lock()
+	require.Len(t, l.warns, 1)
+	require.Contains(t, l.warns[0], "aborting transaction")
+	l.lock.Unlock()
+
+	// Transactions committed in time aren't affected.
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(key, []byte{1}))
+	require.NoError(t, txn.Commit())
+	time.Sleep(200 * time.Millisecond)
+	has, err = ds.Has(key)
+	require.NoError(t, err)
+	require.True(t, has)
+}
+
+func TestTxnClose(t *testing.T) {
+	l := &recordingLogger{}
+	ds := createMongoDS(t, test.GetMongoUri(), WithLogger(l), WithCloseTimeout(10*time.Millisecond),
+		WithTxnLeakWarn(100*time.Millisecond), WithTxnMaxLifetime(200*time.Millisecond))
+
+	key := datastore.NewKey("/test/open")
+	open, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, open.Put(key, []byte{1}))
+	committed, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, committed.Commit())
+
+	// Close aborts the transaction left open instead of waiting for the
+	// watchdog, whose timers are stopped along with the leak warnings.
+	require.NoError(t, ds.Close())
+	require.Zero(t, ds.OldestTxnAge())
+	require.Equal(t, ErrTxnFinalized, open.Commit())
+	l.lock.Lock()
+	require.Len(t, l.warns, 2)
+	require.Contains(t, l.warns[0], "still in flight")
+	require.Contains(t, l.warns[1], "still open on close")
+	l.lock.Unlock()
+
+	time.Sleep(300 * time.Millisecond)
+	l.lock.Lock()
+	require.Len(t, l.warns, 2)
+	l.lock.Unlock()
+}
+
+func TestTxnCommitFailure(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+
+	key := datastore.NewKey("/test/commitfailure")
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(key, []byte{1}))
+	mt := txn.(*mongoTxn)
+	mt.session = &faultySession{Session: mt.session, failures: 1}
+	require.Error(t, txn.Commit())
+	require.Equal(t, ErrTxnFinalized, txn.Commit())
+	has, err := ds.Has(key)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// Every failed attempt of WithTransaction releases its session.
+	attempts := 0
+	err = ds.WithTransaction(context.Background(), false, func(txn dsextensions.TxnExt) error {
+		attempts++
+		mt := txn.(*mongoTxn)
+		mt.session = &faultySession{Session: mt.session, label: driver.TransientTransactionError, failures: 1}
+		return txn.Put(key, []byte{1})
+	})
+	require.Error(t, err)
+	require.Equal(t, ds.txnMaxAttempts, attempts)
+	require.True(t, ds.drain(time.Second))
+}
+
+func TestRestrictedKeyChars(t *testing.T) {
+	ctx := context.Background()
+	ds := createMongoDS(t, test.GetMongoUri())
+
+	keys := []datastore.Key{
+		datastore.NewKey("/a.b/$c"),
+		datastore.NewKey("/a.b/$c.d"),
+		datastore.NewKey("/a.b/c"),
+		datastore.NewKey("/$where/1"),
+		datastore.NewKey("/a/b.c"),
+	}
+	b, err := ds.Batch()
+	require.NoError(t, err)
+	for _, k := range keys[:2] {
+		require.NoError(t, b.Put(k, []byte(k.String())))
+	}
+	require.NoError(t, b.Commit())
+	for _, k := range keys[2:] {
+		require.NoError(t, ds.Put(k, []byte(k.String())))
+	}
+
+	for _, k := range keys {
+		v, err := ds.Get(k)
+		require.NoError(t, err)
+		require.Equal(t, []byte(k.String()), v)
+	}
+	vals, err := ds.GetMany(ctx, keys)
+	require.NoError(t, err)
+	require.Len(t, vals, len(keys))
+
+	res, err := ds.Query(query.Query{Prefix: "/a.b"})
+	require.NoError(t, err)
+	entries, err := res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	for _, e := range entries {
+		require.True(t, strings.HasPrefix(e.Key, "/a.b/"))
+		require.Equal(t, []byte(e.Key), e.Value)
+	}
+
+	res, err = ds.Query(query.Query{
+		Filters: []query.Filter{query.FilterKeyCompare{Op: query.Equal, Key: "/a.b/$c"}},
+	})
+	require.NoError(t, err)
+	entries, err = res.Rest()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.Equal(t, "/a.b/$c", entries[0].Key)
+
+	n, err := ds.Count(ctx, query.Query{Prefix: "/$where"})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	require.NoError(t, ds.Delete(keys[0]))
+	has, err := ds.Has(keys[0])
+	require.NoError(t, err)
+	require.False(t, has)
+	has, err = ds.Has(keys[1])
+	require.NoError(t, err)
+	require.True(t, has)
+
+	require.NoError(t, ds.Close())
+}
+
+func BenchmarkCompression(b *testing.B) {
+	payload := []byte(`{"id":"bafyreigh2akiscaildc","owner":"0x8f7e6d5c4b3a","tags":["alpha","beta","gamma"],` +
+		`"created":"2021-06-01T12:00:00Z","attributes":{"color":"blue","size":"large","weight":12.5},` +
+		`"description":"a representative json document with repeated field names and values"}`)
+	codecs := map[string][]Option{
+		"None": nil,
+		"Gzip": {WithCompression(GzipCodec(gzip.DefaultCompression))},
+	}
+	for name, opts := range codecs {
+		b.Run(name, func(b *testing.B) {
+			ctx := context.Background()
+			opts = append([]Option{WithDatabase(randStoreName())}, opts...)
+			ds, err := New(ctx, test.GetMongoUri(), opts...)
+			require.NoError(b, err)
+			defer ds.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := ds.Put(datastore.NewKey(fmt.Sprintf("/bench/%d", i)), payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+
+			stats, err := ds.collStats(ctx)
+			require.NoError(b, err)
+			var size uint64
+			for _, s := range stats {
+				size += toUint64(s["size"])
+			}
+			b.ReportMetric(float64(size)/float64(b.N), "stored-B/op")
+		})
+	}
+}
+
+func TestWithTransaction(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	ctx := context.Background()
+	key := datastore.NewKey("/test/withtxn")
+
+	// A write conflict with another open transaction is labeled as a
+	// transient error, so the transaction should be retried.
+	other, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, other.Put(key, []byte("other")))
+
+	attempts := 0
+	err = ds.WithTransaction(ctx, false, func(txn dsextensions.TxnExt) error {
+		attempts++
+		if err := txn.Put(key, []byte("mine")); err != nil {
+			require.NoError(t, other.Commit())
+			return err
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+	v, err := ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("mine"), v)
+
+	// Non transient errors are returned right away.
+	errBoom := errors.New("boom")
+	attempts = 0
+	err = ds.WithTransaction(ctx, false, func(txn dsextensions.TxnExt) error {
+		attempts++
+		return errBoom
+	})
+	require.Equal(t, errBoom, err)
+	require.Equal(t, 1, attempts)
+
+	// The operations and the commit are bounded by ctx.
+	cctx, cancel := context.WithCancel(ctx)
+	canceled := datastore.NewKey("/test/withtxn/canceled")
+	err = ds.WithTransaction(cctx, false, func(txn dsextensions.TxnExt) error {
+		if err := txn.Put(canceled, []byte("v")); err != nil {
+			return err
+		}
+		cancel()
+		return nil
+	})
+	require.Error(t, err)
+	_, err = ds.Get(canceled)
+	require.True(t, errors.Is(err, datastore.ErrNotFound))
+	err = ds.WithTransaction(cctx, false, func(txn dsextensions.TxnExt) error {
+		return txn.Put(canceled, []byte("v"))
+	})
+	require.Error(t, err)
+	require.Zero(t, ds.OldestTxnAge())
+
+	require.NoError(t, ds.Close())
+}
+
+func TestTxnRetry(t *testing.T) {
+	for attempt := 1; attempt < 40; attempt++ {
+		d := ExponentialBackoff(10*time.Millisecond, time.Second)(attempt)
+		require.GreaterOrEqual(t, int64(d), int64(0))
+		require.LessOrEqual(t, int64(d), int64(time.Second))
+	}
+
+	var delays []int
+	backoff := func(attempt int) time.Duration {
+		delays = append(delays, attempt)
+		return time.Millisecond
+	}
+	ds := createMongoDS(t, test.GetMongoUri(), WithTxnRetry(4, backoff))
+	defer func() { require.NoError(t, ds.Close()) }()
+	transient := mongo.CommandError{Labels: []string{driver.TransientTransactionError}}
+
+	attempts := 0
+	err := ds.WithTransaction(context.Background(), false, func(txn dsextensions.TxnExt) error {
+		attempts++
+		return transient
+	})
+	require.Error(t, err)
+	require.Equal(t, 4, attempts)
+	require.Equal(t, []int{1, 2, 3}, delays)
+
+	// Retries whose backoff ends past the deadline aren't attempted.
+	slow := createMongoDS(t, test.GetMongoUri(), WithTxnRetry(10, ConstantBackoff(time.Minute)))
+	defer func() { require.NoError(t, slow.Close()) }()
+	ctx, cls := context.WithTimeout(context.Background(), time.Second)
+	defer cls()
+	attempts = 0
+	start := time.Now()
+	err = slow.WithTransaction(ctx, false, func(txn dsextensions.TxnExt) error {
+		attempts++
+		return transient
+	})
+	require.Error(t, err)
+	require.Equal(t, 1, attempts)
+	require.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	_, err = New(context.Background(), test.GetMongoUri(), WithTxnRetry(0, backoff))
+	require.Error(t, err)
+	_, err = New(context.Background(), test.GetMongoUri(), WithTxnRetry(3, nil))
+	require.Error(t, err)
+}
+
+func TestWriteConflict(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+	defer func() { require.NoError(t, ds.Close()) }()
+	key := datastore.NewKey("/test/conflict")
+
+	first, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	defer first.Discard()
+	require.NoError(t, first.Put(key, []byte("first")))
+
+	second, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	defer second.Discard()
+	err = second.Put(key, []byte("second"))
+	require.Error(t, err)
+	require.True(t, errors.Is(err, ErrWriteConflict))
+	require.True(t, IsTransient(err))
+	var se mongo.ServerError
+	require.True(t, errors.As(err, &se))
+	require.True(t, se.HasErrorCode(112))
+
+	require.NoError(t, first.Commit())
+	require.False(t, errors.Is(ds.Put(key, []byte("after")), ErrWriteConflict))
+
+	// Conflicts are reported by transaction batches and commits too.
+	for _, unordered := range []bool{false, true} {
+		first, err = ds.NewTransaction(false)
+		require.NoError(t, err)
+		require.NoError(t, first.Put(key, []byte("first")))
+		second, err := ds.NewTransaction(false)
+		require.NoError(t, err)
+		ds.unorderedBatch = unordered
+		b, err := second.(*mongoTxn).Batch()
+		require.NoError(t, err)
+		require.NoError(t, b.Put(datastore.NewKey("/test/conflict/other"), []byte("second")))
+		require.NoError(t, b.Put(key, []byte("second")))
+		require.True(t, errors.Is(b.Commit(), ErrWriteConflict))
+		second.Discard()
+		first.Discard()
+	}
+	ds.unorderedBatch = false
+
+	txn, err := ds.NewTransaction(false)
+	require.NoError(t, err)
+	require.NoError(t, txn.Put(key, []byte("txn")))
+	mt := txn.(*mongoTxn)
+	mt.session = &faultySession{Session: mt.session, code: 112, failures: 1}
+	require.True(t, errors.Is(txn.Commit(), ErrWriteConflict))
+}
+
+func TestTxnCommitRetry(t *testing.T) {
+	ds := createMongoDS(t, test.GetMongoUri())
+
+	cases := []struct {
+		label         string
+		expectedCalls int
+		expectedErr   bool
+	}{
+		{label: driver.UnknownTransactionCommitResult, expectedCalls: 2},
+		{label: driver.TransientTransactionError, expectedCalls: 1, expectedErr: true},
+	}
+	for i, c := range cases {
+		txn, err := ds.NewTransaction(false)
+		require.NoError(t, err)
+		require.NoError(t, txn.Put(datastore.NewKey(fmt.Sprintf("/test/commitretry%d", i)), []byte{1}))
+
+		mt := txn.(*mongoTxn)
+		fs := &faultySession{Session: mt.session, label: c.label, failures: 1}
+		mt.session = fs
+
+		err = txn.Commit()
+		require.Equal(t, c.expectedErr, err != nil)
+		require.Equal(t, c.expectedCalls, fs.calls)
+		if err != nil {
+			txn.Discard()
+		}
+	}
+
+	require.NoError(t, ds.Close())
+}
+
+// faultySession fails the first commits with an error carrying label.
+type faultySession struct {
+	mongo.Session
+	label    string
+	code     int32
+	failures int
+	calls    int
+}
+
+func (s *faultySession) CommitTransaction(ctx context.Context) error {
+	s.calls++
+	if s.calls <= s.failures {
+		return mongo.CommandError{Code: s.code, Name: "faulty commit", Labels: []string{s.label}}
+	}
+	return s.Session.CommitTransaction(ctx)
+}
+
+func createMongoDS(t *testing.T, uri string, opts ...Option) *MongoDS {
+	opts = append([]Option{WithDatabase(randStoreName())}, opts...)
+	ds, err := New(context.Background(), uri, opts...)
 	require.NoError(t, err)
 	return ds
 }
@@ -0,0 +1,94 @@
+// Package mongodstest helps testing code that uses a MongoDS against a
+// real MongoDB deployment, for instance to run the dstest suite on it:
+//
+//	func TestDatastore(t *testing.T) {
+//		ds, cleanup := mongodstest.NewDatastore(t)
+//		defer cleanup()
+//		dstest.SubtestAll(t, ds)
+//	}
+//
+// The deployment is found at the URI of the MONGO_URI environment
+// variable, or on localhost by default. If MONGO_URI isn't set, Main starts
+// one with docker-compose for the duration of the tests:
+//
+//	func TestMain(m *testing.M) {
+//		mongodstest.Main(m)
+//	}
+package mongodstest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"testing"
+	"time"
+
+	mongods "github.com/textileio/go-ds-mongo"
+	"github.com/textileio/go-ds-mongo/test"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// cleanupTimeout bounds the time the cleanup of a datastore takes.
+const cleanupTimeout = 30 * time.Second
+
+// Main runs the tests of m and exits with their result. Unless MONGO_URI
+// is set, it starts a MongoDB deployment with docker-compose first, which
+// needs docker-compose to be installed, and removes it once the tests are
+// done.
+func Main(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	if os.Getenv("MONGO_URI") == "" {
+		cleanup := test.StartMongoDB()
+		defer cleanup()
+	}
+	return m.Run()
+}
+
+// URI returns the URI of the deployment datastores are created on.
+func URI() string {
+	return test.GetMongoUri()
+}
+
+// NewDatastore returns a datastore configured with opts, stored in a new
+// database of its own so tests don't interfere with each other, and the
+// function cleaning it up, which drops the database and closes the
+// datastore. The test fails right away if the datastore can't be built.
+func NewDatastore(t testing.TB, opts ...mongods.Option) (*mongods.MongoDS, func()) {
+	t.Helper()
+
+	ctx, cls := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cls()
+	opts = append([]mongods.Option{mongods.WithDatabase(databaseName(t))}, opts...)
+	ds, err := mongods.New(ctx, URI(), opts...)
+	if err != nil {
+		t.Fatalf("creating datastore: %s", err)
+	}
+
+	cleanup := func() {
+		ctx, cls := context.WithTimeout(context.Background(), cleanupTimeout)
+		defer cls()
+		// The test may have closed the datastore already, which
+		// disconnects its client and leaves the database behind.
+		err := ds.Database().Drop(ctx)
+		if err != nil && err != mongo.ErrClientDisconnected {
+			t.Errorf("dropping database: %s", err)
+		}
+		if err := ds.Close(); err != nil {
+			t.Errorf("closing datastore: %s", err)
+		}
+	}
+	return ds, cleanup
+}
+
+// databaseName returns a database name unique to this call.
+func databaseName(t testing.TB) string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("generating database name: %s", err)
+	}
+	return "mongodstest_" + hex.EncodeToString(b)
+}
@@ -0,0 +1,32 @@
+package mongodstest
+
+import (
+	"testing"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	Main(m)
+}
+
+func TestNewDatastore(t *testing.T) {
+	ds, cleanup := NewDatastore(t)
+	key := datastore.NewKey("/smoke")
+	require.NoError(t, ds.Put(key, []byte("v")))
+	v, err := ds.Get(key)
+	require.NoError(t, err)
+	require.Equal(t, []byte("v"), v)
+
+	// Datastores don't share their data.
+	other, cleanupOther := NewDatastore(t)
+	defer cleanupOther()
+	has, err := other.Has(key)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	// Cleaning up tolerates a datastore the test closed.
+	require.NoError(t, ds.Close())
+	cleanup()
+}
@@ -0,0 +1,117 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+
+	"github.com/ipfs/go-datastore"
+	dsextensions "github.com/textileio/go-datastore-extensions"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrKeyExists is returned by Move when the destination key already
+// exists, unless WithOverwrite is given.
+var ErrKeyExists = errors.New("key already exists")
+
+// MoveOption configures Move.
+type MoveOption func(*moveConfig)
+
+type moveConfig struct {
+	overwrite bool
+}
+
+// WithOverwrite makes Move replace the value of the destination key if it
+// already exists, instead of failing with ErrKeyExists.
+func WithOverwrite() MoveOption {
+	return func(c *moveConfig) {
+		c.overwrite = true
+	}
+}
+
+// Move atomically relocates the value of from, along with its expiration,
+// to the key to, and deletes from. It returns ErrNotFound if from doesn't
+// exist. Documents can't change their _id, so the value is written under
+// to and from is deleted within a transaction, which is retried like with
+// WithTransaction: no failure can lose the value or leave it under both
+// keys. It needs a deployment supporting transactions, and returns
+// ErrTxnUnsupported otherwise.
+func (m *MongoDS) Move(ctx context.Context, from, to datastore.Key, opts ...MoveOption) error {
+	if !m.txnSupported {
+		return ErrTxnUnsupported
+	}
+	return m.WithTransaction(ctx, false, func(txn dsextensions.TxnExt) error {
+		return txn.(*mongoTxn).Move(ctx, from, to, opts...)
+	})
+}
+
+// Move relocates the value of from to the key to within the transaction,
+// as described by MongoDS.Move.
+func (t *mongoTxn) Move(ctx context.Context, from, to datastore.Key, opts ...MoveOption) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return ErrTxnFinalized
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	var config moveConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.move(ctx, from, to, config)
+}
+
+func (m *MongoDS) move(ctx context.Context, from, to datastore.Key, config moveConfig) (err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return err
+	}
+	ctx, end := m.startOp(ctx, "move", from.String())
+	defer end(&err)
+
+	if from.Equal(to) {
+		return m.findKey(ctx, from)
+	}
+	if !config.overwrite {
+		err := m.findKey(ctx, to)
+		if err == nil {
+			return ErrKeyExists
+		}
+		if err != datastore.ErrNotFound {
+			return err
+		}
+	}
+
+	filter, err := m.docFilter(from)
+	if err != nil {
+		return err
+	}
+	var kv keyValue
+	if err := m.col.FindOneAndDelete(ctx, filter).Decode(&kv); err != nil {
+		return readErr("deleting key-value", err)
+	}
+	// The value is rewritten rather than copied as is, since encrypted
+	// values are bound to the id of their document.
+	val, err := m.loadValue(ctx, kv)
+	if err != nil {
+		return err
+	}
+	if err := m.writeValue(ctx, to, val, kv.ExpireAt); err != nil {
+		return err
+	}
+	m.replacedFile(ctx, kv.File)
+	return nil
+}
+
+// findKey returns ErrNotFound if key doesn't exist.
+func (m *MongoDS) findKey(ctx context.Context, key datastore.Key) error {
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return err
+	}
+	opts := options.FindOne().SetProjection(bson.M{"_id": 1})
+	return readErr("finding key", m.col.FindOne(ctx, filter, opts).Err())
+}
@@ -1,37 +1,904 @@
 package mongods
 
-import "time"
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
 
 var (
 	defaultConfig = config{
 		opTimeout:  30 * time.Second,
 		txnTimeout: 30 * time.Second,
+		dbName:     "mongods",
 		collName:   "kvstore",
+		valueField: defaultValueField,
+
+		queryTimeout: 30 * time.Second,
+		closeTimeout: 30 * time.Second,
+
+		txnMaxAttempts: 3,
+		txnBackoff:     ExponentialBackoff(10*time.Millisecond, 500*time.Millisecond),
+
+		batchFlushThreshold: 1000,
+		batchConcurrency:    1,
+
+		ensureIndexes: true,
+
+		tracerProvider: otel.GetTracerProvider(),
+		logger:         log,
+
+		gridfsBucket: "mongods",
+
+		keyCodec: StringKeyCodec(),
 	}
 )
 
 type config struct {
 	opTimeout  time.Duration
 	txnTimeout time.Duration
+	dbName     string
 	collName   string
+
+	queryTimeout time.Duration
+	closeTimeout time.Duration
+
+	healthInterval time.Duration
+	healthCallback func(healthy bool, err error)
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	rateLimit      int
+	readRateLimit  int
+	writeRateLimit int
+
+	readConcern  *readconcern.ReadConcern
+	writeConcern *writeconcern.WriteConcern
+	readPref     *readpref.ReadPref
+	linearizable bool
+
+	majorityQueries bool
+
+	txnMaxAttempts int
+	txnBackoff     BackoffFunc
+	txnFallback    bool
+	txnLeakWarn    time.Duration
+	txnMaxLifetime time.Duration
+
+	batchFlushThreshold int
+	unorderedBatch      bool
+	batchConcurrency    int
+
+	ttlIndex      bool
+	valueIndex    bool
+	prefixField   bool
+	ensureIndexes bool
+
+	metricsRegisterer prometheus.Registerer
+	tracerProvider    trace.TracerProvider
+	redactKeys        bool
+
+	slowOpThreshold time.Duration
+	logger          Logger
+
+	gridfsThreshold int
+	gridfsBucket    string
+	codec           Codec
+	aead            cipher.AEAD
+
+	keyHashThreshold int
+	namespace        string
+	keyCodec         KeyCodec
+	shardKey         string
+
+	allowDropAll bool
+
+	cursorBatchSize int32
+	maxNaiveResults int
+
+	valueField string
+	timestamps bool
+	slidingTTL time.Duration
+	collation  *options.Collation
+
+	caseInsensitiveKeys bool
+
+	writeRetries int
 }
 
-type Option func(*config)
+// Option configures the datastore. An option returns an error if
+// its input is invalid, which makes New fail.
+type Option func(*config) error
 
+// WithOpTimeout sets the deadline of each operation. Methods taking a
+// context whose deadline is set use that deadline instead, longer or not.
 func WithOpTimeout(d time.Duration) Option {
-	return func(c *config) {
+	return func(c *config) error {
+		if d <= 0 {
+			return errors.New("op timeout must be positive")
+		}
 		c.opTimeout = d
+		return nil
 	}
 }
 
 func WithTxnTimeout(d time.Duration) Option {
-	return func(c *config) {
+	return func(c *config) error {
+		if d <= 0 {
+			return errors.New("txn timeout must be positive")
+		}
 		c.txnTimeout = d
+		return nil
 	}
 }
 
-func WithCollName(collName string) Option {
-	return func(c *config) {
+// WithCloseTimeout sets how long Close waits for the queries and
+// transactions in flight to finish before disconnecting the client.
+func WithCloseTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return errors.New("close timeout must be positive")
+		}
+		c.closeTimeout = d
+		return nil
+	}
+}
+
+// WithHealthCheck pings the primary every interval in the background, so
+// Healthy reports whether it's reachable. The deployment is considered
+// unhealthy after a few consecutive failed pings, and healthy again after
+// a successful one. Health checks are disabled by default.
+func WithHealthCheck(interval time.Duration) Option {
+	return func(c *config) error {
+		if interval <= 0 {
+			return errors.New("health check interval must be positive")
+		}
+		c.healthInterval = interval
+		return nil
+	}
+}
+
+// WithHealthCallback sets a function called by the health checks enabled
+// with WithHealthCheck when the deployment becomes unhealthy, with the
+// error of the last ping, and when it becomes healthy again. It's called
+// from the health check goroutine, so it shouldn't block.
+func WithHealthCallback(fn func(healthy bool, err error)) Option {
+	return func(c *config) error {
+		c.healthCallback = fn
+		return nil
+	}
+}
+
+// WithCircuitBreaker makes operations fail fast with ErrUnavailable during
+// MongoDB outages, instead of each of them waiting for its timeout. Once
+// threshold consecutive operations failed with a timeout or a network
+// error, operations fail right away for cooldown. Then a single operation
+// is let through to probe whether MongoDB is back, which closes the
+// breaker if it succeeds, and opens it again otherwise.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(c *config) error {
+		if threshold <= 0 {
+			return errors.New("circuit breaker threshold must be positive")
+		}
+		if cooldown <= 0 {
+			return errors.New("circuit breaker cooldown must be positive")
+		}
+		c.breakerThreshold = threshold
+		c.breakerCooldown = cooldown
+		return nil
+	}
+}
+
+// WithRateLimit limits the datastore to opsPerSec operations per second on
+// average, in bursts of up to a second worth of operations, so a batch job
+// can't overload a shared cluster. Operations over the limit wait for their
+// turn, or fail with the error of their context if it's done first.
+// Operations over many keys, such as queries, GetMany or DeletePrefix, count
+// as one, and so does each bulk write a batch flushes, as well as the
+// commit of a transaction apart from its operations.
+func WithRateLimit(opsPerSec int) Option {
+	return func(c *config) error {
+		if opsPerSec <= 0 {
+			return errors.New("rate limit must be positive")
+		}
+		c.rateLimit = opsPerSec
+		return nil
+	}
+}
+
+// WithReadRateLimit is like WithRateLimit, but only limits reads. It can
+// be combined with WithRateLimit and WithWriteRateLimit.
+func WithReadRateLimit(opsPerSec int) Option {
+	return func(c *config) error {
+		if opsPerSec <= 0 {
+			return errors.New("read rate limit must be positive")
+		}
+		c.readRateLimit = opsPerSec
+		return nil
+	}
+}
+
+// WithWriteRateLimit is like WithRateLimit, but only limits writes. It can
+// be combined with WithRateLimit and WithReadRateLimit.
+func WithWriteRateLimit(opsPerSec int) Option {
+	return func(c *config) error {
+		if opsPerSec <= 0 {
+			return errors.New("write rate limit must be positive")
+		}
+		c.writeRateLimit = opsPerSec
+		return nil
+	}
+}
+
+// WithQueryTimeout sets the deadline of queries, which is separate from
+// the op timeout so long scans aren't bounded by the timeout of point
+// reads. It bounds both running the query and waiting for each batch of
+// results, and is sent to the server as maxTimeMS. If the context passed
+// to a query has a deadline, that deadline applies instead.
+func WithQueryTimeout(d time.Duration) Option {
+	return func(c *config) error {
+		if d <= 0 {
+			return errors.New("query timeout must be positive")
+		}
+		c.queryTimeout = d
+		return nil
+	}
+}
+
+// WithTxnMaxAttempts sets how many times WithTransaction runs a transaction
+// that keeps failing with a transient error.
+func WithTxnMaxAttempts(n int) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return errors.New("txn max attempts must be at least 1")
+		}
+		c.txnMaxAttempts = n
+		return nil
+	}
+}
+
+// WithTxnBackoff sets how long WithTransaction waits before retrying a
+// transaction that failed with a transient error.
+func WithTxnBackoff(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return errors.New("txn backoff can't be negative")
+		}
+		c.txnBackoff = ConstantBackoff(d)
+		return nil
+	}
+}
+
+// WithTxnRetry sets how many times WithTransaction runs a transaction that
+// keeps failing with a transient error, and how long it waits before each
+// retry. By default, a transaction runs up to 3 times, with a jittered
+// exponential backoff starting at 10ms.
+func WithTxnRetry(maxAttempts int, backoff BackoffFunc) Option {
+	return func(c *config) error {
+		if maxAttempts < 1 {
+			return errors.New("txn max attempts must be at least 1")
+		}
+		if backoff == nil {
+			return errors.New("txn backoff can't be nil")
+		}
+		c.txnMaxAttempts = maxAttempts
+		c.txnBackoff = backoff
+		return nil
+	}
+}
+
+// WithTxnLeakWarn logs a warning for each transaction still open d after
+// it started, which usually was leaked without calling Commit nor Discard.
+// OldestTxnAge and the metrics report the age of the oldest transaction
+// regardless. Zero, the default, disables the warning.
+func WithTxnLeakWarn(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return errors.New("transaction leak warning threshold can't be negative")
+		}
+		c.txnLeakWarn = d
+		return nil
+	}
+}
+
+// WithTxnMaxLifetime makes a watchdog abort the transactions still open d
+// after they started, logging a warning, so the resources a leaked
+// transaction holds on the server are reclaimed. Using an aborted
+// transaction then returns ErrTxnFinalized, as if it was discarded. The
+// watchdog is serialized with the methods of the transaction, so a
+// commit either completes before it fires or fails with ErrTxnFinalized.
+// It must exceed the time transactions legitimately stay open. Zero, the
+// default, disables the watchdog.
+func WithTxnMaxLifetime(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return errors.New("transaction max lifetime can't be negative")
+		}
+		c.txnMaxLifetime = d
+		return nil
+	}
+}
+
+// WithTransactionFallback selects what NewTransaction does when the
+// deployment doesn't support transactions, such as a standalone server. If
+// enabled, it returns a transaction that queues its writes and applies them
+// with an ordered bulk write on Commit, and a warning is logged the first
+// time. The bulk write isn't atomic: if it fails, the writes that preceded
+// the failure stay applied. Discard drops the queued writes. Such
+// transactions serve reads, TTLs and many-key reads like real ones, seeing
+// their own queued writes, but queries don't see them, and they don't
+// implement the conditional and atomic extensions, such as CompareAndSwap
+// and Move. Otherwise, NewTransaction returns ErrTxnUnsupported.
+func WithTransactionFallback(enable bool) Option {
+	return func(c *config) error {
+		c.txnFallback = enable
+		return nil
+	}
+}
+
+// WithDatabase sets the name of the database holding the collection.
+func WithDatabase(dbName string) Option {
+	return func(c *config) error {
+		if dbName == "" {
+			return errors.New("database name can't be empty")
+		}
+		c.dbName = dbName
+		return nil
+	}
+}
+
+// WithCollection sets the name of the collection storing the key-values.
+func WithCollection(collName string) Option {
+	return func(c *config) error {
+		if collName == "" {
+			return errors.New("collection name can't be empty")
+		}
 		c.collName = collName
+		return nil
+	}
+}
+
+// WithCollName is an alias of WithCollection.
+//
+// Deprecated: use WithCollection.
+func WithCollName(collName string) Option {
+	return WithCollection(collName)
+}
+
+// WithReadConcern sets the read concern of the collection handle used by
+// the read methods and queries. Without it, the deployment default applies.
+// The linearizable level only holds for reads of a single document, so it
+// is rejected here, and WithLinearizableReads must be used instead.
+func WithReadConcern(rc *readconcern.ReadConcern) Option {
+	return func(c *config) error {
+		if rc == nil {
+			return errors.New("read concern can't be nil")
+		}
+		if rc.GetLevel() == readconcern.Linearizable().GetLevel() {
+			return errors.New("linearizable read concern must be set with WithLinearizableReads")
+		}
+		c.readConcern = rc
+		return nil
+	}
+}
+
+// WithWriteConcern sets the write concern of the collection handle used
+// by Put, Delete and batch flushes. Without it, the deployment default
+// applies, which makes the durability of a write depend on the server
+// configuration.
+func WithWriteConcern(wc *writeconcern.WriteConcern) Option {
+	return func(c *config) error {
+		if wc == nil {
+			return errors.New("write concern can't be nil")
+		}
+		c.writeConcern = wc
+		return nil
+	}
+}
+
+// WithReadPreference sets the read preference of non-transactional reads,
+// allowing them to target secondaries. Secondaries replicate asynchronously,
+// so such reads may not reflect the latest writes, even the caller's own.
+// Transactions always read from the primary.
+func WithReadPreference(pref *readpref.ReadPref) Option {
+	return func(c *config) error {
+		if pref == nil {
+			return errors.New("read preference can't be nil")
+		}
+		c.readPref = pref
+		return nil
+	}
+}
+
+// WithLinearizableReads makes Get and Has, outside of transactions and
+// causal sessions, read with the linearizable read concern. Such reads
+// return the latest write acknowledged by a majority before the read
+// began, even across a failover, and never a value that is later rolled
+// back. This only holds for single-document reads, so GetMany, GetSize and
+// queries are unaffected. Linearizable reads wait for a majority of the
+// replica set to confirm the primary, so they're notably slower, and
+// they can't target secondaries, which rules out WithReadPreference with
+// a mode other than primary.
+func WithLinearizableReads() Option {
+	return func(c *config) error {
+		c.linearizable = true
+		return nil
+	}
+}
+
+// WithMajorityQueries makes queries, including AggregateQuery,
+// QueryModifiedSince and the counts of CountPrefix, read with the majority
+// read concern outside of transactions, whatever WithReadConcern sets.
+// Results then only hold data acknowledged by a majority of the replica
+// set, which is never rolled back by a failover. The trade-off is
+// freshness: a write acknowledged with a weaker write concern may not be
+// visible to a query issued right after it, until it replicates. Reads of
+// the majority snapshot don't wait for replication, so the added latency
+// is low on a healthy replica set, but grows with replication lag. The
+// cursor still streams results, and the majority level is supported on
+// secondaries, so it combines with WithReadPreference.
+func WithMajorityQueries() Option {
+	return func(c *config) error {
+		c.majorityQueries = true
+		return nil
+	}
+}
+
+// WithBatchFlushThreshold sets the number of queued operations after which
+// a batch automatically flushes them to MongoDB and keeps accumulating.
+// Since a batch may be flushed in several steps, it loses all-or-nothing
+// atomicity once auto-flush kicks in. A value <= 0 disables auto-flush.
+func WithBatchFlushThreshold(n int) Option {
+	return func(c *config) error {
+		c.batchFlushThreshold = n
+		return nil
+	}
+}
+
+// WithUnorderedBatch makes batches flush with unordered bulk writes. MongoDB
+// then keeps applying the remaining operations when one of them fails, and
+// Commit reports all the failures at once.
+func WithUnorderedBatch(unordered bool) Option {
+	return func(c *config) error {
+		c.unorderedBatch = unordered
+		return nil
+	}
+}
+
+// WithBatchConcurrency makes unordered batches flush their operations in
+// chunks written by up to n concurrent bulk writes, which speeds up large
+// loads when the connection pool and the deployment can take them. It has
+// no effect on ordered batches, whose operations must be applied in order.
+func WithBatchConcurrency(n int) Option {
+	return func(c *config) error {
+		if n < 1 {
+			return fmt.Errorf("batch concurrency must be at least 1, got %d", n)
+		}
+		c.batchConcurrency = n
+		return nil
+	}
+}
+
+// WithTTLIndex creates a TTL index on the expiration field when the
+// datastore is built, so MongoDB removes keys stored with a TTL once
+// they expire.
+func WithTTLIndex(enable bool) Option {
+	return func(c *config) error {
+		c.ttlIndex = enable
+		return nil
+	}
+}
+
+// WithEnsureIndexes controls whether the datastore creates the indexes the
+// enabled options rely on when it's built, which is the default. Either
+// way, the indexes of the collection are checked and a warning is logged
+// for each one that is missing or exists with other options than expected.
+// Disabling it lets users without the privilege to create indexes open a
+// datastore whose indexes are managed separately.
+func WithEnsureIndexes(ensure bool) Option {
+	return func(c *config) error {
+		c.ensureIndexes = ensure
+		return nil
+	}
+}
+
+// WithMetrics registers Prometheus collectors in registerer and instruments
+// the datastore operations with request counters and latency histograms
+// labeled by operation and outcome, plus gauges of the number of open
+// transactions and of the age of the oldest one.
+func WithMetrics(registerer prometheus.Registerer) Option {
+	return func(c *config) error {
+		if registerer == nil {
+			return errors.New("metrics registerer can't be nil")
+		}
+		c.metricsRegisterer = registerer
+		return nil
+	}
+}
+
+// WithTracerProvider sets the OpenTelemetry provider of the tracer creating
+// a span for each operation. It defaults to the global provider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) error {
+		if tp == nil {
+			return errors.New("tracer provider can't be nil")
+		}
+		c.tracerProvider = tp
+		return nil
+	}
+}
+
+// WithTraceKeyRedaction hides the keys recorded in span attributes.
+func WithTraceKeyRedaction(redact bool) Option {
+	return func(c *config) error {
+		c.redactKeys = redact
+		return nil
+	}
+}
+
+// WithSlowOpThreshold logs a warning for every operation that takes longer
+// than d, with its name, key or query prefix and duration. Zero disables it.
+func WithSlowOpThreshold(d time.Duration) Option {
+	return func(c *config) error {
+		if d < 0 {
+			return errors.New("slow op threshold can't be negative")
+		}
+		c.slowOpThreshold = d
+		return nil
+	}
+}
+
+// WithLogger makes the datastore log to l instead of the package logger.
+func WithLogger(l Logger) Option {
+	return func(c *config) error {
+		if l == nil {
+			return errors.New("logger can't be nil")
+		}
+		c.logger = l
+		return nil
+	}
+}
+
+// WithGridFSThreshold stores values larger than n bytes in GridFS instead
+// of inline, so they aren't bound by the 16MB document size limit. The
+// collection keeps a pointer document, and reads download the value
+// transparently. Keep n comfortably below 16MB, e.g. 12MB, since the
+// document also holds the key. Zero, the default, disables GridFS.
+//
+// Files replaced or deleted by batches and transactions, or whose key
+// expired, are removed by CollectGarbage. While GridFS is enabled, value
+// filters are always applied client-side.
+func WithGridFSThreshold(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return errors.New("gridfs threshold can't be negative")
+		}
+		c.gridfsThreshold = n
+		return nil
+	}
+}
+
+// WithGridFSBucket sets the name of the GridFS bucket storing the values
+// above the GridFS threshold. It defaults to "mongods".
+func WithGridFSBucket(name string) Option {
+	return func(c *config) error {
+		if name == "" {
+			return errors.New("gridfs bucket name can't be empty")
+		}
+		c.gridfsBucket = name
+		return nil
+	}
+}
+
+// WithCompression compresses values with codec before storing them, and
+// decompresses them on reads. Each document records whether its value was
+// compressed, so documents written without compression, or whose value
+// didn't shrink, are still read as is. GetSize and query sizes report the
+// decompressed size. While compression is enabled, value filters are
+// always applied client-side.
+func WithCompression(codec Codec) Option {
+	return func(c *config) error {
+		if codec == nil {
+			return errors.New("compression codec can't be nil")
+		}
+		if codec.Name() == "" {
+			return errors.New("compression codec name can't be empty")
+		}
+		c.codec = codec
+		return nil
+	}
+}
+
+// WithEncryption encrypts values with aead before storing them, and
+// decrypts them on reads. Each document stores a random nonce, and the
+// ciphertext is bound to its key so it can't be moved to another one.
+// Keys aren't encrypted: they're stored in plaintext in _id, since
+// lookups, ordering and prefix queries depend on them. Values that can't
+// be decrypted, e.g. because the datastore is configured with another
+// key, fail with an error wrapping ErrDecryption. While encryption is
+// enabled, value filters are always applied client-side.
+func WithEncryption(aead cipher.AEAD) Option {
+	return func(c *config) error {
+		if aead == nil {
+			return errors.New("encryption aead can't be nil")
+		}
+		c.aead = aead
+		return nil
+	}
+}
+
+// WithValueIndex creates a compound index on the value and the key when
+// the datastore is built, so queries matching a value within a prefix,
+// through an equality filter, are backed by an index rather than scanning
+// every key below the prefix. It helps when such queries are frequent and
+// values are small, as the index holds a copy of each value. Ordering by
+// value still happens client-side: MongoDB orders binary values by length
+// before their bytes, unlike datastore queries. Values stored in GridFS,
+// compressed or encrypted aren't stored as is, so the index is useless then.
+func WithValueIndex(enable bool) Option {
+	return func(c *config) error {
+		c.valueIndex = enable
+		return nil
+	}
+}
+
+// WithPrefixField stores in each document the prefixes its key is below,
+// in an indexed field, so prefix queries are served by equality lookups
+// on the field instead of ranges over _id. Lookups are faster and more
+// predictable on large collections, at the cost of a few bytes per level
+// of depth of the keys. When enabling it on an existing collection, run
+// MigratePrefixField so the documents already stored match prefix queries.
+func WithPrefixField(enable bool) Option {
+	return func(c *config) error {
+		c.prefixField = enable
+		return nil
+	}
+}
+
+// WithKeyHashing stores keys longer than threshold bytes under their
+// SHA-256 hash in _id, keeping the full key in a separate indexed field,
+// so they don't exceed the size MongoDB allows for indexed values. Shorter
+// keys are still stored as is. Prefix queries match hashed keys by their
+// full key, but hashed keys no longer sort lexicographically: queries
+// ordered by key return them apart from the other keys, and key filters
+// are applied client-side. Zero, the default, disables hashing.
+func WithKeyHashing(threshold int) Option {
+	return func(c *config) error {
+		if threshold < 0 {
+			return errors.New("key hashing threshold can't be negative")
+		}
+		c.keyHashThreshold = threshold
+		return nil
+	}
+}
+
+// WithKeyCodec sets the KeyCodec mapping keys to the _id of documents,
+// StringKeyCodec by default. With any other codec, queries match prefixes
+// and compare and order keys by the full key, which every document then
+// stores in an indexed field, rather than by _id. Key hashing is only
+// supported with StringKeyCodec. Changing the codec of a collection
+// storing data makes its keys unreachable, unless they're migrated.
+func WithKeyCodec(kc KeyCodec) Option {
+	return func(c *config) error {
+		if kc == nil {
+			return errors.New("key codec can't be nil")
+		}
+		c.keyCodec = kc
+		return nil
+	}
+}
+
+// WithShardKey makes every document store, in field, a value derived from
+// its key: a prefix of the hash of the key, which spreads keys evenly. The
+// value is included in the filters of the operations on single keys, so
+// that, once the collection is sharded on {field: 1}, mongos routes them
+// to the shard holding the key instead of broadcasting them, as the
+// transactions and single-document writes on sharded collections require.
+// Queries over a prefix still target every shard. The collection must be
+// sharded on that key, which this package doesn't do. Enabling it on a
+// collection already storing data makes the keys that don't have the
+// field yet unreachable. The field has the same restrictions as the one
+// of WithValueField.
+func WithShardKey(field string) Option {
+	return func(c *config) error {
+		if field == "" || strings.HasPrefix(field, "$") || strings.Contains(field, ".") {
+			return fmt.Errorf("invalid shard key field %q", field)
+		}
+		if reservedFields[field] {
+			return fmt.Errorf("shard key field %q is reserved", field)
+		}
+		c.shardKey = field
+		return nil
+	}
+}
+
+// WithNamespace scopes the datastore to the namespace ns, so datastores
+// with different namespaces can share a collection without seeing each
+// other's keys. The namespace, normalized as a key and enclosed in '!', is
+// prepended to the _id of every key stored, and stripped from the keys
+// returned. The delimiter keeps nested namespaces such as /a and /a/b
+// apart, and since datastore keys start with '/', a datastore without a
+// namespace doesn't see the keys of namespaced ones either.
+func WithNamespace(ns string) Option {
+	return func(c *config) error {
+		p := datastore.NewKey(ns).String()
+		if p == "/" {
+			return errors.New("namespace can't be empty")
+		}
+		if strings.Contains(p, namespaceDelim) {
+			return fmt.Errorf("namespace %q can't contain %q", ns, namespaceDelim)
+		}
+		c.namespace = namespaceDelim + p + namespaceDelim
+		return nil
+	}
+}
+
+// WithAllowDropAll enables DropAll, which is disabled by default so the
+// data can't be wiped accidentally.
+func WithAllowDropAll(allow bool) Option {
+	return func(c *config) error {
+		c.allowDropAll = allow
+		return nil
+	}
+}
+
+// WithCursorBatchSize sets how many documents the server returns per
+// round-trip while iterating query results. Since results are consumed
+// lazily, it also bounds how many documents are buffered in memory. Zero,
+// the default, lets the server decide.
+func WithCursorBatchSize(n int) Option {
+	return func(c *config) error {
+		if n < 0 || n > math.MaxInt32 {
+			return errors.New("cursor batch size must be between 0 and MaxInt32")
+		}
+		c.cursorBatchSize = int32(n)
+		return nil
+	}
+}
+
+// WithMaxNaiveResults bounds how many entries a query may buffer in memory.
+// Results are streamed from the cursor, except for queries ordered in a way
+// MongoDB can't sort, such as by value, which are sorted client-side once
+// every entry is loaded. Such a query fails with ErrTooManyResults once more
+// than n entries match it, instead of exhausting memory on an accidental
+// unfiltered scan. Zero, the default, doesn't set any bound.
+func WithMaxNaiveResults(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return errors.New("max naive results can't be negative")
+		}
+		c.maxNaiveResults = n
+		return nil
+	}
+}
+
+// WithValueField sets the field of the documents storing values, "v" by
+// default, to share the collection with tools expecting another name. It
+// can't be a field the datastore already uses, such as _id, nor contain a
+// dot or start with a dollar sign. Changing it doesn't migrate the values
+// already stored under the previous name.
+func WithValueField(name string) Option {
+	return func(c *config) error {
+		if name == "" || strings.HasPrefix(name, "$") || strings.Contains(name, ".") {
+			return fmt.Errorf("invalid value field %q", name)
+		}
+		if reservedFields[name] {
+			return fmt.Errorf("value field %q is reserved", name)
+		}
+		c.valueField = name
+		return nil
+	}
+}
+
+// WithTimestamps makes writes record when keys were created, and when
+// their value was last written, as returned by GetMeta and relied on by
+// QueryModifiedSince. Changing only the expiration of a key doesn't count
+// as a write. Keys written while timestamps were disabled have no
+// timestamps until they're written again.
+func WithTimestamps(enabled bool) Option {
+	return func(c *config) error {
+		c.timestamps = enabled
+		return nil
+	}
+}
+
+// WithSlidingTTL makes Get push the expiration of the keys it reads back
+// to idle from now, so keys expire once they haven't been read for idle,
+// as in a cache. Only keys that already expire are touched, and their
+// expiration is never brought closer. Reads within transactions and causal
+// sessions don't touch keys. Each read of an expiring key costs an extra
+// write, which is why it's disabled by default.
+func WithSlidingTTL(idle time.Duration) Option {
+	return func(c *config) error {
+		if idle <= 0 {
+			return errors.New("sliding ttl must be positive")
+		}
+		c.slidingTTL = idle
+		return nil
+	}
+}
+
+// WithCollation makes the datastore compare and order keys with c, such as
+// a locale-aware or case-insensitive ordering, instead of byte-wise. The
+// collation is the default of the collection, set when it's created, so it
+// applies to its indexes and to every operation alike: queries ordered by
+// key come sorted by the server and key comparisons are run by it as well.
+// An existing collection must have been created with the same collation.
+// Collations of strength 1 or 2 make the keys differing only by accents or
+// case equal, so they collapse into the key first written. Prefix matches
+// follow the same equality: they ignore accents and case at strength 1,
+// only case at strength 2, and are exact at strength 3 and above, as the
+// strings only alike under the collation are then filtered out with a
+// regular expression. Orders that are done client-side, such as orders by
+// value, still break ties between keys byte-wise. Strength 1 can't be used
+// along with key hashing or encryption.
+//
+// Collated comparisons are noticeably slower than byte-wise ones, for both
+// index lookups and sorts, and prefix scans pay for the regular expression
+// as well. Collations ignoring punctuation, with alternate "shifted", would
+// ignore the separators of keys, so they're rejected.
+func WithCollation(c *options.Collation) Option {
+	return func(cfg *config) error {
+		if c == nil || c.Locale == "" {
+			return errors.New("collation must have a locale")
+		}
+		if c.Alternate == "shifted" {
+			return errors.New("collations ignoring punctuation aren't supported")
+		}
+		cfg.collation = c
+		return nil
+	}
+}
+
+// WithCaseInsensitiveKeys makes keys that only differ by case the same key,
+// so a value written under "/A" is read, overwritten or deleted as "/a".
+// Keys are compared with a case-insensitive collation of strength 2, set
+// with WithCollation, or with the "en" locale by default. The stored key
+// keeps the case of the first write: queries return it as such, and prefix
+// matches ignore case as well. Keys whose case differs collapse into one,
+// so they must be treated as the same by the application. The collation is
+// only set when the collection is created, so it can't be enabled on an
+// existing collection.
+func WithCaseInsensitiveKeys(enabled bool) Option {
+	return func(c *config) error {
+		c.caseInsensitiveKeys = enabled
+		return nil
+	}
+}
+
+// WithWriteRetries makes Put, Delete and the flushes of batches retry up
+// to n times, with an exponential backoff, when they fail with an error
+// MongoDB or the driver labeled RetryableWriteError, such as a network
+// error. The driver already retries such writes once, and this keeps
+// retrying on flakier networks. Retries stop at the deadline of the
+// operation. Since a failed attempt may have been applied nonetheless,
+// writes of values read the version of the value they replace first and
+// only apply to that version, so the version is incremented only once; a
+// value written concurrently in between supersedes the retried one.
+// Deletions aren't retried when GridFS is enabled, which would leave the
+// file of the value behind. Writes within transactions aren't retried
+// either, since WithTransaction retries the whole transaction. By
+// default, writes aren't retried.
+func WithWriteRetries(n int) Option {
+	return func(c *config) error {
+		if n < 0 {
+			return fmt.Errorf("write retries can't be negative, got %d", n)
+		}
+		c.writeRetries = n
+		return nil
 	}
 }
@@ -0,0 +1,78 @@
+package mongods
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore/query"
+	dsextensions "github.com/textileio/go-datastore-extensions"
+)
+
+// ErrPageToken is returned by QueryPage when given a token it didn't issue.
+var ErrPageToken = errors.New("invalid page token")
+
+// QueryPage returns the page of at most pageSize entries matching q that
+// follows the page token was returned with. An empty token starts at the
+// first page, and an empty nextToken is returned with the last page.
+//
+// Pages are delimited by the key of their last entry rather than by an
+// offset, so fetching a page doesn't skip over the previous ones, and
+// paging neither repeats nor misses entries as keys are added or removed
+// before the current page. Pages are therefore sorted by key: q can only
+// be ordered by ascending or descending key, and can't have an offset nor
+// a limit.
+func (m *MongoDS) QueryPage(ctx context.Context, q query.Query, token string, pageSize int) (entries []query.Entry, nextToken string, err error) {
+	if pageSize <= 0 {
+		return nil, "", errors.New("page size must be positive")
+	}
+	if q.Offset != 0 || q.Limit != 0 {
+		return nil, "", errors.New("paged queries can't have an offset nor a limit")
+	}
+	asc, ok := keyOrder(q.Orders)
+	if !ok {
+		return nil, "", errors.New("paged queries must be ordered by key")
+	}
+
+	if token != "" {
+		after, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil || len(after) == 0 {
+			return nil, "", ErrPageToken
+		}
+		op := query.GreaterThan
+		if !asc {
+			op = query.LessThan
+		}
+		q.Filters = append(append([]query.Filter(nil), q.Filters...), query.FilterKeyCompare{Op: op, Key: string(after)})
+	}
+	// One more entry is fetched to know if there's a next page.
+	q.Limit = pageSize + 1
+
+	res, err := m.pageResults(ctx, q)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Close()
+	if entries, err = res.Rest(); err != nil {
+		return nil, "", fmt.Errorf("reading page: %w", err)
+	}
+	if len(entries) > pageSize {
+		entries = entries[:pageSize]
+		nextToken = base64.RawURLEncoding.EncodeToString([]byte(entries[pageSize-1].Key))
+	}
+	return entries, nextToken, nil
+}
+
+// pageResults starts the query of a page. The lock is only held while
+// starting the query, as for Export.
+func (m *MongoDS) pageResults(ctx context.Context, q query.Query) (query.Results, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	ctx, cls := withTimeout(ctx, m.queryTimeout)
+	defer cls()
+	return m.runQuery(ctx, dsextensions.QueryExt{Query: q}, queryConfig{})
+}
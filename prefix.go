@@ -0,0 +1,108 @@
+package mongods
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ancestors returns the prefixes key is strictly below, as they're stored
+// in the prefix field, leaving out the root which every key is below.
+func (m *MongoDS) ancestors(key datastore.Key) bson.A {
+	prefixes := bson.A{}
+	for p := key.Parent(); p.String() != "/"; p = p.Parent() {
+		prefixes = append(prefixes, m.namespace+p.String())
+	}
+	return prefixes
+}
+
+// prefixIndex is the index serving prefix queries from the prefix field.
+// Since the field is an array, each document is indexed under each of its
+// ancestors, and then by _id so the matches of a prefix are ordered by key.
+func prefixIndex() mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.D{{Key: "p", Value: 1}, {Key: "_id", Value: 1}},
+		Options: options.Index().SetName("p_id"),
+	}
+}
+
+// MigratePrefixField sets the prefix field of the documents stored before
+// WithPrefixField was enabled, and returns how many were updated. Prefix
+// queries don't match such documents until they're migrated, so it should
+// run right after enabling the option on an existing collection. It can
+// safely run again, or concurrently with writes, as documents that already
+// have the field are skipped.
+func (m *MongoDS) MigratePrefixField(ctx context.Context) (int, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+	if !m.prefixField {
+		return 0, fmt.Errorf("prefix field isn't enabled")
+	}
+	return m.migratePrefixField(ctx)
+}
+
+func (m *MongoDS) migratePrefixField(ctx context.Context) (_ int, err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return 0, err
+	}
+	ctx, end := m.startOp(ctx, "migratePrefixField", "")
+	defer end(&err)
+
+	// The root range matches every datastore key regardless of the
+	// prefix field, and leaves out internal documents.
+	filter := bson.M{"$and": bson.A{
+		m.keyFilter(m.prefixRange("/")),
+		bson.M{"p": bson.M{"$exists": false}},
+	}}
+	migrated := 0
+	for {
+		fctx, cls := context.WithTimeout(ctx, m.opTimeout)
+		cur, err := m.col.Find(fctx, filter, options.Find().SetProjection(keysProjection).SetLimit(gcBatchSize))
+		if err != nil {
+			cls()
+			return migrated, fmt.Errorf("finding documents to migrate: %w", err)
+		}
+		var kvs []keyValue
+		err = cur.All(fctx, &kvs)
+		if err != nil {
+			cls()
+			return migrated, fmt.Errorf("decoding documents to migrate: %w", err)
+		}
+		if len(kvs) == 0 {
+			cls()
+			return migrated, nil
+		}
+
+		models := make([]mongo.WriteModel, len(kvs))
+		for i, kv := range kvs {
+			k, err := m.kvKey(kv)
+			if err != nil {
+				cls()
+				return migrated, err
+			}
+			key := datastore.RawKey(k)
+			match, err := m.docFilter(key)
+			if err != nil {
+				cls()
+				return migrated, err
+			}
+			match["p"] = bson.M{"$exists": false}
+			models[i] = mongo.NewUpdateOneModel().
+				SetFilter(match).
+				SetUpdate(bson.M{"$set": bson.M{"p": m.ancestors(key)}})
+		}
+		res, err := m.col.BulkWrite(fctx, models, options.BulkWrite().SetOrdered(false))
+		cls()
+		if err != nil {
+			return migrated, fmt.Errorf("migrating documents: %w", err)
+		}
+		migrated += int(res.ModifiedCount)
+	}
+}
@@ -0,0 +1,87 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore/query"
+	"github.com/jbenet/goprocess"
+	dsextensions "github.com/textileio/go-datastore-extensions"
+)
+
+// ErrTooManyResults is returned by the queries that would buffer more
+// entries than allowed by WithMaxNaiveResults.
+var ErrTooManyResults = errors.New("query matches too many entries to be sorted in memory")
+
+// QueryOption configures a query run by QueryWithOptions.
+type QueryOption func(*queryConfig)
+
+type queryConfig struct {
+	hint string
+}
+
+// WithHint makes the query use the index named index, for the queries the
+// planner runs with a poor index. The query fails if there's no such index.
+func WithHint(index string) QueryOption {
+	return func(c *queryConfig) {
+		c.hint = index
+	}
+}
+
+// QueryWithOptions runs q as QueryExtended does, configured by opts.
+func (m *MongoDS) QueryWithOptions(q dsextensions.QueryExt, opts ...QueryOption) (query.Results, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	ctx, cls := context.WithTimeout(context.Background(), m.queryTimeout)
+	defer cls()
+
+	return m.query(ctx, q, opts...)
+}
+
+// QueryWithOptions runs q as QueryExtended does, configured by opts.
+func (t *mongoTxn) QueryWithOptions(q dsextensions.QueryExt, opts ...QueryOption) (query.Results, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	ctx, cls := t.sessionCtxTimeout(t.ctx, t.m.queryTimeout)
+	defer cls()
+	return t.m.query(ctx, q, opts...)
+}
+
+// capResults returns the results of res, failing with ErrTooManyResults
+// once more than n entries were read from it.
+func capResults(res query.Results, n int) query.Results {
+	return query.ResultsWithProcess(res.Query(), func(worker goprocess.Process, out chan<- query.Result) {
+		defer res.Close()
+		count := 0
+		for count <= n {
+			var r query.Result
+			select {
+			case <-worker.Closing():
+				return
+			case next, ok := <-res.Next():
+				if !ok {
+					return
+				}
+				r = next
+			}
+			if r.Error == nil {
+				if count++; count > n {
+					r = query.Result{Error: fmt.Errorf("%w: more than %d", ErrTooManyResults, n)}
+				}
+			}
+			select {
+			case out <- r:
+			case <-worker.Closing():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package mongods
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// opKind tells reads and writes apart, which can be rate limited
+// separately.
+type opKind int
+
+const (
+	readOp opKind = iota
+	writeOp
+)
+
+// admit waits for the rate limiters to let an operation of the given kind
+// through, then checks that the circuit breaker doesn't fail it fast. The
+// breaker is checked last, so an operation it lets through as a probe
+// always runs.
+func (m *MongoDS) admit(ctx context.Context, kind opKind) error {
+	if err := m.opLimit.wait(ctx); err != nil {
+		return err
+	}
+	limit := m.readLimit
+	if kind == writeOp {
+		limit = m.writeLimit
+	}
+	if err := limit.wait(ctx); err != nil {
+		return err
+	}
+	return m.breaker.allow()
+}
+
+// rateLimiter is a token bucket letting through up to rate operations per
+// second on average, in bursts of up to a second worth of operations. A nil
+// limiter lets every operation through.
+type rateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(opsPerSec int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(opsPerSec),
+		burst:  float64(opsPerSec),
+		tokens: float64(opsPerSec),
+		last:   time.Now(),
+	}
+}
+
+// wait takes a token, waiting for one to be available if needed. It
+// returns the error of ctx if it's done first, or if its deadline would
+// expire before a token is available.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	delay := l.reserve()
+	if delay <= 0 {
+		return nil
+	}
+	if dl, ok := ctx.Deadline(); ok && time.Until(dl) < delay {
+		l.cancel()
+		return context.DeadlineExceeded
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	}
+}
+
+// reserve takes a token, which may not be available yet, and returns how
+// long to wait until it is.
+func (l *rateLimiter) reserve() time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel gives back a reserved token that won't be used.
+func (l *rateLimiter) cancel() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tokens++
+}
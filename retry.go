@@ -0,0 +1,200 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
+)
+
+// writeRetryBackoff is the backoff between the retries of WithWriteRetries.
+var writeRetryBackoff = ExponentialBackoff(10*time.Millisecond, 500*time.Millisecond)
+
+// retryWrite runs write, and runs it again up to the configured number of
+// write retries while it fails with an error labeled RetryableWriteError.
+// Since an attempt that failed may have been applied nonetheless, write
+// must have the same result if it's applied twice.
+// Writes within a transaction aren't retried, since the transaction is
+// retried as a whole. No retry is attempted if its backoff would end past the
+// deadline of ctx, in which case the last error is returned.
+func (m *MongoDS) retryWrite(ctx context.Context, write func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil || attempt > m.writeRetries || inTransaction(ctx) || !hasErrorLabel(err, driver.RetryableWriteError) {
+			return err
+		}
+		delay := writeRetryBackoff(attempt)
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) < delay {
+			return err
+		}
+		m.logger.Debugf("retrying retryable write error (attempt %d): %s", attempt, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// retriesWrites returns true if the writes made with ctx may be retried,
+// in which case the upserts of values must be pinned to the version they
+// replace to be safe to apply twice.
+func (m *MongoDS) retriesWrites(ctx context.Context) bool {
+	return m.writeRetries > 0 && !inTransaction(ctx)
+}
+
+// pinVersions returns ops, with the upserts writing values, which
+// increment their version, replaced by upserts that can be applied twice:
+// they only match the document at the version read beforehand, and set
+// the next version instead. Once an attempt is applied, applying it again
+// upserts a document with the same _id, which fails with a duplicate key
+// error, as it does if a concurrent write replaced the value since the
+// version was read, in which case the upsert is ordered before it. pinned
+// reports which operations were replaced.
+func (m *MongoDS) pinVersions(ctx context.Context, ops []mongo.WriteModel) (_ []mongo.WriteModel, pinned []bool, err error) {
+	var filters bson.A
+	for _, op := range ops {
+		if u, ok := op.(*mongo.UpdateOneModel); ok && incrementsVersion(u) {
+			filters = append(filters, u.Filter)
+		}
+	}
+	pinned = make([]bool, len(ops))
+	if len(filters) == 0 {
+		return ops, pinned, nil
+	}
+
+	// A stale version would never match, so it's read from the primary.
+	opts := options.Find().SetProjection(bson.M{"ver": 1})
+	cur, err := m.col.Find(ctx, bson.M{"$or": filters}, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("finding versions: %w", err)
+	}
+	defer func() {
+		if err := cur.Close(ctx); err != nil {
+			m.logger.Errorf("closing cursor: %s", err)
+		}
+	}()
+	versions := make(map[string]int64, len(filters))
+	for cur.Next(ctx) {
+		var doc struct {
+			ID      bson.RawValue `bson:"_id"`
+			Version int64         `bson:"ver"`
+		}
+		if err := cur.Decode(&doc); err != nil {
+			return nil, nil, fmt.Errorf("decoding version: %w", err)
+		}
+		versions[string(append([]byte{byte(doc.ID.Type)}, doc.ID.Value...))] = doc.Version
+	}
+	if err := cur.Err(); err != nil {
+		return nil, nil, fmt.Errorf("iterating versions: %w", err)
+	}
+
+	res := make([]mongo.WriteModel, len(ops))
+	for i, op := range ops {
+		u, ok := op.(*mongo.UpdateOneModel)
+		if !ok || !incrementsVersion(u) {
+			res[i] = op
+			continue
+		}
+		t, id, err := bson.MarshalValue(u.Filter.(bson.M)["_id"])
+		if err != nil {
+			return nil, nil, fmt.Errorf("encoding _id: %w", err)
+		}
+		res[i] = pinVersion(u, versions[string(append([]byte{byte(t)}, id...))])
+		pinned[i] = true
+	}
+	return res, pinned, nil
+}
+
+// pinUpsert returns the upsert of update on the document filter matches,
+// pinned to the version of the value it replaces.
+func (m *MongoDS) pinUpsert(ctx context.Context, filter, update bson.M) (*mongo.UpdateOneModel, error) {
+	u := mongo.NewUpdateOneModel().SetFilter(filter).SetUpdate(update).SetUpsert(true)
+	ops, _, err := m.pinVersions(ctx, []mongo.WriteModel{u})
+	if err != nil {
+		return nil, err
+	}
+	return ops[0].(*mongo.UpdateOneModel), nil
+}
+
+// incrementsVersion returns true if u is an upsert writing a value, as
+// returned by putModel, which increments the version of the value.
+func incrementsVersion(u *mongo.UpdateOneModel) bool {
+	if _, ok := u.Filter.(bson.M); !ok {
+		return false
+	}
+	update, ok := u.Update.(bson.M)
+	if !ok {
+		return false
+	}
+	_, ok = update["$inc"]
+	return ok
+}
+
+// pinVersion returns a copy of the upsert u, writing a value, that only
+// matches the document at version ver, 0 if it isn't stored, and sets the
+// next version instead of incrementing it.
+func pinVersion(u *mongo.UpdateOneModel, ver int64) *mongo.UpdateOneModel {
+	filter := bson.M{"ver": ver}
+	if ver == 0 {
+		filter["ver"] = bson.M{"$exists": false}
+	}
+	for f, v := range u.Filter.(bson.M) {
+		filter[f] = v
+	}
+	update := bson.M{}
+	for op, fields := range u.Update.(bson.M) {
+		if op != "$inc" {
+			update[op] = fields
+		}
+	}
+	set := bson.M{"ver": ver + 1}
+	if fields, ok := update["$set"].(bson.M); ok {
+		for f, v := range fields {
+			set[f] = v
+		}
+	}
+	update["$set"] = set
+
+	p := *u
+	p.Filter = filter
+	p.Update = update
+	return &p
+}
+
+// bulkWritePinned runs ops, as returned by pinVersions, in a bulk write,
+// ignoring the duplicate key errors of the pinned upserts, which were
+// applied already or superseded. An ordered bulk write stops at such an
+// error, so the operations after it are written again.
+func (m *MongoDS) bulkWritePinned(ctx context.Context, ops []mongo.WriteModel, pinned []bool, opts *options.BulkWriteOptions) error {
+	ordered := opts.Ordered == nil || *opts.Ordered
+	for from := 0; from < len(ops); {
+		_, err := m.col.BulkWrite(ctx, ops[from:], opts)
+		var bwe mongo.BulkWriteException
+		if err == nil || !errors.As(err, &bwe) || bwe.WriteConcernError != nil || len(bwe.WriteErrors) == 0 {
+			return offsetWriteErrors(err, from)
+		}
+		var left []mongo.BulkWriteError
+		for _, we := range bwe.WriteErrors {
+			if !pinned[from+we.Index] || !mongo.IsDuplicateKeyError(mongo.WriteException{WriteErrors: mongo.WriteErrors{we.WriteError}}) {
+				left = append(left, we)
+			}
+		}
+		if len(left) > 0 {
+			bwe.WriteErrors = left
+			return offsetWriteErrors(bwe, from)
+		}
+		if !ordered {
+			return nil
+		}
+		from += bwe.WriteErrors[0].Index + 1
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package mongods
+
+import (
+	"reflect"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsoncodec"
+)
+
+// defaultValueField is the field storing values unless WithValueField
+// configures another one.
+const defaultValueField = "v"
+
+// reservedFields are the fields of the documents the datastore stores
+// besides the value, which can't hold the value.
+var reservedFields = map[string]bool{
+	"_id":      true,
+	"k":        true,
+	"p":        true,
+	"t":        true,
+	"expireAt": true,
+	"f":        true,
+	"c":        true,
+	"n":        true,
+	"e":        true,
+	"s":        true,
+
+	"ver":       true,
+	"createdAt": true,
+	"updatedAt": true,
+}
+
+// kvRegistry returns the BSON registry of a datastore storing values in
+// field, which maps the value of keyValue to field.
+func kvRegistry(field string) (*bsoncodec.Registry, error) {
+	parser := bsoncodec.StructTagParserFunc(func(sf reflect.StructField) (bsoncodec.StructTags, error) {
+		tags, err := bsoncodec.DefaultStructTagParser(sf)
+		if err == nil && tags.Name == defaultValueField {
+			tags.Name = field
+		}
+		return tags, err
+	})
+	codec, err := bsoncodec.NewStructCodec(parser)
+	if err != nil {
+		return nil, err
+	}
+	t := reflect.TypeOf(keyValue{})
+	return bson.NewRegistryBuilder().
+		RegisterTypeEncoder(t, codec).
+		RegisterTypeDecoder(t, codec).
+		Build(), nil
+}
@@ -0,0 +1,120 @@
+package mongods
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CausalSession runs operations on a causally consistent session, so each
+// read observes the writes done before it on the same session, without the
+// overhead of a transaction. Operations aren't atomic together. A session
+// isn't meant to be used concurrently, so calls are serialized.
+type CausalSession struct {
+	lock   sync.Mutex
+	closed bool
+
+	m       *MongoDS
+	session mongo.Session
+}
+
+// NewCausalSession starts a causally consistent session. It must be closed
+// once done with it to release the server resources, and Close waits for
+// it.
+func (m *MongoDS) NewCausalSession(ctx context.Context) (*CausalSession, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	session, err := m.m.StartSession(options.Session().SetCausalConsistency(true))
+	if err != nil {
+		return nil, fmt.Errorf("starting mongo session: %w", err)
+	}
+	// The session is in flight until it's closed.
+	m.active.Add(1)
+	return &CausalSession{m: m, session: session}, nil
+}
+
+// sessionCtx returns a context that runs operations within the session,
+// canceled along with parent and bounded by its deadline, or by the op
+// timeout if it has none.
+func (s *CausalSession) sessionCtx(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cls := withTimeout(parent, s.m.opTimeout)
+	return mongo.NewSessionContext(ctx, s.session), cls
+}
+
+func (s *CausalSession) Get(ctx context.Context, key datastore.Key) ([]byte, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	ctx, cls := s.sessionCtx(ctx)
+	defer cls()
+	return s.m.get(ctx, key)
+}
+
+func (s *CausalSession) Has(ctx context.Context, key datastore.Key) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return false, ErrClosed
+	}
+	ctx, cls := s.sessionCtx(ctx)
+	defer cls()
+	return s.m.has(ctx, key)
+}
+
+func (s *CausalSession) GetSize(ctx context.Context, key datastore.Key) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	ctx, cls := s.sessionCtx(ctx)
+	defer cls()
+	return s.m.getSize(ctx, key)
+}
+
+func (s *CausalSession) Put(ctx context.Context, key datastore.Key, val []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	ctx, cls := s.sessionCtx(ctx)
+	defer cls()
+	return s.m.put(ctx, key, val)
+}
+
+func (s *CausalSession) Delete(ctx context.Context, key datastore.Key) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	ctx, cls := s.sessionCtx(ctx)
+	defer cls()
+	return s.m.delete(ctx, key)
+}
+
+// Close ends the session. Closing it again is a no-op.
+func (s *CausalSession) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	ctx, cls := context.WithTimeout(context.Background(), s.m.opTimeout)
+	defer cls()
+	s.session.EndSession(ctx)
+	s.m.active.Done()
+	return nil
+}
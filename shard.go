@@ -0,0 +1,80 @@
+package mongods
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// shardValueLen is the number of hex digits of the key hash stored in the
+// shard key field, enough to split the collection in 2^32 chunks.
+const shardValueLen = 8
+
+// shardValue returns the value of the shard key field of the document
+// storing key, which is a prefix of the hash of its idString, so keys are
+// spread evenly across shards whatever their distribution.
+func (m *MongoDS) shardValue(key datastore.Key) string {
+	return m.shardHash(m.idString(key))
+}
+
+func (m *MongoDS) shardHash(id string) string {
+	h := sha256.Sum256([]byte(m.foldKey(id)))
+	return hex.EncodeToString(h[:])[:shardValueLen]
+}
+
+// docFilter returns the filter matching the document storing key. If a
+// shard key is configured, it includes the shard key value, so mongos
+// routes the operation to the shard holding the document, and upserts
+// store it in the documents they insert.
+func (m *MongoDS) docFilter(key datastore.Key) (bson.M, error) {
+	id, err := m.docID(key)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"_id": id}
+	if m.shardKey != "" {
+		filter[m.shardKey] = m.shardValue(key)
+	}
+	return filter, nil
+}
+
+// internalFilter returns the filter matching the internal document id,
+// such as the Check probe, including its shard key value.
+func (m *MongoDS) internalFilter(id string) bson.M {
+	filter := bson.M{"_id": id}
+	if m.shardKey != "" {
+		filter[m.shardKey] = m.shardHash(id)
+	}
+	return filter
+}
+
+// docsFilter returns the filter matching the documents storing keys,
+// including their shard key values if a shard key is configured.
+func (m *MongoDS) docsFilter(keys []datastore.Key) (bson.M, error) {
+	ids, err := m.keyIDs(keys)
+	if err != nil {
+		return nil, err
+	}
+	filter := bson.M{"_id": bson.M{"$in": ids}}
+	if m.shardKey != "" {
+		vals := make(bson.A, len(keys))
+		for i, k := range keys {
+			vals[i] = m.shardValue(k)
+		}
+		filter[m.shardKey] = bson.M{"$in": vals}
+	}
+	return filter, nil
+}
+
+// shardKeyIndex is the index on the shard key field, which sharding
+// the collection requires.
+func shardKeyIndex(field string) mongo.IndexModel {
+	return mongo.IndexModel{
+		Keys:    bson.M{field: 1},
+		Options: options.Index().SetName(field + "_shard"),
+	}
+}
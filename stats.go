@@ -0,0 +1,112 @@
+package mongods
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var _ datastore.PersistentDatastore = (*MongoDS)(nil)
+
+// DiskUsage returns the storage size of the collection plus the size of
+// its indexes. On sharded clusters, the sizes of every shard are summed.
+func (m *MongoDS) DiskUsage() (uint64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+
+	ctx, cls := context.WithTimeout(context.Background(), m.opTimeout)
+	defer cls()
+	stats, err := m.collStats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	var total uint64
+	for _, s := range stats {
+		total += toUint64(s["storageSize"]) + toUint64(s["totalIndexSize"])
+	}
+	return total, nil
+}
+
+// Stats holds statistics of the collection storing the key-values, summed
+// over every shard on sharded clusters. Sizes are in bytes.
+type Stats struct {
+	// Count is the number of documents, which includes internal ones.
+	Count uint64
+	// DataSize is the uncompressed size of the documents.
+	DataSize uint64
+	// StorageSize is the size allocated on disk for the documents.
+	StorageSize uint64
+	// IndexSize is the size of all the indexes.
+	IndexSize uint64
+	// AvgObjSize is the average uncompressed size of a document.
+	AvgObjSize uint64
+}
+
+// Stats returns statistics of the collection from the collStats command.
+func (m *MongoDS) Stats(ctx context.Context) (Stats, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return Stats{}, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	stats, err := m.collStats(ctx)
+	if err != nil {
+		return Stats{}, err
+	}
+	var res Stats
+	for _, s := range stats {
+		res.Count += toUint64(s["count"])
+		res.DataSize += toUint64(s["size"])
+		res.StorageSize += toUint64(s["storageSize"])
+		res.IndexSize += toUint64(s["totalIndexSize"])
+	}
+	if res.Count > 0 {
+		res.AvgObjSize = res.DataSize / res.Count
+	}
+	return res, nil
+}
+
+// collStats runs the collStats command and returns the stats of each
+// shard of the collection, or a single element if it isn't sharded.
+func (m *MongoDS) collStats(ctx context.Context) ([]bson.M, error) {
+	var res bson.M
+	cmd := bson.D{{Key: "collStats", Value: m.col.Name()}}
+	if err := m.db.RunCommand(ctx, cmd).Decode(&res); err != nil {
+		return nil, fmt.Errorf("running collStats: %w", err)
+	}
+	if sharded, _ := res["sharded"].(bool); !sharded {
+		return []bson.M{res}, nil
+	}
+	shards, ok := res["shards"].(bson.M)
+	if !ok {
+		return []bson.M{res}, nil
+	}
+	stats := make([]bson.M, 0, len(shards))
+	for _, s := range shards {
+		if s, ok := s.(bson.M); ok {
+			stats = append(stats, s)
+		}
+	}
+	return stats, nil
+}
+
+// toUint64 converts the numeric types a command result may use.
+func toUint64(v interface{}) uint64 {
+	switch n := v.(type) {
+	case int32:
+		return uint64(n)
+	case int64:
+		return uint64(n)
+	case float64:
+		return uint64(n)
+	}
+	return 0
+}
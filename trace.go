@@ -0,0 +1,60 @@
+package mongods
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/textileio/go-ds-mongo"
+
+// redactedKey replaces keys in span attributes when key redaction
+// is enabled.
+const redactedKey = "<redacted>"
+
+// spanParent returns a context carrying the span of ctx, if any, but
+// neither its cancellation nor its deadline, to parent the spans of the
+// operations that must run even once ctx is done, such as the abort of a
+// transaction.
+func spanParent(ctx context.Context) context.Context {
+	return trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx))
+}
+
+// startOp instruments the operation op on key, which may also be a query
+// prefix. It starts a span named after the operation as a child of the
+// span in ctx, if any, and returns the context to run the operation with.
+// The returned func must be called with a pointer to the operation error
+// once it's done, and ends the span, records metrics and logs the
+// operation if it was slower than the configured threshold. The outcome
+// also feeds the circuit breaker, if enabled, and write conflicts are
+// wrapped with ErrWriteConflict. Since it's started by the unexported
+// methods, the datastore lock acquisition isn't part of the measured
+// duration.
+func (m *MongoDS) startOp(ctx context.Context, op string, key string) (context.Context, func(*error)) {
+	start := time.Now()
+	spanKey := key
+	if m.redactKeys {
+		spanKey = redactedKey
+	}
+	ctx, span := m.tracer.Start(ctx, "mongods."+strings.ToUpper(op[:1])+op[1:], trace.WithAttributes(
+		attribute.String("mongods.key", spanKey),
+		attribute.String("mongods.collection", m.col.Name()),
+	))
+	return ctx, func(err *error) {
+		*err = conflictErr(*err)
+		if *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+		m.metrics.observe(op, start, err)
+		m.breaker.record(*err)
+		if elapsed := time.Since(start); m.slowOpThreshold > 0 && elapsed > m.slowOpThreshold {
+			m.logger.Warnf("slow %s operation on %q took %s", op, key, elapsed)
+		}
+	}
+}
@@ -5,15 +5,21 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
 	dsextensions "github.com/textileio/go-datastore-extensions"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/x/mongo/driver"
 )
 
 var (
-	ErrTxnFinalized = errors.New("txn was already finalized")
+	ErrTxnFinalized   = errors.New("txn was already finalized")
+	ErrTxnReadOnly    = errors.New("txn is read-only")
+	ErrTxnUnsupported = errors.New("MongoDB deployment doesn't support transactions")
 )
 
 type mongoTxn struct {
@@ -22,62 +28,159 @@ type mongoTxn struct {
 	// in the docs.
 	lock      sync.Mutex
 	finalized bool
+	readOnly  bool
 
 	m       *MongoDS
 	session mongo.Session
-	ctx     mongo.SessionContext
+	// tracked is the id of the transaction in m.txns.
+	tracked uint64
+	// ctx bounds the operations that don't take a context, such as
+	// Commit, and parents their spans. It's the context WithTransaction
+	// was called with, if any.
+	ctx context.Context
 }
 
 var _ dsextensions.TxnExt = (*mongoTxn)(nil)
+var _ datastore.TTL = (*mongoTxn)(nil)
 
 func (m *MongoDS) NewTransaction(readOnly bool) (datastore.Txn, error) {
-	return m.newTransaction(readOnly)
+	return m.newTransaction(context.Background(), readOnly)
 }
 
 func (m *MongoDS) NewTransactionExtended(readOnly bool) (dsextensions.TxnExt, error) {
-	return m.newTransaction(readOnly)
+	return m.newTransaction(context.Background(), readOnly)
 }
 
-func (m *MongoDS) newTransaction(bool) (dsextensions.TxnExt, error) {
+// WithTransaction runs fn within a new transaction and commits it if fn
+// succeeds. If fn or the commit fail with an error labeled by MongoDB as a
+// TransientTransactionError, the whole transaction is retried on a new
+// session, up to the configured number of attempts. Any other error is
+// returned right away. No retry is attempted if its backoff would end past
+// the deadline of ctx, in which case the last error is returned. The
+// transaction operations that don't take a context and the commit are
+// bounded by ctx, and their spans are children of the span in ctx, if any.
+func (m *MongoDS) WithTransaction(ctx context.Context, readOnly bool, fn func(dsextensions.TxnExt) error) error {
+	for attempt := 1; ; attempt++ {
+		err := m.runTransaction(ctx, readOnly, fn)
+		if err == nil || !hasErrorLabel(err, driver.TransientTransactionError) || attempt >= m.txnMaxAttempts {
+			return err
+		}
+		delay := m.txnBackoff(attempt)
+		if dl, ok := ctx.Deadline(); ok && time.Until(dl) < delay {
+			return err
+		}
+		m.logger.Debugf("retrying transient transaction error (attempt %d): %s", attempt, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+func (m *MongoDS) runTransaction(ctx context.Context, readOnly bool, fn func(dsextensions.TxnExt) error) error {
+	txn, err := m.newTransaction(ctx, readOnly)
+	if err != nil {
+		return err
+	}
+	if err := fn(txn); err != nil {
+		txn.Discard()
+		return err
+	}
+	return txn.Commit()
+}
+
+// hasErrorLabel returns true if err wraps a MongoDB server
+// error carrying label.
+func hasErrorLabel(err error, label string) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorLabel(label)
+}
+
+// newTransaction begins a transaction whose operations that don't take a
+// context, its commit included, are bounded by ctx.
+func (m *MongoDS) newTransaction(ctx context.Context, readOnly bool) (dsextensions.TxnExt, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
 	if m.closed {
 		return nil, ErrClosed
 	}
+	if !m.txnSupported {
+		if !m.txnFallback {
+			return nil, ErrTxnUnsupported
+		}
+		m.fallbackWarn.Do(func() {
+			m.logger.Warnf("MongoDB deployment doesn't support transactions, falling back to non-atomic transactions")
+		})
+		m.active.Add(1)
+		return newDirectTxn(m, ctx, readOnly), nil
+	}
 
 	session, err := m.m.StartSession()
 	if err != nil {
-		return nil, fmt.Errorf("starting mongo session: %s", err)
+		return nil, fmt.Errorf("starting mongo session: %w", err)
 	}
 
-	if err := session.StartTransaction(); err != nil {
-		return nil, fmt.Errorf("starting session txn: %s", err)
+	// Read-only transactions read from a consistent snapshot.
+	txnOpts := options.Transaction()
+	if readOnly {
+		txnOpts.SetReadConcern(readconcern.Snapshot())
+	}
+	if err := session.StartTransaction(txnOpts); err != nil {
+		session.EndSession(context.Background())
+		return nil, fmt.Errorf("starting session txn: %w", err)
 	}
+	m.metrics.txnStarted()
+	m.active.Add(1)
 
-	return &mongoTxn{
-		session: session,
-		m:       m,
-		ctx:     mongo.NewSessionContext(context.Background(), session),
-	}, nil
+	t := &mongoTxn{
+		session:  session,
+		readOnly: readOnly,
+		m:        m,
+		ctx:      ctx,
+	}
+	// The watchdog may fire before add returns, so it's serialized
+	// with the assignment of the id it removes.
+	t.lock.Lock()
+	t.tracked = m.txns.add(t.expire, t.abandon)
+	t.lock.Unlock()
+	return t, nil
 }
 
-func (t *mongoTxn) Commit() error {
+func (t *mongoTxn) Commit() (err error) {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	if t.finalized {
 		return ErrTxnFinalized
 	}
-
-	ctx, cls := context.WithTimeout(context.Background(), t.m.txnTimeout)
+	ctx, cls := context.WithTimeout(t.ctx, t.m.txnTimeout)
 	defer cls()
-	if err := t.session.CommitTransaction(ctx); err != nil {
-		return fmt.Errorf("commiting session txn: %s", err)
+	// A commit that isn't admitted isn't attempted, so the transaction
+	// stays open and can still be committed or discarded.
+	if err = t.m.admit(ctx, writeOp); err != nil {
+		return err
 	}
-	t.finalized = true
-	ctx, cls = context.WithTimeout(context.Background(), t.m.opTimeout)
-	defer cls()
-	t.session.EndSession(ctx)
+	ctx, end := t.m.startOp(ctx, "commit", "")
+	defer end(&err)
 
+	// MongoDB recommends retrying the commit when its outcome is
+	// unknown, as it's safe to commit the same transaction again.
+	for attempt := 1; ; attempt++ {
+		err := t.session.CommitTransaction(ctx)
+		if err == nil {
+			break
+		}
+		if !hasErrorLabel(err, driver.UnknownTransactionCommitResult) || attempt >= t.m.txnMaxAttempts || ctx.Err() != nil {
+			// The transaction can't be committed anymore, and ending
+			// its session aborts it if it's still in progress.
+			t.finalize()
+			return fmt.Errorf("commiting session txn: %w", err)
+		}
+		t.m.logger.Debugf("retrying commit with unknown result (attempt %d): %s", attempt, err)
+	}
+	t.finalize()
 	return nil
 }
 
@@ -87,16 +190,83 @@ func (t *mongoTxn) Discard() {
 	if t.finalized {
 		return
 	}
+	t.abort("discard")
+}
+
+// expire aborts the transaction once it outlived the max lifetime, unless
+// it was finalized meanwhile. It holds the lock like the other methods, so
+// it never runs concurrently with a commit.
+func (t *mongoTxn) expire() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return
+	}
+	t.m.logger.Warnf("aborting transaction open for more than %s, it was never committed nor discarded", t.m.txns.maxLifetime)
+	t.abort("expire")
+}
 
-	ctx, cls := context.WithTimeout(context.Background(), t.m.txnTimeout)
+// abandon aborts the transaction if it's still open once the datastore is
+// closed, before the client is disconnected. Like expire, it waits for a
+// commit in progress.
+func (t *mongoTxn) abandon() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return
+	}
+	t.m.logger.Warnf("aborting transaction still open on close, it was never committed nor discarded")
+	t.abort("abandon")
+}
+
+// abort aborts the transaction as the operation op and finalizes it. The
+// lock must be held.
+func (t *mongoTxn) abort(op string) {
+	// The transaction is aborted even if its context is done.
+	ctx, end := t.m.startOp(spanParent(t.ctx), op, "")
+	ctx, cls := context.WithTimeout(ctx, t.m.txnTimeout)
 	defer cls()
-	if err := t.session.AbortTransaction(ctx); err != nil {
-		log.Errorf("aborting transaction: %s", err)
+	err := t.session.AbortTransaction(ctx)
+	end(&err)
+	if err != nil {
+		t.m.logger.Errorf("aborting transaction: %s", err)
 	}
+	t.finalize()
+}
+
+// finalize marks the transaction as finalized, ends its session and
+// releases what tracks it. The lock must be held.
+func (t *mongoTxn) finalize() {
+	t.finalized = true
+	t.m.metrics.txnFinished()
+	t.m.txns.remove(t.tracked)
 
-	ctx, cls = context.WithTimeout(context.Background(), t.m.opTimeout)
+	ctx, cls := context.WithTimeout(context.Background(), t.m.opTimeout)
 	defer cls()
 	t.session.EndSession(ctx)
+	t.m.active.Done()
+}
+
+// sessionCtx returns a context that runs operations within the transaction
+// session. It's canceled along with parent and bounded by the op timeout.
+func (t *mongoTxn) sessionCtx(parent context.Context) (context.Context, context.CancelFunc) {
+	return t.sessionCtxTimeout(parent, t.m.opTimeout)
+}
+
+// sessionCtxTimeout is like sessionCtx, with a timeout of d unless parent
+// has a deadline.
+func (t *mongoTxn) sessionCtxTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cls := withTimeout(parent, d)
+	ctx = context.WithValue(ctx, txnCtxKey{}, true)
+	return mongo.NewSessionContext(ctx, t.session), cls
+}
+
+type txnCtxKey struct{}
+
+// inTransaction returns true if ctx runs operations within a transaction.
+func inTransaction(ctx context.Context) bool {
+	in, _ := ctx.Value(txnCtxKey{}).(bool)
+	return in
 }
 
 func (t *mongoTxn) Get(key datastore.Key) ([]byte, error) {
@@ -105,7 +275,22 @@ func (t *mongoTxn) Get(key datastore.Key) ([]byte, error) {
 	if t.finalized {
 		return nil, ErrTxnFinalized
 	}
-	return t.m.get(t.ctx, key)
+	ctx, cls := t.sessionCtx(t.ctx)
+	defer cls()
+	return t.m.get(ctx, key)
+}
+
+// GetMany retrieves the values of keys within the transaction. Keys that
+// aren't found are absent from the returned map.
+func (t *mongoTxn) GetMany(ctx context.Context, keys []datastore.Key) (map[datastore.Key][]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.getMany(ctx, keys)
 }
 
 func (t *mongoTxn) Has(key datastore.Key) (bool, error) {
@@ -114,7 +299,22 @@ func (t *mongoTxn) Has(key datastore.Key) (bool, error) {
 	if t.finalized {
 		return false, ErrTxnFinalized
 	}
-	return t.m.has(t.ctx, key)
+	ctx, cls := t.sessionCtx(t.ctx)
+	defer cls()
+	return t.m.has(ctx, key)
+}
+
+// HasMany checks the existence of keys within the transaction. Every
+// requested key is present in the returned map.
+func (t *mongoTxn) HasMany(ctx context.Context, keys []datastore.Key) (map[datastore.Key]bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.hasMany(ctx, keys)
 }
 
 func (t *mongoTxn) GetSize(key datastore.Key) (int, error) {
@@ -123,7 +323,22 @@ func (t *mongoTxn) GetSize(key datastore.Key) (int, error) {
 	if t.finalized {
 		return 0, ErrTxnFinalized
 	}
-	return t.m.getSize(t.ctx, key)
+	ctx, cls := t.sessionCtx(t.ctx)
+	defer cls()
+	return t.m.getSize(ctx, key)
+}
+
+// GetSizeMany returns the value sizes of keys within the transaction.
+// Keys that aren't found are absent from the returned map.
+func (t *mongoTxn) GetSizeMany(ctx context.Context, keys []datastore.Key) (map[datastore.Key]int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.getSizeMany(ctx, keys)
 }
 
 func (t *mongoTxn) Query(q query.Query) (query.Results, error) {
@@ -133,7 +348,9 @@ func (t *mongoTxn) Query(q query.Query) (query.Results, error) {
 		return nil, ErrTxnFinalized
 	}
 	qe := dsextensions.QueryExt{Query: q}
-	return t.m.query(t.ctx, qe)
+	ctx, cls := t.sessionCtxTimeout(t.ctx, t.m.queryTimeout)
+	defer cls()
+	return t.m.query(ctx, qe)
 }
 
 func (t *mongoTxn) QueryExtended(q dsextensions.QueryExt) (query.Results, error) {
@@ -142,23 +359,264 @@ func (t *mongoTxn) QueryExtended(q dsextensions.QueryExt) (query.Results, error)
 	if t.finalized {
 		return nil, ErrTxnFinalized
 	}
-	return t.m.query(t.ctx, q)
+	ctx, cls := t.sessionCtxTimeout(t.ctx, t.m.queryTimeout)
+	defer cls()
+	return t.m.query(ctx, q)
+}
+
+// Count returns the number of entries matching q as seen by the transaction.
+func (t *mongoTxn) Count(ctx context.Context, q query.Query) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return 0, ErrTxnFinalized
+	}
+
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	if _, ok := t.m.serverFilters(q); !ok {
+		res, err := t.m.query(ctx, dsextensions.QueryExt{Query: q})
+		if err != nil {
+			return 0, err
+		}
+		return countResults(res)
+	}
+	return t.m.countDocuments(ctx, q)
 }
 
 func (t *mongoTxn) Delete(key datastore.Key) error {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	if t.finalized {
-		return ErrClosed
+		return ErrTxnFinalized
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
 	}
-	return t.m.delete(t.ctx, key)
+	ctx, cls := t.sessionCtx(t.ctx)
+	defer cls()
+	return t.m.delete(ctx, key)
+}
+
+// DeleteManyKeys deletes keys within the transaction, and returns the ones
+// that existed.
+func (t *mongoTxn) DeleteManyKeys(ctx context.Context, keys []datastore.Key) ([]datastore.Key, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	if t.readOnly {
+		return nil, ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.deleteManyKeys(ctx, keys)
+}
+
+// DeletePrefix deletes every key strictly below prefix within the
+// transaction, and returns how many were removed. All the deletions are
+// part of the transaction, so very large subtrees may exceed the limits
+// MongoDB puts on the size and runtime of a transaction, in which case
+// the commit fails.
+func (t *mongoTxn) DeletePrefix(ctx context.Context, prefix datastore.Key) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return 0, ErrTxnFinalized
+	}
+	if t.readOnly {
+		return 0, ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.deletePrefix(ctx, prefix)
+}
+
+// CompareAndSwap sets the value of key to new within the transaction if
+// its current value is old, and returns whether it did.
+func (t *mongoTxn) CompareAndSwap(ctx context.Context, key datastore.Key, old, new []byte) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return false, ErrTxnFinalized
+	}
+	if t.readOnly {
+		return false, ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.compareAndSwap(ctx, key, old, new)
+}
+
+// PutWithVersion sets the value of key to val within the transaction if
+// key is still at expectedVersion, and returns ErrVersionConflict otherwise.
+func (t *mongoTxn) PutWithVersion(ctx context.Context, key datastore.Key, val []byte, expectedVersion int64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return ErrTxnFinalized
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.putWithVersion(ctx, key, val, expectedVersion)
+}
+
+// DeleteIf deletes key within the transaction if its current value is
+// expected, and returns whether it did.
+func (t *mongoTxn) DeleteIf(ctx context.Context, key datastore.Key, expected []byte) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return false, ErrTxnFinalized
+	}
+	if t.readOnly {
+		return false, ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.deleteIf(ctx, key, expected)
+}
+
+// GetAndDelete deletes key within the transaction and returns the value
+// it had, or ErrNotFound if it doesn't exist.
+func (t *mongoTxn) GetAndDelete(ctx context.Context, key datastore.Key) ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	if t.readOnly {
+		return nil, ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.getAndDelete(ctx, key)
+}
+
+// GetAndPut sets the value of key to new within the transaction and
+// returns the value it replaced, if any.
+func (t *mongoTxn) GetAndPut(ctx context.Context, key datastore.Key, new []byte) ([]byte, bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, false, ErrTxnFinalized
+	}
+	if t.readOnly {
+		return nil, false, ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.getAndPut(ctx, key, new)
+}
+
+// PutIfChanged stores val as the value of key within the transaction
+// unless it's already its value, and returns whether it wrote.
+func (t *mongoTxn) PutIfChanged(ctx context.Context, key datastore.Key, val []byte) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return false, ErrTxnFinalized
+	}
+	if t.readOnly {
+		return false, ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(ctx)
+	defer cls()
+	return t.m.putIfChanged(ctx, key, val)
 }
 
 func (t *mongoTxn) Put(key datastore.Key, val []byte) error {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	if t.finalized {
-		return ErrClosed
+		return ErrTxnFinalized
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(t.ctx)
+	defer cls()
+	return t.m.put(ctx, key, val)
+}
+
+// Batch returns a batch whose operations are written within the
+// transaction when it's committed, or auto-flushed. Committing the batch
+// doesn't commit the transaction: its writes are only applied once the
+// transaction is, and are discarded with it.
+func (t *mongoTxn) Batch() (datastore.Batch, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	if t.readOnly {
+		return nil, ErrTxnReadOnly
+	}
+	return &mongoBatch{
+		ds:        t.m,
+		txn:       t,
+		keys:      map[string]int{},
+		unordered: t.m.unorderedBatch,
+	}, nil
+}
+
+// bulkWrite runs models within the transaction, with a timeout of d.
+func (t *mongoTxn) bulkWrite(models []mongo.WriteModel, opts *options.BulkWriteOptions, d time.Duration) (err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return ErrTxnFinalized
+	}
+	ctx, cls := t.sessionCtxTimeout(t.ctx, d)
+	defer cls()
+	if err = t.m.admit(ctx, writeOp); err != nil {
+		return err
 	}
-	return t.m.put(t.ctx, key, val)
+	ctx, end := t.m.startOp(ctx, "batchWrite", "")
+	defer end(&err)
+	_, err = t.m.col.BulkWrite(ctx, models, opts)
+	return err
+}
+
+func (t *mongoTxn) PutWithTTL(key datastore.Key, val []byte, ttl time.Duration) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return ErrTxnFinalized
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(t.ctx)
+	defer cls()
+	return t.m.putWithTTL(ctx, key, val, ttl)
+}
+
+func (t *mongoTxn) SetTTL(key datastore.Key, ttl time.Duration) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return ErrTxnFinalized
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	ctx, cls := t.sessionCtx(t.ctx)
+	defer cls()
+	return t.m.setTTL(ctx, key, ttl)
+}
+
+func (t *mongoTxn) GetExpiration(key datastore.Key) (time.Time, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return time.Time{}, ErrTxnFinalized
+	}
+	ctx, cls := t.sessionCtx(t.ctx)
+	defer cls()
+	return t.m.getExpiration(ctx, key)
 }
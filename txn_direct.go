@@ -0,0 +1,360 @@
+package mongods
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	dsextensions "github.com/textileio/go-datastore-extensions"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// directTxn is the transaction used on deployments that don't support
+// transactions. Writes are queued and applied on Commit with an ordered
+// bulk write, which has no multi-operation atomicity: a failure leaves
+// the writes that preceded it applied. Discard drops the queued writes,
+// leaving the GridFS files of large values for CollectGarbage.
+type directTxn struct {
+	lock      sync.Mutex
+	finalized bool
+	readOnly  bool
+
+	m *MongoDS
+	// writes queues the writes until Commit.
+	writes *mongoBatch
+	// pending holds the value queued for each written key, by its
+	// pendingKey, or nil if it's deleted, so that reads see the writes
+	// of the transaction. Queries don't.
+	pending map[string][]byte
+	// expires holds the expiration queued for each key whose expiration
+	// was written, the zero time meaning none.
+	expires map[string]time.Time
+	// ctx bounds the operations that don't take a context, the writes
+	// of Commit included, and parents their spans.
+	ctx context.Context
+}
+
+var _ dsextensions.TxnExt = (*directTxn)(nil)
+var _ datastore.TTL = (*directTxn)(nil)
+
+func newDirectTxn(m *MongoDS, ctx context.Context, readOnly bool) *directTxn {
+	return &directTxn{
+		m:        m,
+		ctx:      ctx,
+		readOnly: readOnly,
+		writes:   &mongoBatch{ds: m, ctx: ctx, keys: map[string]int{}},
+		pending:  map[string][]byte{},
+		expires:  map[string]time.Time{},
+	}
+}
+
+// pendingKey returns the key the writes of key are recorded by, which is
+// the same for all the keys that are stored in the same document, such as
+// keys differing by case under a case-insensitive collation.
+func (t *directTxn) pendingKey(key datastore.Key) string {
+	return t.m.docKey(key)
+}
+
+// pendingValue returns the value queued for key, which is nil if it's
+// deleted, and whether a write of key is queued.
+func (t *directTxn) pendingValue(key datastore.Key) ([]byte, bool) {
+	val, ok := t.pending[t.pendingKey(key)]
+	return val, ok
+}
+
+// setPending records the value queued for key, nil if it's deleted, and
+// its expiration, the zero time meaning none.
+func (t *directTxn) setPending(key datastore.Key, val []byte, expireAt time.Time) {
+	t.pending[t.pendingKey(key)] = val
+	t.expires[t.pendingKey(key)] = expireAt
+}
+
+func (t *directTxn) Commit() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return ErrTxnFinalized
+	}
+	t.finalized = true
+	defer t.m.active.Done()
+
+	t.writes.lock.Lock()
+	defer t.writes.lock.Unlock()
+	if err := t.writes.flush(); err != nil {
+		return fmt.Errorf("applying queued writes: %w", err)
+	}
+	return nil
+}
+
+func (t *directTxn) Discard() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.finalized {
+		t.finalized = true
+		t.writes, t.pending, t.expires = nil, nil, nil
+		t.m.active.Done()
+	}
+}
+
+func (t *directTxn) Get(key datastore.Key) ([]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	if val, ok := t.pendingValue(key); ok {
+		if val == nil {
+			return nil, datastore.ErrNotFound
+		}
+		return append([]byte{}, val...), nil
+	}
+	ctx, cls := context.WithTimeout(t.ctx, t.m.opTimeout)
+	defer cls()
+	return t.m.get(ctx, key)
+}
+
+func (t *directTxn) Has(key datastore.Key) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return false, ErrTxnFinalized
+	}
+	if val, ok := t.pendingValue(key); ok {
+		return val != nil, nil
+	}
+	ctx, cls := context.WithTimeout(t.ctx, t.m.opTimeout)
+	defer cls()
+	return t.m.has(ctx, key)
+}
+
+func (t *directTxn) GetSize(key datastore.Key) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return 0, ErrTxnFinalized
+	}
+	if val, ok := t.pendingValue(key); ok {
+		if val == nil {
+			return -1, datastore.ErrNotFound
+		}
+		return len(val), nil
+	}
+	ctx, cls := context.WithTimeout(t.ctx, t.m.opTimeout)
+	defer cls()
+	return t.m.getSize(ctx, key)
+}
+
+func (t *directTxn) Query(q query.Query) (query.Results, error) {
+	return t.QueryExtended(dsextensions.QueryExt{Query: q})
+}
+
+func (t *directTxn) QueryExtended(q dsextensions.QueryExt) (query.Results, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	ctx, cls := context.WithTimeout(t.ctx, t.m.queryTimeout)
+	defer cls()
+	return t.m.query(ctx, q)
+}
+
+func (t *directTxn) Put(key datastore.Key, val []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return ErrTxnFinalized
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	// Large values are uploaded to GridFS right away, like in batches.
+	ctx, cls := context.WithTimeout(t.ctx, t.m.opTimeout)
+	defer cls()
+	op, err := t.m.putModel(ctx, key, val, false, nil)
+	if err != nil {
+		return err
+	}
+	t.writes.queue(key, op, len(key.String())+len(val))
+	t.setPending(key, append([]byte{}, val...), time.Time{})
+	return nil
+}
+
+func (t *directTxn) PutWithTTL(key datastore.Key, val []byte, ttl time.Duration) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return ErrTxnFinalized
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	ctx, cls := context.WithTimeout(t.ctx, t.m.opTimeout)
+	defer cls()
+	expireAt := time.Now().Add(ttl)
+	op, err := t.m.putModel(ctx, key, val, false, &expireAt)
+	if err != nil {
+		return err
+	}
+	t.writes.queue(key, op, len(key.String())+len(val))
+	t.setPending(key, append([]byte{}, val...), expireAt)
+	return nil
+}
+
+// SetTTL queues the update of the expiration of key, and returns
+// ErrNotFound if key doesn't exist, as seen by the transaction.
+func (t *directTxn) SetTTL(key datastore.Key, ttl time.Duration) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return ErrTxnFinalized
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	val, ok := t.pendingValue(key)
+	if ok && val == nil {
+		return datastore.ErrNotFound
+	}
+	if !ok {
+		ctx, cls := context.WithTimeout(t.ctx, t.m.opTimeout)
+		defer cls()
+		has, err := t.m.has(ctx, key)
+		if err != nil {
+			return err
+		}
+		if !has {
+			return datastore.ErrNotFound
+		}
+	}
+	filter, err := t.m.docFilter(key)
+	if err != nil {
+		return err
+	}
+	expireAt := time.Now().Add(ttl)
+	op := mongo.NewUpdateOneModel().
+		SetFilter(filter).
+		SetUpdate(bson.M{"$set": bson.M{"expireAt": expireAt}})
+	t.writes.queue(key, op, len(key.String()))
+	t.expires[t.pendingKey(key)] = expireAt
+	return nil
+}
+
+func (t *directTxn) GetExpiration(key datastore.Key) (time.Time, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return time.Time{}, ErrTxnFinalized
+	}
+	if val, ok := t.pendingValue(key); ok && val == nil {
+		return time.Time{}, datastore.ErrNotFound
+	}
+	if exp, ok := t.expires[t.pendingKey(key)]; ok {
+		return exp, nil
+	}
+	ctx, cls := context.WithTimeout(t.ctx, t.m.opTimeout)
+	defer cls()
+	return t.m.getExpiration(ctx, key)
+}
+
+// GetMany retrieves the values of keys as seen by the transaction. Keys
+// that aren't found are absent from the returned map.
+func (t *directTxn) GetMany(ctx context.Context, keys []datastore.Key) (map[datastore.Key][]byte, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	ctx, cls := withTimeout(ctx, t.m.opTimeout)
+	defer cls()
+	res, err := t.m.getMany(ctx, t.unqueued(keys))
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if val, ok := t.pendingValue(k); ok && val != nil {
+			res[k] = append([]byte{}, val...)
+		}
+	}
+	return res, nil
+}
+
+// HasMany checks the existence of keys as seen by the transaction. Every
+// requested key is present in the returned map.
+func (t *directTxn) HasMany(ctx context.Context, keys []datastore.Key) (map[datastore.Key]bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	ctx, cls := withTimeout(ctx, t.m.opTimeout)
+	defer cls()
+	res, err := t.m.hasMany(ctx, t.unqueued(keys))
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if val, ok := t.pendingValue(k); ok {
+			res[k] = val != nil
+		}
+	}
+	return res, nil
+}
+
+// GetSizeMany returns the value sizes of keys as seen by the transaction.
+// Keys that aren't found are absent from the returned map.
+func (t *directTxn) GetSizeMany(ctx context.Context, keys []datastore.Key) (map[datastore.Key]int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return nil, ErrTxnFinalized
+	}
+	ctx, cls := withTimeout(ctx, t.m.opTimeout)
+	defer cls()
+	res, err := t.m.getSizeMany(ctx, t.unqueued(keys))
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if val, ok := t.pendingValue(k); ok && val != nil {
+			res[k] = len(val)
+		}
+	}
+	return res, nil
+}
+
+// unqueued returns the keys that have no queued write, which must be
+// read from the collection.
+func (t *directTxn) unqueued(keys []datastore.Key) []datastore.Key {
+	var res []datastore.Key
+	for _, k := range keys {
+		if _, ok := t.pendingValue(k); !ok {
+			res = append(res, k)
+		}
+	}
+	return res
+}
+
+func (t *directTxn) Delete(key datastore.Key) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.finalized {
+		return ErrTxnFinalized
+	}
+	if t.readOnly {
+		return ErrTxnReadOnly
+	}
+	filter, err := t.m.docFilter(key)
+	if err != nil {
+		return err
+	}
+	op := mongo.NewDeleteOneModel()
+	op.SetFilter(filter)
+	t.writes.queue(key, op, len(key.String()))
+	t.setPending(key, nil, time.Time{})
+	return nil
+}
@@ -0,0 +1,145 @@
+package mongods
+
+import (
+	"sync"
+	"time"
+)
+
+// txnTracker records when the open transactions started, to report the
+// age of the oldest one, and warn about or abort the transactions left
+// open for too long, which usually were leaked without being committed
+// nor discarded.
+type txnTracker struct {
+	lock sync.Mutex
+	next uint64
+	open map[uint64]trackedTxn
+
+	// stopped is set once the datastore is closed, after which timers
+	// don't run their callbacks, and running counts the callbacks in
+	// progress for stop to wait for.
+	stopped bool
+	running sync.WaitGroup
+
+	// leakWarn is the age after which a warning is logged, and
+	// maxLifetime the age after which transactions are aborted, if
+	// they're positive.
+	leakWarn    time.Duration
+	maxLifetime time.Duration
+	logger      Logger
+}
+
+type trackedTxn struct {
+	start  time.Time
+	warn   *time.Timer
+	expire *time.Timer
+	abort  func()
+}
+
+func newTxnTracker(leakWarn, maxLifetime time.Duration, logger Logger) *txnTracker {
+	return &txnTracker{
+		open:        make(map[uint64]trackedTxn),
+		leakWarn:    leakWarn,
+		maxLifetime: maxLifetime,
+		logger:      logger,
+	}
+}
+
+// add records a transaction starting now, and returns the id to remove
+// it with once it's finalized. expire is called if the transaction is
+// still open past the max lifetime, and abort if it's still open once the
+// datastore is closed.
+func (tt *txnTracker) add(expire, abort func()) uint64 {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	tt.next++
+	id := tt.next
+	t := trackedTxn{start: time.Now(), abort: abort}
+	if tt.leakWarn > 0 {
+		t.warn = time.AfterFunc(tt.leakWarn, tt.callback(func() {
+			tt.logger.Warnf("transaction open for more than %s, it may have been leaked without Commit or Discard", tt.leakWarn)
+		}))
+	}
+	if tt.maxLifetime > 0 {
+		t.expire = time.AfterFunc(tt.maxLifetime, tt.callback(expire))
+	}
+	tt.open[id] = t
+	return id
+}
+
+// callback wraps the timer callback f so it doesn't run once the tracker
+// is stopped, and stop waits for it if it's already running.
+func (tt *txnTracker) callback(f func()) func() {
+	return func() {
+		tt.lock.Lock()
+		if tt.stopped {
+			tt.lock.Unlock()
+			return
+		}
+		tt.running.Add(1)
+		tt.lock.Unlock()
+		defer tt.running.Done()
+		f()
+	}
+}
+
+// stop stops the timers of the open transactions, waits for the callbacks
+// already running, and returns the abort functions of the transactions
+// still open.
+func (tt *txnTracker) stop() []func() {
+	tt.lock.Lock()
+	tt.stopped = true
+	aborts := make([]func(), 0, len(tt.open))
+	for _, t := range tt.open {
+		t.stopTimers()
+		aborts = append(aborts, t.abort)
+	}
+	tt.lock.Unlock()
+	// Callbacks finalizing their transaction remove it, which requires
+	// the lock.
+	tt.running.Wait()
+	return aborts
+}
+
+// remove stops tracking the transaction id.
+func (tt *txnTracker) remove(id uint64) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	if t, ok := tt.open[id]; ok {
+		t.stopTimers()
+		delete(tt.open, id)
+	}
+}
+
+func (t trackedTxn) stopTimers() {
+	if t.warn != nil {
+		t.warn.Stop()
+	}
+	if t.expire != nil {
+		t.expire.Stop()
+	}
+}
+
+// oldest returns the age of the oldest open transaction, or zero if none
+// is open.
+func (tt *txnTracker) oldest() time.Duration {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	var start time.Time
+	for _, t := range tt.open {
+		if start.IsZero() || t.start.Before(start) {
+			start = t.start
+		}
+	}
+	if start.IsZero() {
+		return 0
+	}
+	return time.Since(start)
+}
+
+// OldestTxnAge returns how long the oldest open transaction has been open
+// for, or zero if no transaction is open. Transactions hold resources on
+// the server until they're committed or discarded, so an age growing past
+// the transaction timeout usually reveals a leaked transaction.
+func (m *MongoDS) OldestTxnAge() time.Duration {
+	return m.txns.oldest()
+}
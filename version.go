@@ -0,0 +1,123 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrVersionConflict is returned by PutWithVersion when the key isn't at
+// the expected version anymore.
+var ErrVersionConflict = errors.New("key isn't at the expected version")
+
+// GetWithVersion returns the value of key along with its version, which
+// is incremented by every write of the value, or ErrNotFound. Keys last
+// written before versions were recorded are at version 0.
+func (m *MongoDS) GetWithVersion(ctx context.Context, key datastore.Key) ([]byte, int64, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, 0, ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.getWithVersion(ctx, key)
+}
+
+func (m *MongoDS) getWithVersion(ctx context.Context, key datastore.Key) (_ []byte, _ int64, err error) {
+	if err = m.admit(ctx, readOp); err != nil {
+		return nil, 0, err
+	}
+	ctx, end := m.startOp(ctx, "getWithVersion", key.String())
+	defer end(&err)
+	kv, err := m.findKeyValue(ctx, m.pointReader(ctx), key)
+	if err != nil {
+		return nil, 0, err
+	}
+	val, err := m.loadValue(ctx, kv)
+	if err != nil {
+		return nil, 0, err
+	}
+	return val, kv.Version, nil
+}
+
+// PutWithVersion sets the value of key to val only if key is still at
+// expectedVersion, as returned by GetWithVersion or GetMeta, and returns
+// ErrVersionConflict otherwise. An expectedVersion of 0 means the key must
+// not exist. On success, the key is at expectedVersion+1. Like Put, it
+// drops the expiration the key may have had.
+func (m *MongoDS) PutWithVersion(ctx context.Context, key datastore.Key, val []byte, expectedVersion int64) error {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	ctx, cls := withTimeout(ctx, m.opTimeout)
+	defer cls()
+	return m.putWithVersion(ctx, key, val, expectedVersion)
+}
+
+func (m *MongoDS) putWithVersion(ctx context.Context, key datastore.Key, val []byte, expectedVersion int64) (err error) {
+	if err = m.admit(ctx, writeOp); err != nil {
+		return err
+	}
+	ctx, end := m.startOp(ctx, "putWithVersion", key.String())
+	defer end(&err)
+	if expectedVersion < 0 {
+		return fmt.Errorf("invalid version %d", expectedVersion)
+	}
+
+	filter, err := m.docFilter(key)
+	if err != nil {
+		return err
+	}
+	ev, err := m.encode(m.idString(key), val)
+	if err != nil {
+		return err
+	}
+	update := m.putUpdate(ev, nil)
+	var file *primitive.ObjectID
+	if m.inGridFS(ev) {
+		id, err := m.uploadFile(ctx, key, ev.data)
+		if err != nil {
+			return err
+		}
+		file = &id
+		update = m.filePutUpdate(id, ev, nil)
+	}
+
+	// Version 0 matches keys that don't exist, by upserting, as well as
+	// keys written before versions were recorded.
+	filter["ver"] = expectedVersion
+	opts := options.FindOneAndUpdate().
+		SetProjection(bson.M{"f": 1}).
+		SetReturnDocument(options.Before)
+	if expectedVersion == 0 {
+		filter["ver"] = bson.M{"$exists": false}
+		opts.SetUpsert(true)
+	}
+	var prev keyValue
+	err = m.col.FindOneAndUpdate(ctx, filter, m.upsertKey(update, key), opts).Decode(&prev)
+	switch {
+	case err == nil:
+		m.replacedFile(ctx, prev.File)
+		return nil
+	case errors.Is(err, mongo.ErrNoDocuments) && expectedVersion == 0:
+		return nil
+	}
+	if file != nil {
+		m.deleteFile(ctx, *file)
+	}
+	if errors.Is(err, mongo.ErrNoDocuments) || mongo.IsDuplicateKeyError(err) {
+		return ErrVersionConflict
+	}
+	return fmt.Errorf("inserting/updating key-value: %w", err)
+}
@@ -0,0 +1,267 @@
+package mongods
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-datastore"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrWatchUnsupported = errors.New("MongoDB deployment doesn't support change streams")
+
+// changeStreamHistoryLost is the code of the error MongoDB returns when
+// resuming a change stream from a point no longer in the oplog.
+const changeStreamHistoryLost = 286
+
+// ResumeToken identifies a point of a change stream. It can be stored to
+// resume watching from that point later on.
+type ResumeToken []byte
+
+// WatchOption configures Watch.
+type WatchOption func(*watchConfig)
+
+type watchConfig struct {
+	resumeAfter ResumeToken
+}
+
+// WithResumeToken makes Watch report the changes that happened after
+// token, as returned in the ResumeToken of an Event. Resuming relies on
+// the oplog: if it no longer holds the changes that followed token, Watch
+// logs a warning and only reports new changes, so the oplog retention must
+// exceed the time watchers may stay disconnected for events not to be lost.
+func WithResumeToken(token ResumeToken) WatchOption {
+	return func(c *watchConfig) {
+		c.resumeAfter = token
+	}
+}
+
+// EventType is the kind of change an Event reports.
+type EventType int
+
+const (
+	// EventInsert reports a key that was created.
+	EventInsert EventType = iota
+	// EventUpdate reports a key whose value or expiration changed.
+	EventUpdate
+	// EventDelete reports a key that was deleted, or that expired.
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventInsert:
+		return "insert"
+	case EventUpdate:
+		return "update"
+	case EventDelete:
+		return "delete"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event is a change of a key observed by Watch. Value is the value of the
+// key when the event is read, which may already reflect later changes, and
+// is nil for deletions or if the key was deleted since. ResumeToken can be
+// passed to WithResumeToken to resume watching after this event.
+type Event struct {
+	Type        EventType
+	Key         datastore.Key
+	Value       []byte
+	ResumeToken ResumeToken
+}
+
+// changeEvent is the subset of a change stream event Watch uses.
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID interface{} `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument *keyValue `bson:"fullDocument"`
+}
+
+// Watch opens a change stream reporting the changes of the keys strictly
+// below prefix, in the order they were applied. The channel is closed once
+// ctx is canceled or the datastore is closed, or if the stream fails with an error the driver can't
+// recover from, which is logged. Change streams need a replica set or a
+// sharded cluster, otherwise Watch returns ErrWatchUnsupported. The
+// deletion of hashed keys, or of any key if keys aren't stored as string
+// ids, isn't reported, since only their _id is known then.
+//
+// The driver transparently resumes the stream after transient errors, such
+// as a failover. To survive a restart without missing events, store the
+// ResumeToken of the last event processed and pass it with WithResumeToken.
+func (m *MongoDS) Watch(ctx context.Context, prefix datastore.Key, opts ...WatchOption) (<-chan Event, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if !m.txnSupported {
+		return nil, ErrWatchUnsupported
+	}
+
+	// The key filter is applied to both the _id of the document, which
+	// is the only field deletions have, and the full document, which
+	// holds the full key of hashed keys.
+	keyRange := m.prefixRange(prefix.String())
+	match := bson.M{
+		"operationType": bson.M{"$in": bson.A{"insert", "update", "replace", "delete"}},
+		"$or": bson.A{
+			bson.M{"documentKey._id": keyRange},
+			bson.M{"fullDocument.k": keyRange},
+		},
+	}
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: match}}}
+
+	var config watchConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	// The stream is stopped by Close too, which waits for it to be
+	// closed before disconnecting.
+	ctx, cancel := context.WithCancel(ctx)
+	cs, err := m.openChangeStream(ctx, pipeline, config.resumeAfter)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	go func() {
+		select {
+		case <-m.closing.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	m.active.Add(1)
+	events := make(chan Event)
+	go func() {
+		defer m.active.Done()
+		defer cancel()
+		defer close(events)
+		for {
+			if !m.streamEvents(ctx, cs, events) {
+				return
+			}
+			// The driver failed to resume the stream because the oplog
+			// rolled over, so watching restarts from the current time.
+			if cs, err = m.openChangeStream(ctx, pipeline, nil); err != nil {
+				m.logger.Errorf("reopening change stream: %s", err)
+				return
+			}
+		}
+	}()
+	return events, nil
+}
+
+// openChangeStream opens a change stream running pipeline, resuming after
+// token if it isn't nil. If the changes following token are no longer in
+// the oplog, it opens a stream starting at the current time instead.
+func (m *MongoDS) openChangeStream(ctx context.Context, pipeline mongo.Pipeline, token ResumeToken) (*mongo.ChangeStream, error) {
+	opts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
+	if token != nil {
+		opts.SetResumeAfter(bson.Raw(token))
+	}
+	openCtx, cls := context.WithTimeout(ctx, m.opTimeout)
+	defer cls()
+	cs, err := m.col.Watch(openCtx, pipeline, opts)
+	if token != nil && isHistoryLost(err) {
+		m.logger.Warnf("resume token is no longer in the oplog, changes may have been missed: %s", err)
+		return m.openChangeStream(ctx, pipeline, nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening change stream: %w", err)
+	}
+	return cs, nil
+}
+
+// streamEvents sends the events of cs until it ends, and closes it. It
+// returns true if the stream ended because its history was lost while
+// resuming, in which case it can be reopened.
+func (m *MongoDS) streamEvents(ctx context.Context, cs *mongo.ChangeStream, events chan<- Event) bool {
+	defer func() {
+		if err := cs.Close(context.Background()); err != nil {
+			m.logger.Errorf("closing change stream: %s", err)
+		}
+	}()
+	for cs.Next(ctx) {
+		var ce changeEvent
+		if err := cs.Decode(&ce); err != nil {
+			m.logger.Errorf("decoding change event: %s", err)
+			continue
+		}
+		key, err := m.eventKey(ce)
+		if err != nil {
+			m.logger.Errorf("decoding changed key: %s", err)
+			continue
+		}
+		e, err := m.event(ctx, ce, key)
+		if err != nil {
+			m.logger.Errorf("reading changed value: %s", err)
+		}
+		e.ResumeToken = ResumeToken(cs.ResumeToken())
+		select {
+		case events <- e:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	err := cs.Err()
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	if isHistoryLost(err) {
+		m.logger.Warnf("change stream history lost, changes may have been missed: %s", err)
+		return true
+	}
+	m.logger.Errorf("watching changes: %s", err)
+	return false
+}
+
+// isHistoryLost returns true if err reports that a change stream can't be
+// resumed since the oplog no longer holds the changes to resume from.
+func isHistoryLost(err error) bool {
+	var se mongo.ServerError
+	return errors.As(err, &se) && se.HasErrorCode(changeStreamHistoryLost)
+}
+
+// eventKey returns the key changed by a change stream event, read from the
+// full document if the event has one.
+func (m *MongoDS) eventKey(ce changeEvent) (datastore.Key, error) {
+	kv := keyValue{ID: ce.DocumentKey.ID}
+	if ce.FullDocument != nil {
+		kv = *ce.FullDocument
+	}
+	k, err := m.kvKey(kv)
+	if err != nil {
+		return datastore.Key{}, err
+	}
+	return datastore.RawKey(k), nil
+}
+
+// event turns a change stream event on key into an Event, loading the
+// value of the key if the change has one.
+func (m *MongoDS) event(ctx context.Context, ce changeEvent, key datastore.Key) (Event, error) {
+	e := Event{Type: EventUpdate, Key: key}
+	switch ce.OperationType {
+	case "insert":
+		e.Type = EventInsert
+	case "delete":
+		e.Type = EventDelete
+	}
+	if ce.FullDocument == nil {
+		return e, nil
+	}
+	ctx, cls := context.WithTimeout(ctx, m.opTimeout)
+	defer cls()
+	val, err := m.loadValue(ctx, *ce.FullDocument)
+	if err != nil {
+		return e, err
+	}
+	e.Value = val
+	return e, nil
+}